@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// backoff is exponential backoff with jitter
+// interval = min(max, initial * multiplier^attempt) * (1 ± jitter)
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	// 0 ~ 1, randomize interval so clients don't reconnect in lockstep
+	jitter  float64
+	attempt int
+}
+
+func newBackoff(conf *ReconnectConfig) *backoff {
+	return &backoff{
+		initial:    time.Second * time.Duration(conf.Interval),
+		max:        time.Second * time.Duration(conf.MaxInterval),
+		multiplier: conf.Multiplier,
+		jitter:     *conf.Jitter,
+	}
+}
+
+// Next returns the interval before next attempt
+func (b *backoff) Next() time.Duration {
+	interval := float64(b.initial) * math.Pow(b.multiplier, float64(b.attempt))
+	if interval > float64(b.max) {
+		interval = float64(b.max)
+	} else {
+		b.attempt++
+	}
+
+	delta := interval * b.jitter
+	interval = interval - delta + rand.Float64()*2*delta
+	return time.Duration(interval)
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
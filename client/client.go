@@ -1,78 +1,374 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
 	"github.com/astaxie/beego/logs"
-	"github.com/xtaci/smux"
 	"io"
+	"math/rand"
 	"net"
+	"strconv"
 	"time"
 )
 
+// errGoAway is returned by run if gateway is shutting down
+var errGoAway = errors.New("gateway goaway")
+
 type Client struct {
-	clientID   string
-	serverAddr string
+	conf *Config
+	// dial gateway with tls if not nil
+	tlsConfig *tls.Config
+	// internal targets allowed to dial, nil allows all
+	policy *Policy
+	// name -> local service
+	services map[string]*ServiceConfig
+	// connection state and health of gateways
+	state *stateMachine
+	// measured by heartbeat, reset on each connection
+	rtt *common.RTTStats
+	// compressed streams of all listeners
+	compressStats *common.CompressStats
+}
+
+// session is negotiated with gateway in handshake
+// streams of a draining session keep using the one of their own
+type session struct {
+	version  int
+	features uint32
+	mux      string
+}
+
+func NewClient(conf *Config) (*Client, error) {
+	c := &Client{
+		conf:     conf,
+		services: make(map[string]*ServiceConfig),
+		state:    newStateMachine(conf.ServerAddrs),
+		rtt:      &common.RTTStats{},
+
+		compressStats: &common.CompressStats{},
+	}
+
+	// quic always uses tls
+	if conf.Transport == TransportQUIC || conf.TLS.Enable {
+		tlsConfig, err := newTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		c.tlsConfig = tlsConfig
+	}
+
+	if conf.PolicyFile != "" {
+		policy, err := LoadPolicy(conf.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.policy = policy
+		logs.Info("policy: %s", policy)
+	} else {
+		logs.Warn("no policy file, all internal targets are allowed")
+	}
+
+	for _, svc := range conf.Services {
+		c.services[svc.Name] = svc
+		logs.Info("service %s: %s %s", svc.Name, svc.Protocol, svc.Addr)
+	}
+	return c, nil
 }
 
-func NewClient(clientID string, serverAddr string) *Client {
-	return &Client{
-		clientID,
-		serverAddr,
+// Status returns a snapshot of the connection state
+func (c *Client) Status() Status {
+	status := c.state.Status()
+	rtt := c.rtt.Get()
+	if rtt.Samples > 0 {
+		status.RTT = rtt.Smoothed.String()
+		status.LastRTT = rtt.Last.String()
+		status.Jitter = rtt.Jitter.String()
 	}
+	status.CompressRaw, status.CompressWire = c.compressStats.Get()
+	status.CompressRatio = c.compressStats.Ratio()
+	return status
+}
+
+// Watch calls f on every connection state change
+func (c *Client) Watch(f func(Status)) {
+	c.state.Watch(f)
+}
+
+// pickGateway returns the first healthy gateway in configured order
+// a gateway is unhealthy after failing failover_threshold times in a row
+// or sending goaway, it is retried after max_interval or when all gateways
+// are unhealthy
+func (c *Client) pickGateway() string {
+	addrs := make([]string, len(c.conf.ServerAddrs))
+	copy(addrs, c.conf.ServerAddrs)
+	if c.conf.Reconnect.GatewayOrder == GatewayOrderRandom {
+		rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	}
+
+	cooldown := time.Second * time.Duration(c.conf.Reconnect.MaxInterval)
+	status := c.state.Status()
+	gateways := make(map[string]GatewayStatus)
+	for _, gw := range status.Gateways {
+		gateways[gw.Addr] = gw
+	}
+
+	var skipped []string
+	for _, addr := range addrs {
+		gw := gateways[addr]
+		if (gw.Failures < c.conf.Reconnect.FailoverThreshold ||
+			time.Since(gw.LastFailAt) > cooldown) &&
+			time.Since(gw.LastGoAwayAt) > cooldown {
+			if len(skipped) > 0 {
+				logs.Warn("gateway %v unhealthy, failover to %s", skipped, addr)
+			}
+			return addr
+		}
+		skipped = append(skipped, addr)
+	}
+
+	// all unhealthy, try the one failed longest ago
+	addr := addrs[0]
+	for _, a := range addrs {
+		if gateways[a].LastFailAt.Before(gateways[addr].LastFailAt) {
+			addr = a
+		}
+	}
+	return addr
 }
 
 func (c *Client) Run() {
+	bo := newBackoff(c.conf.Reconnect)
 	for {
-		err := c.run()
+		addr := c.pickGateway()
+		connectedAt, err := c.run(addr)
+		if err == errGoAway {
+			// gateway is going away, connect to another one right away
+			bo.Reset()
+			continue
+		}
 		if err != nil && err != io.EOF {
-			logs.Error("%v", err)
+			logs.Error("%s: %v", addr, err)
+		}
+
+		if connectedAt.IsZero() {
+			c.state.recordFailure(addr, err)
+		} else if time.Since(connectedAt) >= bo.max {
+			// connection was stable, start over
+			bo.Reset()
+		}
+
+		interval := bo.Next()
+		// retrying won't help until gateway or client config changes
+		var replyErr *common.ReplyError
+		if errors.As(err, &replyErr) && replyErr.Code != common.CodeAlreadyOnline {
+			rejected := time.Second * time.Duration(c.conf.Reconnect.RejectedInterval)
+			if interval < rejected {
+				interval = rejected
+			}
 		}
-		logs.Warn("reconnect %s", c.serverAddr)
-		time.Sleep(time.Second * 1)
+
+		c.state.transit(func(status *Status) {
+			status.State = StateBackoff
+			status.Attempt = bo.attempt
+			status.NextRetry = time.Now().Add(interval)
+		})
+		logs.Warn("reconnect after %s", interval)
+		time.Sleep(interval)
 	}
 }
 
-func (c *Client) run() error {
-	conn, err := net.Dial("tcp", c.serverAddr)
+// run connects to gateway addr and serves streams until disconnected
+// connectedAt is zero if handshake is not finished
+// errGoAway is returned if gateway is shutting down, streams in progress
+// are served by the session in background
+func (c *Client) run(addr string) (connectedAt time.Time, err error) {
+	c.state.transit(func(status *Status) {
+		status.State = StateConnecting
+		status.Gateway = addr
+		status.NextRetry = time.Time{}
+	})
+	tun, err := c.dial(addr)
 	if err != nil {
-		return err
+		return connectedAt, err
+	}
+	// tunnel is closed by drain after goaway
+	draining := false
+	defer func() {
+		if !draining {
+			tun.Close()
+		}
+	}()
+
+	c.state.transit(func(status *Status) {
+		status.State = StateHandshaking
+	})
+	sess, err := c.handshake(tun.Conn(), tun.Muxes())
+	if err != nil {
+		return connectedAt, err
+	}
+
+	connectedAt = time.Now()
+	c.rtt.Reset()
+	c.state.recordConnected(addr)
+	c.state.transit(func(status *Status) {
+		status.State = StateConnected
+		status.Version = sess.version
+		status.Features = common.FeatureString(sess.features)
+		status.Mux = sess.mux
+	})
+
+	// 创建mux session
+	muxSess, err := tun.Mux(sess.mux)
+	if err != nil {
+		return connectedAt, err
 	}
-	defer conn.Close()
+	defer func() {
+		if !draining {
+			muxSess.Close()
+		}
+	}()
+
+	// 控制流，用于注册listener等
+	ctrl, err := c.openControl(muxSess)
+	if err != nil {
+		return connectedAt, err
+	}
+	go c.serveControl(ctrl, sess)
+
+	// 等待mux stream
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			stream, err := muxSess.AcceptStream()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+
+			go c.handleStream(stream, sess)
+		}
+	}()
+
+	select {
+	case err = <-acceptErr:
+		return connectedAt, err
+	case goAway := <-ctrl.goAway:
+		draining = true
+		c.state.recordGoAway(addr)
+		go drain(muxSess, tun, time.Duration(goAway.DrainTimeout)*time.Second)
+		return connectedAt, errGoAway
+	}
+}
+
+// drain closes the session after its streams are done or timeout
+func drain(muxSess mux.Session, tun io.Closer, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for !muxSess.IsClosed() && muxSess.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			logs.Warn("drain timeout, %d streams dropped", muxSess.NumStreams())
+			break
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	muxSess.Close()
+	tun.Close()
+	logs.Info("session drained")
+}
+
+// muxes are the multiplexers the tunnel supports
+func (c *Client) handshake(conn net.Conn, muxes []string) (*session, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	defer conn.SetDeadline(time.Time{})
 
 	// 发送handshake包
-	handshakeReq := common.HandshakeReq{ClientID: c.clientID}
+	handshakeReq := common.HandshakeReq{
+		ClientID:   c.conf.ClientID,
+		InstanceID: c.conf.InstanceID,
+		Group:      c.conf.Group,
+		MinVersion: common.MinProtocolVersion,
+		Version:    common.ProtocolVersion,
+		Features:   common.SupportedFeatures,
+		Muxes:      muxes,
+	}
 	buf, err := handshakeReq.Encode()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(time.Second * 3))
 	_, err = conn.Write(buf)
-	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 创建mux session
-	mux, err := smux.Client(conn, nil)
+	// 使用secret对challenge签名
+	challenge := common.Challenge{}
+	err = challenge.Decode(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer mux.Close()
 
-	// 等待mux stream
-	for {
-		stream, err := mux.AcceptStream()
-		if err != nil {
-			return err
+	auth := common.HandshakeAuth{
+		Signature: common.Sign(c.conf.Secret, c.conf.ClientID, challenge.Nonce),
+	}
+	buf, err = auth.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// 等待网关回复握手结果
+	reply := common.HandshakeReply{}
+	err = reply.Decode(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reply.Err()
+	if err != nil {
+		return nil, fmt.Errorf("handshake rejected by gateway: %w", err)
+	}
+
+	// gateway picks version in our range, double check for older gateway
+	if reply.Version < common.MinProtocolVersion || reply.Version > common.ProtocolVersion {
+		return nil, &common.ReplyError{
+			Code:    common.CodeVersionUnsupported,
+			Message: fmt.Sprintf("gateway replies protocol version %d", reply.Version),
 		}
+	}
 
-		go c.handleStream(stream)
+	// older gateway only supports smux
+	if reply.Mux == "" {
+		reply.Mux = mux.TypeSmux
+	}
+	if !contains(muxes, reply.Mux) {
+		return nil, &common.ReplyError{
+			Code:    common.CodeProtocolUnsupported,
+			Message: fmt.Sprintf("gateway replies mux %s", reply.Mux),
+		}
 	}
+
+	sess := &session{
+		version:  reply.Version,
+		features: reply.Features & common.SupportedFeatures,
+		mux:      reply.Mux,
+	}
+	logs.Info("handshake success, protocol version %d, features %s, mux %s",
+		sess.version, common.FeatureString(sess.features), sess.mux)
+	return sess, nil
 }
 
-func (c *Client) handleStream(stream net.Conn) {
+// sess is the session the stream is accepted from
+func (c *Client) handleStream(stream net.Conn, sess *session) {
 	defer stream.Close()
 
 	// pp解码
@@ -84,33 +380,73 @@ func (c *Client) handleStream(stream net.Conn) {
 	}
 	logs.Debug("pp %+v", pp)
 
+	protocol, internalAddr, err := c.resolveTarget(pp)
+	if err != nil {
+		logs.Error("resolve target fail: %v", err)
+		var replyErr *common.ReplyError
+		if errors.As(err, &replyErr) {
+			c.replyStream(stream, replyErr.Code, replyErr.Message)
+		}
+		return
+	}
+
 	// 与本地建连接
 	var localConn net.Conn
-	switch pp.InternalProtocol {
+	switch protocol {
 	case "tcp":
-		localConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", pp.InternalIP, pp.InternalPort))
+		localConn, err = net.Dial("tcp", internalAddr)
 		if err != nil {
 			logs.Error("connect to to local fail: %v", err)
+			c.replyStream(stream, common.CodeDialFail, err.Error())
 			return
 		}
 		defer localConn.Close()
 
+		// accept compression of the listener if supported
+		reply := &common.StreamReply{Code: common.CodeOK}
+		if sess.features&common.FeatureCompression != 0 &&
+			common.ValidateCompression(pp.Compression) == nil {
+			reply.Compression = pp.Compression
+		}
+		err = c.writeStreamReply(stream, reply)
+		if err != nil {
+			logs.Error("reply stream fail: %v", err)
+			return
+		}
+
+		tunnelConn, err := common.Compress(stream, reply.Compression, c.compressStats)
+		if err != nil {
+			logs.Error("compress stream fail: %v", err)
+			return
+		}
+		defer tunnelConn.Close()
+
 		// 双向数据拷贝
 		go func() {
 			defer localConn.Close()
-			defer stream.Close()
-			io.Copy(localConn, stream)
+			defer tunnelConn.Close()
+			io.Copy(localConn, tunnelConn)
 		}()
-		io.Copy(stream, localConn)
+		io.Copy(tunnelConn, localConn)
 
 	case "udp":
-		localConn, err = net.Dial("udp", fmt.Sprintf("%s:%d", pp.InternalIP, pp.InternalPort))
+		localConn, err = net.Dial("udp", internalAddr)
 		if err != nil {
 			logs.Error("connect to to local fail: %v", err)
+			c.replyStream(stream, common.CodeDialFail, err.Error())
 			return
 		}
 		defer localConn.Close()
 
+		err = c.replyStream(stream, common.CodeOK, "")
+		if err != nil {
+			logs.Error("reply stream fail: %v", err)
+			return
+		}
+
+		// quic tunnel sends packets as datagrams
+		pc, _ := stream.(mux.PacketConn)
+
 		// read local conn
 		go func() {
 			defer localConn.Close()
@@ -124,6 +460,15 @@ func (c *Client) handleStream(stream net.Conn) {
 				}
 
 				logs.Debug("read %d bytes from local connect", nr)
+				if pc != nil {
+					err = pc.WritePacket(buf[:nr])
+					if err != nil {
+						logs.Warn("write udp to stream fail: %v", err)
+						break
+					}
+					continue
+				}
+
 				// udp packet编码
 				p := common.UDPPacket(buf[:nr])
 				body, err := p.Encode()
@@ -142,8 +487,15 @@ func (c *Client) handleStream(stream net.Conn) {
 
 		// read stream
 		p := common.UDPPacket(make([]byte, 1024*64))
+		readPacket := p.Decode
+		if pc != nil {
+			readPacket = func(io.Reader) (int, error) {
+				return pc.ReadPacket(p)
+			}
+		}
+
 		for {
-			nr, err := p.Decode(stream)
+			nr, err := readPacket(stream)
 			if err != nil {
 				logs.Warn("decode udp from stream fail: %v", err)
 				break
@@ -158,7 +510,57 @@ func (c *Client) handleStream(stream net.Conn) {
 		}
 
 	default:
-		logs.Warn("unsupported protocol %s", pp.InternalProtocol)
+		logs.Warn("unsupported protocol %s", protocol)
+		c.replyStream(stream, common.CodeProtocolUnsupported, protocol)
+	}
+
+}
+
+// resolveTarget returns the protocol and address to dial for pp
+// declared services are trusted, raw ip and port are checked by policy
+func (c *Client) resolveTarget(pp *common.ProxyProtocol) (string, string, error) {
+	if pp.InternalService != "" {
+		svc := c.services[pp.InternalService]
+		if svc == nil {
+			return "", "", &common.ReplyError{
+				Code:    common.CodeUnknownService,
+				Message: pp.InternalService,
+			}
+		}
+
+		if pp.InternalProtocol != "" && pp.InternalProtocol != svc.Protocol {
+			return "", "", &common.ReplyError{
+				Code: common.CodeProtocolUnsupported,
+				Message: fmt.Sprintf("service %s is %s, not %s",
+					svc.Name, svc.Protocol, pp.InternalProtocol),
+			}
+		}
+		return svc.Protocol, svc.Addr, nil
+	}
+
+	// 检查本地策略，避免网关把客户端当作访问内网的跳板
+	if !c.policy.Allow(pp.InternalProtocol, pp.InternalIP, pp.InternalPort) {
+		return "", "", &common.ReplyError{
+			Code:    common.CodeForbidden,
+			Message: fmt.Sprintf("%s %s:%d", pp.InternalProtocol, pp.InternalIP, pp.InternalPort),
+		}
+	}
+	return pp.InternalProtocol, net.JoinHostPort(pp.InternalIP, strconv.Itoa(int(pp.InternalPort))), nil
+}
+
+// replyStream tells gateway the result of dialing internal address
+func (c *Client) replyStream(stream net.Conn, code int, msg string) error {
+	return c.writeStreamReply(stream, &common.StreamReply{Code: code, Message: msg})
+}
+
+func (c *Client) writeStreamReply(stream net.Conn, reply *common.StreamReply) error {
+	buf, err := reply.Encode()
+	if err != nil {
+		return err
 	}
 
+	stream.SetWriteDeadline(time.Now().Add(time.Second * 3))
+	_, err = stream.Write(buf)
+	stream.SetWriteDeadline(time.Time{})
+	return err
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/ICKelin/zta/common"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+)
+
+func TestHandleStream(t *testing.T) {
+	convey.Convey("test handle stream", t, func() {
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer local.Close()
+		go func() {
+			for {
+				conn, err := local.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		c, err := NewClient(&Config{TLS: &TLSConfig{}, Services: []*ServiceConfig{
+			{Name: "web", Protocol: "tcp", Addr: local.Addr().String()},
+		}})
+		convey.So(err, convey.ShouldBeNil)
+
+		open := func(sess *session) *common.StreamReply {
+			stream, peer := net.Pipe()
+			defer stream.Close()
+			go c.handleStream(peer, sess)
+			pp := &common.ProxyProtocol{InternalService: "web", Compression: common.CompressionSnappy}
+			buf, _ := pp.Encode()
+			stream.Write(buf)
+			reply := &common.StreamReply{}
+			convey.So(reply.Decode(stream), convey.ShouldBeNil)
+			return reply
+		}
+
+		// compression is accepted only if negotiated by the session of the stream
+		reply := open(&session{features: common.FeatureCompression})
+		convey.So(reply.Code, convey.ShouldEqual, common.CodeOK)
+		convey.So(reply.Compression, convey.ShouldEqual, common.CompressionSnappy)
+		reply = open(&session{})
+		convey.So(reply.Code, convey.ShouldEqual, common.CodeOK)
+		convey.So(reply.Compression, convey.ShouldEqual, "")
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/astaxie/beego/logs"
+	"net"
+	"sync"
+	"time"
+)
+
+// control is the stream opened by client for control frames
+type control struct {
+	mux     mux.Session
+	stream  net.Conn
+	writeMu sync.Mutex
+	// goaway received from gateway
+	goAway chan *common.GoAway
+}
+
+func (c *Client) openControl(muxSess mux.Session) (*control, error) {
+	stream, err := muxSess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &control{
+		mux:    muxSess,
+		stream: stream,
+		goAway: make(chan *common.GoAway, 1),
+	}, nil
+}
+
+func (ctrl *control) write(buf []byte) error {
+	ctrl.writeMu.Lock()
+	defer ctrl.writeMu.Unlock()
+	ctrl.stream.SetWriteDeadline(time.Now().Add(time.Second * 3))
+	_, err := ctrl.stream.Write(buf)
+	ctrl.stream.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// serveControl registers listeners and handles control frames from gateway
+func (c *Client) serveControl(ctrl *control, sess *session) {
+	defer ctrl.stream.Close()
+
+	for _, l := range c.conf.Listeners {
+		svc := c.services[l.Service]
+		req := &common.RegisterListenerReq{
+			Name:            l.Name,
+			PublicProtocol:  l.PublicProtocol,
+			PublicPort:      l.PublicPort,
+			Hosts:           l.Hosts,
+			Service:         l.Service,
+			ServiceProtocol: svc.Protocol,
+			Compression:     l.Compression,
+		}
+		buf, err := req.Encode()
+		if err != nil {
+			logs.Error("encode register listener fail: %v", err)
+			return
+		}
+
+		err = ctrl.write(buf)
+		if err != nil {
+			logs.Error("register listener %s fail: %v", l.Name, err)
+			return
+		}
+	}
+
+	hb := common.NewHeartbeat(
+		time.Duration(c.conf.Heartbeat.Interval)*time.Second,
+		time.Duration(c.conf.Heartbeat.Timeout)*time.Second,
+		c.rtt, ctrl.write)
+	if sess.features&common.FeatureHeartbeat != 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			err := hb.Run(done)
+			if err != nil {
+				// gateway is unreachable, close mux to reconnect
+				logs.Error("heartbeat fail: %v", err)
+				ctrl.mux.Close()
+			}
+		}()
+	}
+
+	for {
+		frame, err := common.ReadFrame(ctrl.stream)
+		if err != nil {
+			logs.Debug("control stream closed: %v", err)
+			return
+		}
+
+		handled, err := hb.HandleFrame(frame)
+		if err != nil {
+			logs.Error("handle heartbeat fail: %v", err)
+			return
+		}
+		if handled {
+			continue
+		}
+
+		switch frame.Cmd {
+		case common.CmdRegisterListenerReply:
+			reply := &common.RegisterListenerReply{}
+			err = frame.Decode(reply)
+			if err != nil {
+				logs.Error("decode register listener reply fail: %v", err)
+				return
+			}
+
+			err = reply.Err()
+			if err != nil {
+				logs.Error("register listener %s fail: %v", reply.Name, err)
+				continue
+			}
+			logs.Info("register listener %s success, id %s public port %d",
+				reply.Name, reply.ListenerID, reply.PublicPort)
+		case common.CmdGoAway:
+			goAway := &common.GoAway{}
+			err = frame.Decode(goAway)
+			if err != nil {
+				logs.Error("decode goaway fail: %v", err)
+				return
+			}
+
+			logs.Warn("gateway goaway: %s, streams are drained in %ds",
+				goAway.Reason, goAway.DrainTimeout)
+			ctrl.goAway <- goAway
+			return
+		default:
+			logs.Warn("unknown control cmd %d", frame.Cmd)
+		}
+	}
+}
+
+// validateListeners checks listeners reference declared services
+func validateListeners(listeners []*ListenerConfig, services []*ServiceConfig) error {
+	names := make(map[string]struct{})
+	for _, l := range listeners {
+		if _, ok := names[l.Name]; ok || l.Name == "" {
+			return fmt.Errorf("invalid or duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = struct{}{}
+
+		err := common.ValidateCompression(l.Compression)
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+
+		found := false
+		for _, svc := range services {
+			if svc.Name == l.Service {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("listener %s references unknown service %s", l.Name, l.Service)
+		}
+	}
+	return nil
+}
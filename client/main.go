@@ -1,13 +1,78 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"github.com/astaxie/beego/logs"
+)
 
 func main() {
-	var clientID, serverAddr string
+	var confFile string
+	var clientID, instanceID, group, secret, serverAddr string
+	var enableTLS bool
+	var caFile, certFile, keyFile, serverName string
+	var policyFile string
+	var statusAddr string
+	var transport string
+	flag.StringVar(&confFile, "c", "", "config file, flags are ignored if set")
 	flag.StringVar(&clientID, "client_id", "", "client id")
+	flag.StringVar(&instanceID, "instance_id", "", "instance id, default hostname")
+	flag.StringVar(&group, "group", "", "service group to join")
+	flag.StringVar(&secret, "secret", "", "client secret")
 	flag.StringVar(&serverAddr, "server_addr", "", "server address")
+	flag.StringVar(&transport, "transport", "", "tcp, quic, websocket or kcp, default tcp")
+	flag.BoolVar(&enableTLS, "tls", false, "connect to gateway with tls")
+	flag.StringVar(&caFile, "ca_file", "", "ca file to verify gateway certificate")
+	flag.StringVar(&certFile, "cert_file", "", "client certificate file for mutual tls")
+	flag.StringVar(&keyFile, "key_file", "", "client key file for mutual tls")
+	flag.StringVar(&serverName, "server_name", "", "gateway tls server name")
+	flag.StringVar(&policyFile, "policy", "", "allowlist of internal targets, allow all if empty")
+	flag.StringVar(&statusAddr, "status_addr", "", "serve connection status on this address, eg: 127.0.0.1:8090")
 	flag.Parse()
 
-	c := NewClient(clientID, serverAddr)
+	var conf *Config
+	if confFile != "" {
+		var err error
+		conf, err = ParseConfig(confFile)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		conf = &Config{
+			ClientID:    clientID,
+			InstanceID:  instanceID,
+			Group:       group,
+			Secret:      secret,
+			ServerAddrs: []string{serverAddr},
+			Transport:   transport,
+			TLS: &TLSConfig{
+				Enable:     enableTLS,
+				CAFile:     caFile,
+				CertFile:   certFile,
+				KeyFile:    keyFile,
+				ServerName: serverName,
+			},
+			PolicyFile: policyFile,
+			StatusAddr: statusAddr,
+		}
+		err := conf.validate()
+		if err != nil {
+			panic(err)
+		}
+	}
+	logs.SetLevel(logLevels[conf.LogLevel])
+
+	c, err := NewClient(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	if conf.StatusAddr != "" {
+		go func() {
+			err := serveStatus(conf.StatusAddr, c)
+			if err != nil {
+				logs.Error("serve status fail: %v", err)
+			}
+		}()
+	}
 	c.Run()
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PolicyRule allows internal targets matched by protocol, host/cidr and ports
+// empty field matches any
+type PolicyRule struct {
+	// tcp or udp
+	Protocol string `json:"protocol"`
+	// exact ip or hostname sent by gateway
+	Host string `json:"host"`
+	// ip range, only matches targets given as ip
+	CIDR string `json:"cidr"`
+	// single port
+	Port uint16 `json:"port"`
+	// port list and ranges, eg: "80,443,8000-9000"
+	Ports string `json:"ports"`
+
+	ipNet      *net.IPNet
+	portRanges [][2]uint16
+}
+
+func (r *PolicyRule) String() string {
+	target := "*"
+	if r.Host != "" {
+		target = r.Host
+	} else if r.CIDR != "" {
+		target = r.CIDR
+	}
+
+	ports := "*"
+	if r.Port != 0 {
+		ports = strconv.Itoa(int(r.Port))
+	} else if r.Ports != "" {
+		ports = r.Ports
+	}
+
+	protocol := "*"
+	if r.Protocol != "" {
+		protocol = r.Protocol
+	}
+	return fmt.Sprintf("%s %s:%s", protocol, target, ports)
+}
+
+func (r *PolicyRule) match(protocol, host string, port uint16) bool {
+	if r.Protocol != "" && r.Protocol != protocol {
+		return false
+	}
+
+	if r.Host != "" && r.Host != host {
+		return false
+	}
+
+	if r.ipNet != nil {
+		ip := net.ParseIP(host)
+		if ip == nil || !r.ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+
+	if len(r.portRanges) > 0 {
+		for _, pr := range r.portRanges {
+			if port >= pr[0] && port <= pr[1] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Policy is the allowlist of internal targets the gateway may ask to dial
+// nil Policy allows everything
+type Policy struct {
+	Rules []*PolicyRule
+}
+
+func LoadPolicy(file string) (*Policy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*PolicyRule, 0)
+	err = json.Unmarshal(content, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		switch rule.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("invalid protocol %s", rule.Protocol)
+		}
+
+		if rule.Host != "" && rule.CIDR != "" {
+			return nil, fmt.Errorf("host and cidr are exclusive")
+		}
+
+		if rule.CIDR != "" {
+			_, ipNet, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			rule.ipNet = ipNet
+		}
+
+		if rule.Ports != "" {
+			rule.portRanges, err = parsePortRanges(rule.Ports)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &Policy{Rules: rules}, nil
+}
+
+// Allow checks whether the target is allowed
+func (p *Policy) Allow(protocol, host string, port uint16) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Rules {
+		if rule.match(protocol, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) String() string {
+	if p == nil {
+		return "allow all"
+	}
+
+	rules := make([]string, 0, len(p.Rules))
+	for _, rule := range p.Rules {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, "; ")
+}
+
+func parsePortRanges(ports string) ([][2]uint16, error) {
+	ranges := make([][2]uint16, 0)
+	for _, item := range strings.Split(ports, ",") {
+		item = strings.TrimSpace(item)
+		lo, hi, isRange := strings.Cut(item, "-")
+		start, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports %s", ports)
+		}
+
+		end := start
+		if isRange {
+			end, err = strconv.ParseUint(hi, 10, 16)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid ports %s", ports)
+			}
+		}
+		ranges = append(ranges, [2]uint16{uint16(start), uint16(end)})
+	}
+	return ranges, nil
+}
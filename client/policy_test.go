@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	convey.Convey("test policy", t, func() {
+		file := filepath.Join(t.TempDir(), "policy.json")
+		err := os.WriteFile(file, []byte(`[
+			{"protocol": "tcp", "host": "127.0.0.1", "port": 22},
+			{"protocol": "udp", "cidr": "10.0.0.0/8", "ports": "53,8000-9000"}
+		]`), 0644)
+		convey.So(err, convey.ShouldBeNil)
+
+		policy, err := LoadPolicy(file)
+		convey.So(err, convey.ShouldBeNil)
+
+		convey.So(policy.Allow("tcp", "127.0.0.1", 22), convey.ShouldBeTrue)
+		convey.So(policy.Allow("tcp", "127.0.0.1", 23), convey.ShouldBeFalse)
+		convey.So(policy.Allow("udp", "127.0.0.1", 22), convey.ShouldBeFalse)
+		convey.So(policy.Allow("udp", "10.1.2.3", 53), convey.ShouldBeTrue)
+		convey.So(policy.Allow("udp", "10.1.2.3", 8500), convey.ShouldBeTrue)
+		convey.So(policy.Allow("udp", "10.1.2.3", 9001), convey.ShouldBeFalse)
+		convey.So(policy.Allow("udp", "192.168.1.1", 53), convey.ShouldBeFalse)
+		convey.So(policy.Allow("udp", "internal.host", 53), convey.ShouldBeFalse)
+
+		var nilPolicy *Policy
+		convey.So(nilPolicy.Allow("tcp", "192.168.1.1", 80), convey.ShouldBeTrue)
+	})
+}
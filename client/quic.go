@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	quicALPN = "zta"
+	// interval of checking local ip for connection migration
+	migrateInterval = time.Second * 3
+)
+
+// quicTunnel maps each proxied connection to a quic stream
+// the connection migrates to a new path when local ip changes
+type quicTunnel struct {
+	conn   *quic.Conn
+	sess   mux.Session
+	stream net.Conn
+
+	transportsMu sync.Mutex
+	// transports of all the paths, closed with the tunnel
+	transports []*quic.Transport
+}
+
+func (c *Client) dialQUIC(addr string) (tunnel, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: udpConn}
+
+	tlsConfig := c.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{quicALPN}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	conn, err := transport.Dial(ctx, raddr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:     time.Second * 30,
+		KeepAlivePeriod:    time.Second * 10,
+		MaxIncomingStreams: 1 << 16,
+		EnableDatagrams:    true,
+	})
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	t := &quicTunnel{
+		conn:       conn,
+		sess:       mux.QUIC(conn),
+		transports: []*quic.Transport{transport},
+	}
+
+	// the first stream carries handshake
+	t.stream, err = t.sess.OpenStream()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	go t.migrate(raddr)
+	return t, nil
+}
+
+func (t *quicTunnel) Conn() net.Conn {
+	return t.stream
+}
+
+func (t *quicTunnel) Muxes() []string {
+	return []string{mux.TypeQUIC}
+}
+
+func (t *quicTunnel) Mux(typ string) (mux.Session, error) {
+	t.stream.Close()
+	return t.sess, nil
+}
+
+func (t *quicTunnel) Close() error {
+	err := t.sess.Close()
+	t.transportsMu.Lock()
+	defer t.transportsMu.Unlock()
+	for _, transport := range t.transports {
+		transport.Close()
+	}
+	return err
+}
+
+// migrate moves the connection to a new path when local ip changes
+// eg: switching from wifi to cellular
+func (t *quicTunnel) migrate(raddr *net.UDPAddr) {
+	ctx := t.conn.Context()
+	lastIP := localIP(raddr)
+	tick := time.NewTicker(migrateInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		ip := localIP(raddr)
+		if ip == nil || ip.Equal(lastIP) {
+			continue
+		}
+
+		logs.Info("local ip changes from %s to %s, migrate connection", lastIP, ip)
+		err := t.addPath(ctx, ip)
+		if err != nil {
+			logs.Warn("migrate connection to %s fail: %v", ip, err)
+			continue
+		}
+		lastIP = ip
+	}
+}
+
+func (t *quicTunnel) addPath(ctx context.Context, ip net.IP) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	transport := &quic.Transport{Conn: udpConn}
+
+	path, err := t.conn.AddPath(transport)
+	if err != nil {
+		transport.Close()
+		return err
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err = path.Probe(probeCtx)
+	if err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		path.Close()
+		transport.Close()
+		return err
+	}
+
+	t.transportsMu.Lock()
+	t.transports = append(t.transports, transport)
+	t.transportsMu.Unlock()
+	return nil
+}
+
+// localIP returns the source ip to reach raddr, no packet is sent
+func localIP(raddr *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// State of the connection to gateway
+type State string
+
+const (
+	StateConnecting  State = "connecting"
+	StateHandshaking State = "handshaking"
+	StateConnected   State = "connected"
+	StateBackoff     State = "backoff"
+)
+
+// GatewayStatus is the health memory of a gateway address
+type GatewayStatus struct {
+	Addr string `json:"addr"`
+	// consecutive failures, reset after handshake success
+	Failures        int       `json:"failures"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastFailAt      time.Time `json:"last_fail_at"`
+	LastConnectedAt time.Time `json:"last_connected_at"`
+	// gateway is avoided for max_interval after goaway
+	LastGoAwayAt time.Time `json:"last_goaway_at"`
+}
+
+// Status is a snapshot of the client connection
+type Status struct {
+	State   State     `json:"state"`
+	Gateway string    `json:"gateway"`
+	Since   time.Time `json:"since"`
+	// attempts since last stable connection
+	Attempt   int       `json:"attempt"`
+	NextRetry time.Time `json:"next_retry"`
+	Version   int       `json:"version"`
+	Features  string    `json:"features"`
+	Mux       string    `json:"mux"`
+	// smoothed rtt, last rtt and jitter measured by heartbeat
+	RTT     string `json:"rtt,omitempty"`
+	LastRTT string `json:"last_rtt,omitempty"`
+	Jitter  string `json:"jitter,omitempty"`
+	// bytes before and after compression of compressed streams
+	CompressRaw   int64           `json:"compress_raw"`
+	CompressWire  int64           `json:"compress_wire"`
+	CompressRatio float64         `json:"compress_ratio"`
+	Gateways      []GatewayStatus `json:"gateways"`
+}
+
+// stateMachine records connection state and notifies observers
+type stateMachine struct {
+	mu        sync.Mutex
+	status    Status
+	gateways  []*GatewayStatus
+	observers []func(Status)
+}
+
+func newStateMachine(addrs []string) *stateMachine {
+	sm := &stateMachine{}
+	for _, addr := range addrs {
+		sm.gateways = append(sm.gateways, &GatewayStatus{Addr: addr})
+	}
+	return sm
+}
+
+// Watch registers f to be called on every state change
+func (sm *stateMachine) Watch(f func(Status)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.observers = append(sm.observers, f)
+}
+
+func (sm *stateMachine) Status() Status {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.snapshot()
+}
+
+func (sm *stateMachine) snapshot() Status {
+	status := sm.status
+	status.Gateways = make([]GatewayStatus, 0, len(sm.gateways))
+	for _, gw := range sm.gateways {
+		status.Gateways = append(status.Gateways, *gw)
+	}
+	return status
+}
+
+func (sm *stateMachine) transit(f func(status *Status)) {
+	sm.mu.Lock()
+	f(&sm.status)
+	sm.status.Since = time.Now()
+	status := sm.snapshot()
+	observers := sm.observers
+	sm.mu.Unlock()
+
+	for _, observer := range observers {
+		observer(status)
+	}
+}
+
+func (sm *stateMachine) gateway(addr string) *GatewayStatus {
+	for _, gw := range sm.gateways {
+		if gw.Addr == addr {
+			return gw
+		}
+	}
+	return nil
+}
+
+func (sm *stateMachine) recordFailure(addr string, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	gw := sm.gateway(addr)
+	gw.Failures++
+	gw.LastFailAt = time.Now()
+	if err != nil {
+		gw.LastError = err.Error()
+	}
+}
+
+func (sm *stateMachine) recordConnected(addr string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	gw := sm.gateway(addr)
+	gw.Failures = 0
+	gw.LastError = ""
+	gw.LastConnectedAt = time.Now()
+}
+
+func (sm *stateMachine) recordGoAway(addr string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	gw := sm.gateway(addr)
+	gw.LastGoAwayAt = time.Now()
+}
+
+// serveStatus serves connection status as json on GET /status
+func serveStatus(addr string, c *Client) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	return http.ListenAndServe(addr, mux)
+}
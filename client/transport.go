@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
+	"net"
+	"time"
+)
+
+// transports between client and gateway
+const (
+	TransportTCP  = "tcp"
+	TransportQUIC = "quic"
+	// websocket over http proxy, wss if tls is enabled
+	TransportWebSocket = "websocket"
+	// kcp over udp for lossy links, tls works over kcp too
+	TransportKCP = "kcp"
+)
+
+// tunnel is a connection to gateway
+// handshake goes through Conn and streams are multiplexed after handshake
+type tunnel interface {
+	Conn() net.Conn
+	// multiplexers offered in handshake
+	Muxes() []string
+	// Mux creates mux session of the type picked by gateway
+	Mux(typ string) (mux.Session, error)
+	Close() error
+}
+
+// streamTunnel multiplexes streams over a tcp or tls connection
+type streamTunnel struct {
+	conn    net.Conn
+	muxConf *mux.Config
+}
+
+func (t *streamTunnel) Conn() net.Conn {
+	return t.conn
+}
+
+func (t *streamTunnel) Muxes() []string {
+	return t.muxConf.Types
+}
+
+func (t *streamTunnel) Mux(typ string) (mux.Session, error) {
+	return mux.Client(t.conn, typ, t.muxConf)
+}
+
+func (t *streamTunnel) Close() error {
+	return t.conn.Close()
+}
+
+func (c *Client) dial(addr string) (tunnel, error) {
+	switch c.conf.Transport {
+	case TransportQUIC:
+		return c.dialQUIC(addr)
+	case TransportWebSocket:
+		return c.dialWebSocket(addr)
+	case TransportKCP:
+		return c.dialKCP(addr)
+	}
+
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig == nil {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamTunnel{conn: conn, muxConf: c.conf.Mux}, nil
+}
+
+// dialKCP dials gateway over kcp, the handshake fails if gateway is unreachable
+func (c *Client) dialKCP(addr string) (tunnel, error) {
+	sess, err := common.DialKCP(addr, c.conf.KCP)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn = sess
+	if c.tlsConfig != nil {
+		tlsConfig := c.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(sess, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(time.Second * 10))
+		err = tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &streamTunnel{conn: conn, muxConf: c.conf.Mux}, nil
+}
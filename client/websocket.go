@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialWebSocket connects to gateway by websocket upgrade
+// through http CONNECT proxy if configured
+func (c *Client) dialWebSocket(addr string) (tunnel, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: c.conf.WebSocket.Path}
+	if c.tlsConfig != nil {
+		u.Scheme = "wss"
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  c.tlsConfig,
+		HandshakeTimeout: time.Second * 10,
+		ReadBufferSize:   1024 * 32,
+		WriteBufferSize:  1024 * 32,
+	}
+	if c.conf.WebSocket.Proxy != "" {
+		// validated in config
+		proxyURL, _ := url.Parse(c.conf.WebSocket.Proxy)
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ws, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket upgrade %s fail: %s", u.String(), resp.Status)
+		}
+		return nil, err
+	}
+
+	conn := common.NewWSConn(ws, nil)
+	return &streamTunnel{conn: conn, muxConf: c.conf.Mux}, nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// NewNonce generates a random hex encoded challenge nonce
+func NewNonce() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Sign signs the challenge nonce with client secret
+// the clientID is signed too, so a signature can't be replayed by other client
+func Sign(secret, clientID, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID))
+	mac.Write([]byte(":"))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature in constant time
+func Verify(secret, clientID, nonce, signature string) bool {
+	expected := Sign(secret, clientID, nonce)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
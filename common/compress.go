@@ -0,0 +1,157 @@
+package common
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// compression of proxied streams, configured per listener
+const (
+	CompressionNone   = ""
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+func ValidateCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionSnappy, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression %s", compression)
+	}
+}
+
+// CompressStats counts bytes before and after compression in both directions
+type CompressStats struct {
+	raw  int64
+	wire int64
+}
+
+func (s *CompressStats) Get() (raw, wire int64) {
+	return atomic.LoadInt64(&s.raw), atomic.LoadInt64(&s.wire)
+}
+
+// Ratio is raw bytes / wire bytes, 0 if nothing is transferred
+func (s *CompressStats) Ratio() float64 {
+	raw, wire := s.Get()
+	if wire == 0 {
+		return 0
+	}
+	return float64(raw) / float64(wire)
+}
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressConn compresses the data written to and read from conn
+// every write is flushed so interactive protocols are not delayed
+type compressConn struct {
+	net.Conn
+	stats *CompressStats
+
+	reader io.Reader
+	// release decoder after read fails, only the reader goroutine touches it
+	closeRead func()
+
+	writeMu sync.Mutex
+	writer  flushWriter
+
+	closeOnce sync.Once
+}
+
+// Compress wraps conn with compression, both sides must use the same one
+// stats may be shared by streams of a listener
+func Compress(conn net.Conn, compression string, stats *CompressStats) (net.Conn, error) {
+	if compression == CompressionNone {
+		return conn, nil
+	}
+
+	c := &compressConn{Conn: conn, stats: stats}
+	wire := &countWriter{w: conn, n: &stats.wire}
+	reader := &countReader{r: conn, n: &stats.wire}
+	switch compression {
+	case CompressionSnappy:
+		c.writer = snappy.NewBufferedWriter(wire)
+		c.reader = snappy.NewReader(reader)
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(wire,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(1<<20))
+		if err != nil {
+			return nil, err
+		}
+		decoder, err := zstd.NewReader(reader,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true))
+		if err != nil {
+			encoder.Close()
+			return nil, err
+		}
+		c.writer = encoder
+		c.reader = decoder
+		c.closeRead = decoder.Close
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", compression)
+	}
+	return c, nil
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(&c.stats.raw, int64(n))
+	if err != nil && c.closeRead != nil {
+		c.closeRead()
+		c.closeRead = nil
+	}
+	return n, err
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	atomic.AddInt64(&c.stats.raw, int64(n))
+	return n, c.writer.Flush()
+}
+
+func (c *compressConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		c.writer.Close()
+		c.writeMu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
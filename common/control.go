@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+)
+
+// frames of the control stream
+// control stream is opened by client after the mux session is created
+// and carries frames of different cmd in both directions
+const (
+	CmdRegisterListener      = 0x07
+	CmdRegisterListenerReply = 0x08
+	CmdGoAway                = 0x0b
+)
+
+// Frame is a raw frame read from control stream
+type Frame struct {
+	Cmd  byte
+	Body []byte
+}
+
+// ReadFrame reads a frame of any cmd
+func ReadFrame(reader io.Reader) (*Frame, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(reader, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Frame{Cmd: hdr[1], Body: body}, nil
+}
+
+// Decode unmarshal frame body into v
+func (f *Frame) Decode(v interface{}) error {
+	return json.Unmarshal(f.Body, v)
+}
+
+// RegisterListenerReq asks gateway to create a listener for the client
+// the listener is closed when the session ends
+type RegisterListenerReq struct {
+	// uniq name in client
+	Name string
+	// tcp, udp, http or https
+	PublicProtocol string
+	// required for tcp and udp, allocated by gateway for http and https
+	PublicPort uint16
+	// hostnames for http and https
+	Hosts []string
+	// local service declared in client config
+	Service string
+	// tcp or udp
+	ServiceProtocol string
+	// snappy or zstd, tcp, http and https only
+	Compression string `json:",omitempty"`
+}
+
+func (req *RegisterListenerReq) Encode() ([]byte, error) {
+	return encodeFrame(CmdRegisterListener, req)
+}
+
+type RegisterListenerReply struct {
+	Name       string
+	Code       int
+	Message    string
+	ListenerID string
+	PublicPort uint16
+}
+
+func (r *RegisterListenerReply) Encode() ([]byte, error) {
+	return encodeFrame(CmdRegisterListenerReply, r)
+}
+
+// Err returns nil if listener is created
+func (r *RegisterListenerReply) Err() error {
+	return newReplyError(r.Code, r.Message)
+}
+
+// GoAway is sent by gateway before it shuts down
+// gateway opens no more streams to the session, streams in progress are
+// served until they are done or drained, then the session is closed
+// client should connect again, eg: to another gateway
+type GoAway struct {
+	Reason string
+	// seconds streams in progress are waited for
+	DrainTimeout int
+}
+
+func (g *GoAway) Encode() ([]byte, error) {
+	return encodeFrame(CmdGoAway, g)
+}
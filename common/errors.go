@@ -0,0 +1,60 @@
+package common
+
+import (
+	"fmt"
+)
+
+// reply codes of HandshakeReply and StreamReply
+const (
+	CodeOK                  = 0
+	CodeAuthFail            = 1
+	CodeUnknownClient       = 2
+	CodeAlreadyOnline       = 3
+	CodeVersionUnsupported  = 4
+	CodeDialFail            = 5
+	CodeProtocolUnsupported = 6
+	CodeInternalError       = 7
+	CodeForbidden           = 8
+	CodeUnknownService      = 9
+)
+
+var codeText = map[int]string{
+	CodeOK:                  "ok",
+	CodeAuthFail:            "authenticate fail",
+	CodeUnknownClient:       "unknown client",
+	CodeAlreadyOnline:       "already online",
+	CodeVersionUnsupported:  "version unsupported",
+	CodeDialFail:            "dial internal address fail",
+	CodeProtocolUnsupported: "protocol unsupported",
+	CodeInternalError:       "internal error",
+	CodeForbidden:           "target not allowed",
+	CodeUnknownService:      "unknown service",
+}
+
+// CodeText returns the description of code
+func CodeText(code int) string {
+	if text, ok := codeText[code]; ok {
+		return text
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// ReplyError is the error carried by a reply frame
+type ReplyError struct {
+	Code    int
+	Message string
+}
+
+func newReplyError(code int, msg string) error {
+	if code == CodeOK {
+		return nil
+	}
+	return &ReplyError{Code: code, Message: msg}
+}
+
+func (e *ReplyError) Error() string {
+	if e.Message == "" {
+		return CodeText(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", CodeText(e.Code), e.Message)
+}
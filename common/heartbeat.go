@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat frames of the control stream
+// both sides send ping every interval and answer ping with pong
+// the session is considered dead if nothing is received within timeout
+const (
+	CmdPing = 0x09
+	CmdPong = 0x0a
+)
+
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+type Ping struct {
+	Seq uint64
+	// unix nano of the sender, echoed in pong
+	Timestamp int64
+}
+
+func (p *Ping) Encode() ([]byte, error) {
+	return encodeFrame(CmdPing, p)
+}
+
+type Pong struct {
+	Seq       uint64
+	Timestamp int64
+}
+
+func (p *Pong) Encode() ([]byte, error) {
+	return encodeFrame(CmdPong, p)
+}
+
+// RTT is a snapshot of round trip time measurement
+type RTT struct {
+	Last time.Duration
+	// smoothed rtt and mean deviation as tcp does(rfc6298)
+	Smoothed time.Duration
+	Jitter   time.Duration
+	Samples  int
+	// time of the last sample
+	UpdatedAt time.Time
+}
+
+// RTTStats is updated by heartbeat and read by others concurrently
+type RTTStats struct {
+	mu  sync.Mutex
+	rtt RTT
+}
+
+func (s *RTTStats) Update(sample time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rtt.Samples == 0 {
+		s.rtt.Smoothed = sample
+		s.rtt.Jitter = sample / 2
+	} else {
+		delta := s.rtt.Smoothed - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rtt.Jitter = (3*s.rtt.Jitter + delta) / 4
+		s.rtt.Smoothed = (7*s.rtt.Smoothed + sample) / 8
+	}
+	s.rtt.Last = sample
+	s.rtt.Samples++
+	s.rtt.UpdatedAt = time.Now()
+}
+
+func (s *RTTStats) Get() RTT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+func (s *RTTStats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtt = RTT{}
+}
+
+// Heartbeat pings peer over control stream and measures rtt
+type Heartbeat struct {
+	interval time.Duration
+	timeout  time.Duration
+	// writes a frame to control stream
+	write func([]byte) error
+	stats *RTTStats
+
+	seq uint64
+	// unix nano of the last frame received
+	lastRecv int64
+}
+
+func NewHeartbeat(interval, timeout time.Duration, stats *RTTStats, write func([]byte) error) *Heartbeat {
+	return &Heartbeat{
+		interval: interval,
+		timeout:  timeout,
+		write:    write,
+		stats:    stats,
+		lastRecv: time.Now().UnixNano(),
+	}
+}
+
+// Run sends ping every interval until done is closed
+// returns ErrHeartbeatTimeout if peer is silent for timeout
+func (h *Heartbeat) Run(done <-chan struct{}) error {
+	tick := time.NewTicker(h.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-tick.C:
+		}
+
+		lastRecv := time.Unix(0, atomic.LoadInt64(&h.lastRecv))
+		if time.Since(lastRecv) > h.timeout {
+			return ErrHeartbeatTimeout
+		}
+
+		ping := &Ping{
+			Seq:       atomic.AddUint64(&h.seq, 1),
+			Timestamp: time.Now().UnixNano(),
+		}
+		buf, err := ping.Encode()
+		if err != nil {
+			return err
+		}
+
+		err = h.write(buf)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// HandleFrame answers ping and measures rtt by pong
+// returns false if frame is not a heartbeat frame
+func (h *Heartbeat) HandleFrame(frame *Frame) (bool, error) {
+	switch frame.Cmd {
+	case CmdPing:
+		atomic.StoreInt64(&h.lastRecv, time.Now().UnixNano())
+		ping := &Ping{}
+		err := frame.Decode(ping)
+		if err != nil {
+			return true, err
+		}
+
+		pong := &Pong{Seq: ping.Seq, Timestamp: ping.Timestamp}
+		buf, err := pong.Encode()
+		if err != nil {
+			return true, err
+		}
+		return true, h.write(buf)
+
+	case CmdPong:
+		now := time.Now()
+		atomic.StoreInt64(&h.lastRecv, now.UnixNano())
+		pong := &Pong{}
+		err := frame.Decode(pong)
+		if err != nil {
+			return true, err
+		}
+
+		rtt := now.Sub(time.Unix(0, pong.Timestamp))
+		if rtt >= 0 {
+			h.stats.Update(rtt)
+		}
+		return true, nil
+	}
+	return false, nil
+}
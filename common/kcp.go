@@ -0,0 +1,82 @@
+package common
+
+import (
+	"fmt"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// KCPConfig of tunnel over kcp, gateway and client should use the same fec
+type KCPConfig struct {
+	// normal, fast(default), fast2 or fast3, faster mode uses more bandwidth
+	Mode string `yaml:"mode"`
+	// window size in packets, default 1024
+	SndWnd int `yaml:"sndwnd"`
+	RcvWnd int `yaml:"rcvwnd"`
+	// default 1350
+	MTU int `yaml:"mtu"`
+	// reed-solomon forward error correction, disabled if data_shards is 0
+	// parity_shards lost packets of every data_shards packets are recovered
+	// eg: 10 and 3
+	DataShards   int `yaml:"data_shards"`
+	ParityShards int `yaml:"parity_shards"`
+}
+
+// nodelay, interval, resend, nc of kcp modes
+var kcpModes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// Validate checks mode and fills default values
+func (c *KCPConfig) Validate() error {
+	if c.Mode == "" {
+		c.Mode = "fast"
+	}
+	if _, ok := kcpModes[c.Mode]; !ok {
+		return fmt.Errorf("invalid kcp mode %s", c.Mode)
+	}
+
+	if c.SndWnd <= 0 {
+		c.SndWnd = 1024
+	}
+	if c.RcvWnd <= 0 {
+		c.RcvWnd = 1024
+	}
+	if c.MTU <= 0 {
+		c.MTU = 1350
+	}
+
+	if c.DataShards < 0 || c.ParityShards < 0 || (c.DataShards == 0 && c.ParityShards > 0) {
+		return fmt.Errorf("invalid kcp data_shards %d parity_shards %d", c.DataShards, c.ParityShards)
+	}
+	return nil
+}
+
+// ListenKCP listens kcp on udp addr
+func ListenKCP(addr string, conf *KCPConfig) (*kcp.Listener, error) {
+	return kcp.ListenWithOptions(addr, nil, conf.DataShards, conf.ParityShards)
+}
+
+// DialKCP dials kcp, no packet is sent until the first write
+func DialKCP(addr string, conf *KCPConfig) (*kcp.UDPSession, error) {
+	sess, err := kcp.DialWithOptions(addr, nil, conf.DataShards, conf.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	conf.Apply(sess)
+	return sess, nil
+}
+
+// Apply sets the parameters of kcp session
+func (c *KCPConfig) Apply(sess *kcp.UDPSession) {
+	mode := kcpModes[c.Mode]
+	sess.SetNoDelay(mode[0], mode[1], mode[2], mode[3])
+	sess.SetWindowSize(c.SndWnd, c.RcvWnd)
+	sess.SetMtu(c.MTU)
+	// tunnel is a byte stream
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetACKNoDelay(true)
+}
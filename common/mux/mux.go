@@ -0,0 +1,195 @@
+// Package mux multiplexes streams over the tunnel between client and gateway
+// the implementation is negotiated in handshake
+package mux
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+	"io"
+	"net"
+	"time"
+)
+
+// multiplexers, smux and smux2 are not compatible with each other
+const (
+	TypeSmux = "smux"
+	// smux protocol v2 with stream level flow control
+	// a bulk stream won't starve the other streams
+	TypeSmux2 = "smux2"
+	TypeYamux = "yamux"
+)
+
+// Session is a multiplexed connection
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+// Config of multiplexer, zero value uses the default of implementation
+type Config struct {
+	// multiplexers in order of preference, default [smux]
+	// clients not negotiating mux use smux
+	Types []string `yaml:"types"`
+	// seconds
+	KeepAliveInterval int `yaml:"keepalive_interval"`
+	// seconds, smux only, yamux waits ping reply up to its write timeout
+	KeepAliveTimeout int `yaml:"keepalive_timeout"`
+	// max frame size of smux
+	MaxFrameSize int `yaml:"max_frame_size"`
+	// session receive window of smux
+	MaxReceiveBuffer int `yaml:"max_receive_buffer"`
+	// stream receive window of smux2 and yamux, at least 256KB for yamux
+	MaxStreamBuffer int `yaml:"max_stream_buffer"`
+}
+
+// Validate checks types and fills default values
+func (c *Config) Validate() error {
+	if len(c.Types) == 0 {
+		c.Types = []string{TypeSmux}
+	}
+	for _, typ := range c.Types {
+		switch typ {
+		case TypeSmux, TypeSmux2, TypeYamux:
+		default:
+			return fmt.Errorf("unsupported mux type %s", typ)
+		}
+	}
+
+	if c.KeepAliveInterval < 0 || c.KeepAliveTimeout < 0 ||
+		c.MaxFrameSize < 0 || c.MaxReceiveBuffer < 0 || c.MaxStreamBuffer < 0 {
+		return fmt.Errorf("mux config should not be negative")
+	}
+
+	// let the implementations check the values
+	for _, typ := range c.Types {
+		var err error
+		switch typ {
+		case TypeSmux, TypeSmux2:
+			err = smux.VerifyConfig(c.smuxConfig(typ))
+		case TypeYamux:
+			err = yamux.VerifyConfig(c.yamuxConfig())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", typ, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) smuxConfig(typ string) *smux.Config {
+	conf := smux.DefaultConfig()
+	if typ == TypeSmux2 {
+		conf.Version = 2
+	}
+	if c.KeepAliveInterval > 0 {
+		conf.KeepAliveInterval = time.Second * time.Duration(c.KeepAliveInterval)
+	}
+	if c.KeepAliveTimeout > 0 {
+		conf.KeepAliveTimeout = time.Second * time.Duration(c.KeepAliveTimeout)
+	}
+	if c.MaxFrameSize > 0 {
+		conf.MaxFrameSize = c.MaxFrameSize
+	}
+	if c.MaxReceiveBuffer > 0 {
+		conf.MaxReceiveBuffer = c.MaxReceiveBuffer
+	}
+	if c.MaxStreamBuffer > 0 {
+		conf.MaxStreamBuffer = c.MaxStreamBuffer
+	}
+	return conf
+}
+
+func (c *Config) yamuxConfig() *yamux.Config {
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = io.Discard
+	if c.KeepAliveInterval > 0 {
+		conf.KeepAliveInterval = time.Second * time.Duration(c.KeepAliveInterval)
+	}
+	if c.MaxStreamBuffer > 0 {
+		conf.MaxStreamWindowSize = uint32(c.MaxStreamBuffer)
+	}
+	return conf
+}
+
+// Negotiate picks the first of local types offered by peer
+// peer not offering any type is an old client using smux
+func Negotiate(offered, local []string) (string, error) {
+	if len(offered) == 0 {
+		offered = []string{TypeSmux}
+	}
+
+	for _, typ := range local {
+		for _, o := range offered {
+			if o == typ {
+				return typ, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no common mux in %v and %v", offered, local)
+}
+
+// Server creates the gateway side of typ mux over conn
+func Server(conn net.Conn, typ string, conf *Config) (Session, error) {
+	switch typ {
+	case TypeSmux, TypeSmux2, "":
+		sess, err := smux.Server(conn, conf.smuxConfig(typ))
+		if err != nil {
+			return nil, err
+		}
+		return &smuxSession{sess}, nil
+	case TypeYamux:
+		sess, err := yamux.Server(conn, conf.yamuxConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &yamuxSession{sess}, nil
+	}
+	return nil, fmt.Errorf("unsupported mux type %s", typ)
+}
+
+// Client creates the client side of typ mux over conn
+func Client(conn net.Conn, typ string, conf *Config) (Session, error) {
+	switch typ {
+	case TypeSmux, TypeSmux2, "":
+		sess, err := smux.Client(conn, conf.smuxConfig(typ))
+		if err != nil {
+			return nil, err
+		}
+		return &smuxSession{sess}, nil
+	case TypeYamux:
+		sess, err := yamux.Client(conn, conf.yamuxConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &yamuxSession{sess}, nil
+	}
+	return nil, fmt.Errorf("unsupported mux type %s", typ)
+}
+
+type smuxSession struct {
+	*smux.Session
+}
+
+func (s *smuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.OpenStream()
+}
+
+func (s *smuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.AcceptStream()
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (s *yamuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.Open()
+}
+
+func (s *yamuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.Accept()
+}
@@ -0,0 +1,75 @@
+package mux
+
+import (
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	convey.Convey("test mux", t, func() {
+		convey.Convey("test negotiate", func() {
+			typ, err := Negotiate(nil, []string{TypeSmux2, TypeSmux})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(typ, convey.ShouldEqual, TypeSmux)
+
+			typ, err = Negotiate([]string{TypeSmux, TypeYamux}, []string{TypeYamux, TypeSmux})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(typ, convey.ShouldEqual, TypeYamux)
+
+			_, err = Negotiate(nil, []string{TypeSmux2})
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test config", func() {
+			conf := &Config{}
+			convey.So(conf.Validate(), convey.ShouldBeNil)
+			convey.So(conf.Types, convey.ShouldResemble, []string{TypeSmux})
+
+			conf = &Config{Types: []string{"quic"}}
+			convey.So(conf.Validate(), convey.ShouldNotBeNil)
+
+			// yamux stream window is at least 256KB
+			conf = &Config{Types: []string{TypeYamux}, MaxStreamBuffer: 1024}
+			convey.So(conf.Validate(), convey.ShouldNotBeNil)
+		})
+
+		for _, typ := range []string{TypeSmux, TypeSmux2, TypeYamux} {
+			convey.Convey("test stream of "+typ, func() {
+				conf := &Config{Types: []string{typ}}
+				convey.So(conf.Validate(), convey.ShouldBeNil)
+
+				c1, c2 := net.Pipe()
+				server, err := Server(c1, typ, conf)
+				convey.So(err, convey.ShouldBeNil)
+				defer server.Close()
+				client, err := Client(c2, typ, conf)
+				convey.So(err, convey.ShouldBeNil)
+				defer client.Close()
+
+				go func() {
+					stream, err := server.AcceptStream()
+					if err != nil {
+						return
+					}
+					io.Copy(stream, stream)
+				}()
+
+				stream, err := client.OpenStream()
+				convey.So(err, convey.ShouldBeNil)
+				_, err = stream.Write([]byte("hello"))
+				convey.So(err, convey.ShouldBeNil)
+
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(stream, buf)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(string(buf), convey.ShouldEqual, "hello")
+				convey.So(client.NumStreams(), convey.ShouldEqual, 1)
+
+				client.Close()
+				convey.So(client.IsClosed(), convey.ShouldBeTrue)
+			})
+		}
+	})
+}
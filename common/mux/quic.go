@@ -0,0 +1,247 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/ICKelin/zta/common"
+	"github.com/quic-go/quic-go"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TypeQUIC is used by quic transport, it is not negotiated over tcp
+const TypeQUIC = "quic"
+
+// PacketConn is a stream that carries udp packets
+// packets are sent as unreliable datagrams if the mux supports
+// so one lost packet won't block the others
+type PacketConn interface {
+	net.Conn
+	WritePacket(p []byte) error
+	ReadPacket(p []byte) (int, error)
+}
+
+// quicSession uses quic streams as mux streams
+// datagrams are prefixed by stream id and dispatched to the stream
+type quicSession struct {
+	conn       *quic.Conn
+	numStreams int32
+
+	streamsMu sync.Mutex
+	streams   map[quic.StreamID]*quicStream
+}
+
+// QUIC creates mux session over a quic connection
+func QUIC(conn *quic.Conn) Session {
+	s := &quicSession{
+		conn:    conn,
+		streams: make(map[quic.StreamID]*quicStream),
+	}
+	if conn.ConnectionState().SupportsDatagrams {
+		go s.readDatagrams()
+	}
+	return s
+}
+
+func (s *quicSession) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(s.conn.Context(), time.Second*10)
+	defer cancel()
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newStream(stream, false), nil
+}
+
+func (s *quicSession) AcceptStream() (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	// peer opened the stream, so it knows the stream id
+	return s.newStream(stream, true), nil
+}
+
+func (s *quicSession) NumStreams() int {
+	return int(atomic.LoadInt32(&s.numStreams))
+}
+
+func (s *quicSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+func (s *quicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+func (s *quicSession) newStream(stream *quic.Stream, peerReady bool) *quicStream {
+	qs := &quicStream{
+		Stream:  stream,
+		sess:    s,
+		packets: make(chan []byte, 128),
+		done:    make(chan struct{}),
+	}
+	if peerReady {
+		qs.peerReady = 1
+	}
+
+	atomic.AddInt32(&s.numStreams, 1)
+	s.streamsMu.Lock()
+	s.streams[stream.StreamID()] = qs
+	s.streamsMu.Unlock()
+	return qs
+}
+
+func (s *quicSession) removeStream(qs *quicStream) {
+	atomic.AddInt32(&s.numStreams, -1)
+	s.streamsMu.Lock()
+	delete(s.streams, qs.StreamID())
+	s.streamsMu.Unlock()
+}
+
+func (s *quicSession) readDatagrams() {
+	for {
+		buf, err := s.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+
+		if len(buf) < 8 {
+			continue
+		}
+
+		id := quic.StreamID(binary.BigEndian.Uint64(buf[:8]))
+		s.streamsMu.Lock()
+		qs := s.streams[id]
+		s.streamsMu.Unlock()
+		if qs != nil {
+			qs.pushPacket(buf[8:])
+		}
+	}
+}
+
+type quicStream struct {
+	*quic.Stream
+	sess *quicSession
+	// peer has accepted the stream, datagrams sent before that may be dropped
+	peerReady int32
+
+	packets      chan []byte
+	readOnce     sync.Once
+	readErr      error
+	done         chan struct{}
+	closeOnce    sync.Once
+	packetsMu    sync.Mutex
+	packetsClose bool
+}
+
+func (qs *quicStream) LocalAddr() net.Addr {
+	return qs.sess.conn.LocalAddr()
+}
+
+func (qs *quicStream) RemoteAddr() net.Addr {
+	return qs.sess.conn.RemoteAddr()
+}
+
+// ConnectionState is used to verify the peer certificate
+func (qs *quicStream) ConnectionState() tls.ConnectionState {
+	return qs.sess.conn.ConnectionState().TLS
+}
+
+func (qs *quicStream) Read(p []byte) (int, error) {
+	n, err := qs.Stream.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(&qs.peerReady, 1)
+	}
+	return n, err
+}
+
+// Close closes both directions, quic stream Close only closes the write direction
+func (qs *quicStream) Close() error {
+	qs.closeOnce.Do(func() {
+		close(qs.done)
+		qs.sess.removeStream(qs)
+		qs.Stream.CancelRead(0)
+	})
+	return qs.Stream.Close()
+}
+
+func (qs *quicStream) WritePacket(p []byte) error {
+	if atomic.LoadInt32(&qs.peerReady) == 1 && qs.sess.conn.ConnectionState().SupportsDatagrams {
+		buf := make([]byte, 8+len(p))
+		binary.BigEndian.PutUint64(buf[:8], uint64(qs.StreamID()))
+		copy(buf[8:], p)
+
+		err := qs.sess.conn.SendDatagram(buf)
+		if err == nil {
+			return nil
+		}
+
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
+	}
+
+	// peer is not ready or packet is too large, send in stream
+	body, err := common.UDPPacket(p).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = qs.Write(body)
+	return err
+}
+
+// ReadPacket reads packets from both datagrams and stream
+func (qs *quicStream) ReadPacket(p []byte) (int, error) {
+	qs.readOnce.Do(func() {
+		go qs.readStreamPackets()
+	})
+
+	select {
+	case buf, ok := <-qs.packets:
+		if !ok {
+			return 0, qs.readErr
+		}
+		return copy(p, buf), nil
+	case <-qs.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (qs *quicStream) readStreamPackets() {
+	buf := common.UDPPacket(make([]byte, 1024*64))
+	for {
+		nr, err := buf.Decode(qs)
+		if err != nil {
+			qs.readErr = err
+			qs.packetsMu.Lock()
+			qs.packetsClose = true
+			close(qs.packets)
+			qs.packetsMu.Unlock()
+			return
+		}
+
+		pkt := make([]byte, nr)
+		copy(pkt, buf[:nr])
+		qs.pushPacket(pkt)
+	}
+}
+
+// pushPacket drops the packet if reader is slow, as udp does
+func (qs *quicStream) pushPacket(p []byte) {
+	qs.packetsMu.Lock()
+	defer qs.packetsMu.Unlock()
+	if qs.packetsClose {
+		return
+	}
+
+	select {
+	case qs.packets <- p:
+	default:
+	}
+}
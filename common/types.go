@@ -8,10 +8,16 @@ import (
 )
 
 const (
-	version      = 0
-	cmdPP        = 0x0
-	cmdHandshake = 0x1
-	cmdUDPPacket = 0x02
+	// version byte of frame header is kept for framing only and never checked
+	// protocol version is negotiated by HandshakeReq.MinVersion and Version
+	version           = 0
+	cmdPP             = 0x0
+	cmdHandshake      = 0x1
+	cmdUDPPacket      = 0x02
+	cmdChallenge      = 0x03
+	cmdAuth           = 0x04
+	cmdHandshakeReply = 0x05
+	cmdStreamReply    = 0x06
 )
 
 // 私有协议头部
@@ -34,6 +40,10 @@ type ProxyProtocol struct {
 	InternalProtocol string
 	InternalIP       string
 	InternalPort     uint16
+	// service declared by client, used instead of InternalIP and InternalPort
+	InternalService string `json:",omitempty"`
+	// compression of the stream after StreamReply, tcp only
+	Compression string `json:",omitempty"`
 }
 
 func (pp *ProxyProtocol) Encode() ([]byte, error) {
@@ -81,49 +91,24 @@ func (pp *ProxyProtocol) Decode(reader io.Reader) error {
 
 type HandshakeReq struct {
 	ClientID string
+	// distinguish instances of the same client id
+	InstanceID string
+	// optional service group to join
+	Group string
+	// protocol version range and features of client
+	MinVersion int
+	Version    int
+	Features   uint32
+	// multiplexers supported by client in order of preference
+	Muxes []string
 }
 
 func (req *HandshakeReq) Encode() ([]byte, error) {
-	hdr := make([]byte, 4)
-	hdr[0] = version
-	hdr[1] = cmdHandshake
-
-	body, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
-	return append(hdr, body...), nil
+	return encodeFrame(cmdHandshake, req)
 }
 
 func (req *HandshakeReq) Decode(reader io.Reader) error {
-	hdr := make([]byte, 4)
-	_, err := io.ReadFull(reader, hdr)
-	if err != nil {
-		return err
-	}
-
-	cmd := hdr[1]
-	if cmd != cmdHandshake {
-		return fmt.Errorf("invalid handshake cmd")
-	}
-
-	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
-
-	body := make([]byte, bodyLen)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		return err
-
-	}
-
-	err = json.Unmarshal(body, req)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return decodeFrame(reader, cmdHandshake, req)
 }
 
 type UDPPacket []byte
@@ -162,3 +147,113 @@ func (p UDPPacket) Decode(reader io.Reader) (int, error) {
 
 	return int(bodyLen), nil
 }
+
+// Challenge is sent by gateway after HandshakeReq
+// client should prove it holds the secret by signing the nonce
+type Challenge struct {
+	Nonce string
+}
+
+func (c *Challenge) Encode() ([]byte, error) {
+	return encodeFrame(cmdChallenge, c)
+}
+
+func (c *Challenge) Decode(reader io.Reader) error {
+	return decodeFrame(reader, cmdChallenge, c)
+}
+
+// HandshakeAuth is the challenge response of client
+type HandshakeAuth struct {
+	Signature string
+}
+
+func (a *HandshakeAuth) Encode() ([]byte, error) {
+	return encodeFrame(cmdAuth, a)
+}
+
+func (a *HandshakeAuth) Decode(reader io.Reader) error {
+	return decodeFrame(reader, cmdAuth, a)
+}
+
+// HandshakeReply is the final result of handshake
+// Code is CodeOK if accepted, Message carries the reason when rejected
+type HandshakeReply struct {
+	Code    int
+	Message string
+	// negotiated protocol version and features
+	Version  int
+	Features uint32
+	// multiplexer picked by gateway, smux if empty
+	Mux string
+}
+
+// Err returns nil if accepted
+func (r *HandshakeReply) Err() error {
+	return newReplyError(r.Code, r.Message)
+}
+
+func (r *HandshakeReply) Encode() ([]byte, error) {
+	return encodeFrame(cmdHandshakeReply, r)
+}
+
+func (r *HandshakeReply) Decode(reader io.Reader) error {
+	return decodeFrame(reader, cmdHandshakeReply, r)
+}
+
+// StreamReply is sent by client on a stream after it dials
+// the internal address in ProxyProtocol
+type StreamReply struct {
+	Code    int
+	Message string
+	// compression accepted by client, empty if client doesn't support
+	Compression string `json:",omitempty"`
+}
+
+func (r *StreamReply) Encode() ([]byte, error) {
+	return encodeFrame(cmdStreamReply, r)
+}
+
+func (r *StreamReply) Decode(reader io.Reader) error {
+	return decodeFrame(reader, cmdStreamReply, r)
+}
+
+// Err returns nil if client dials internal address success
+func (r *StreamReply) Err() error {
+	return newReplyError(r.Code, r.Message)
+}
+
+func encodeFrame(cmd byte, v interface{}) ([]byte, error) {
+	hdr := make([]byte, 4)
+	hdr[0] = version
+	hdr[1] = cmd
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
+	return append(hdr, body...), nil
+}
+
+func decodeFrame(reader io.Reader, cmd byte, v interface{}) error {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(reader, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr[1] != cmd {
+		return fmt.Errorf("invalid cmd %d, expected %d", hdr[1], cmd)
+	}
+
+	bodyLen := binary.BigEndian.Uint16(hdr[2:4])
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
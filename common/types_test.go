@@ -0,0 +1,137 @@
+package common
+
+import (
+	"bytes"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	convey.Convey("test handshake", t, func() {
+		convey.Convey("test frame encode and decode", func() {
+			reply := &HandshakeReply{Code: CodeAuthFail, Message: "authenticate fail"}
+			buf, err := reply.Encode()
+			convey.So(err, convey.ShouldBeNil)
+
+			decoded := &HandshakeReply{}
+			err = decoded.Decode(bytes.NewReader(buf))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(decoded, convey.ShouldResemble, reply)
+
+			challenge := &Challenge{}
+			err = challenge.Decode(bytes.NewReader(buf))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			// header version of newer peers is accepted, version is negotiated in handshake
+			buf[0] = version + 1
+			decoded = &HandshakeReply{}
+			err = decoded.Decode(bytes.NewReader(buf))
+			convey.So(err, convey.ShouldBeNil)
+			frame, err := ReadFrame(bytes.NewReader(buf))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(frame.Cmd, convey.ShouldEqual, cmdHandshakeReply)
+		})
+
+		convey.Convey("test reply error", func() {
+			reply := &StreamReply{Code: CodeOK}
+			convey.So(reply.Err(), convey.ShouldBeNil)
+
+			reply = &StreamReply{Code: CodeDialFail, Message: "connection refused"}
+			err := reply.Err()
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(err.Error(), convey.ShouldEqual, "dial internal address fail: connection refused")
+		})
+
+		convey.Convey("test version negotiate", func() {
+			ver, features, err := Negotiate(MinProtocolVersion, ProtocolVersion+1,
+				FeatureHeartbeat|FeatureCompression, FeatureHeartbeat, 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ver, convey.ShouldEqual, ProtocolVersion)
+			convey.So(features, convey.ShouldEqual, FeatureHeartbeat)
+
+			_, _, err = Negotiate(0, MinProtocolVersion-1, 0, 0, 0)
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, _, err = Negotiate(ProtocolVersion+1, ProtocolVersion+2, 0, 0, 0)
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, _, err = Negotiate(MinProtocolVersion, ProtocolVersion,
+				FeatureCompression, FeatureHeartbeat|FeatureCompression, FeatureHeartbeat)
+			convey.So(err.Error(), convey.ShouldEqual,
+				"version unsupported: missing required features heartbeat")
+		})
+
+		convey.Convey("test sign and verify", func() {
+			nonce, err := NewNonce()
+			convey.So(err, convey.ShouldBeNil)
+
+			signature := Sign("secret", "client", nonce)
+			convey.So(Verify("secret", "client", nonce, signature), convey.ShouldBeTrue)
+			convey.So(Verify("secret", "other", nonce, signature), convey.ShouldBeFalse)
+			convey.So(Verify("wrong", "client", nonce, signature), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("test compress", func() {
+			for _, compression := range []string{CompressionSnappy, CompressionZstd} {
+				c1, c2 := net.Pipe()
+				stats := &CompressStats{}
+				w, err := Compress(c1, compression, &CompressStats{})
+				convey.So(err, convey.ShouldBeNil)
+				r, err := Compress(c2, compression, stats)
+				convey.So(err, convey.ShouldBeNil)
+
+				payload := bytes.Repeat([]byte("GET /api/v1/users HTTP/1.1\r\n"), 100)
+				go func() {
+					w.Write(payload)
+					w.Close()
+				}()
+
+				buf := make([]byte, len(payload))
+				_, err = io.ReadFull(r, buf)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(buf, convey.ShouldResemble, payload)
+				r.Close()
+				convey.So(stats.Ratio(), convey.ShouldBeGreaterThan, 1)
+			}
+
+			convey.So(ValidateCompression("gzip"), convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test heartbeat", func() {
+			// ping answered by pong of the same seq
+			var written []byte
+			stats := &RTTStats{}
+			hb := NewHeartbeat(time.Second, time.Second*3, stats, func(buf []byte) error {
+				written = buf
+				return nil
+			})
+
+			ping := &Ping{Seq: 1, Timestamp: time.Now().Add(-time.Millisecond * 20).UnixNano()}
+			buf, _ := ping.Encode()
+			frame, err := ReadFrame(bytes.NewReader(buf))
+			convey.So(err, convey.ShouldBeNil)
+			handled, err := hb.HandleFrame(frame)
+			convey.So(handled, convey.ShouldBeTrue)
+			convey.So(err, convey.ShouldBeNil)
+
+			frame, err = ReadFrame(bytes.NewReader(written))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(frame.Cmd, convey.ShouldEqual, CmdPong)
+
+			handled, err = hb.HandleFrame(frame)
+			convey.So(handled, convey.ShouldBeTrue)
+			rtt := stats.Get()
+			convey.So(rtt.Samples, convey.ShouldEqual, 1)
+			convey.So(rtt.Last, convey.ShouldBeGreaterThanOrEqualTo, time.Millisecond*20)
+
+			stats.Update(rtt.Last + time.Millisecond*40)
+			convey.So(stats.Get().Jitter, convey.ShouldBeGreaterThan, 0)
+
+			handled, _ = hb.HandleFrame(&Frame{Cmd: CmdRegisterListener})
+			convey.So(handled, convey.ShouldBeFalse)
+		})
+	})
+}
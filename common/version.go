@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// protocol versions supported by this build
+// version is exchanged in HandshakeReq and HandshakeReply
+// so gateway and clients can be upgraded independently
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// feature flags exchanged in handshake
+// both sides use the intersection of their features
+const (
+	FeatureHeartbeat uint32 = 1 << iota
+	FeatureCompression
+	FeatureUDPFramingV2
+	// gateway sends goaway before shutting down
+	FeatureGoAway
+)
+
+// SupportedFeatures is the feature set implemented by this build
+var SupportedFeatures uint32 = FeatureHeartbeat | FeatureCompression | FeatureGoAway
+
+var featureNames = []struct {
+	flag uint32
+	name string
+}{
+	{FeatureHeartbeat, "heartbeat"},
+	{FeatureCompression, "compression"},
+	{FeatureUDPFramingV2, "udp_framing_v2"},
+	{FeatureGoAway, "goaway"},
+}
+
+// FeatureString formats features as comma separated names
+func FeatureString(features uint32) string {
+	names := make([]string, 0)
+	for _, f := range featureNames {
+		if features&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseFeatures converts feature names to flags
+func ParseFeatures(names []string) (uint32, error) {
+	var features uint32
+	for _, name := range names {
+		found := false
+		for _, f := range featureNames {
+			if f.name == name {
+				features |= f.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown feature %s", name)
+		}
+	}
+	return features, nil
+}
+
+// Negotiate picks the highest common version and the common feature set
+// peerMin and peerMax are the version range of peer
+// required features must be supported by both sides
+func Negotiate(peerMin, peerMax int, peerFeatures, localFeatures, required uint32) (int, uint32, error) {
+	ver := ProtocolVersion
+	if peerMax < ver {
+		ver = peerMax
+	}
+
+	if ver < MinProtocolVersion || ver < peerMin {
+		return 0, 0, &ReplyError{
+			Code: CodeVersionUnsupported,
+			Message: fmt.Sprintf("peer supports %d-%d, local supports %d-%d",
+				peerMin, peerMax, MinProtocolVersion, ProtocolVersion),
+		}
+	}
+
+	features := peerFeatures & localFeatures
+	if missing := required &^ features; missing != 0 {
+		return 0, 0, &ReplyError{
+			Code:    CodeVersionUnsupported,
+			Message: fmt.Sprintf("missing required features %s", FeatureString(missing)),
+		}
+	}
+	return ver, features, nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WSConn adapts websocket to net.Conn so tunnel can run over websocket
+// data is carried in binary messages, message boundary is meaningless
+type WSConn struct {
+	ws *websocket.Conn
+	// tls state of the http request, nil if not https
+	tlsState *tls.ConnectionState
+
+	readMu sync.Mutex
+	reader io.Reader
+
+	writeMu sync.Mutex
+}
+
+func NewWSConn(ws *websocket.Conn, tlsState *tls.ConnectionState) *WSConn {
+	return &WSConn{ws: ws, tlsState: tlsState}
+}
+
+func (c *WSConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *WSConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err := c.ws.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *WSConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// ConnectionState is used to verify client certificate
+func (c *WSConn) ConnectionState() tls.ConnectionState {
+	if c.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.tlsState
+}
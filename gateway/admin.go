@@ -0,0 +1,662 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/gateway/authenticate"
+	"github.com/ICKelin/zta/gateway/http_route"
+	"github.com/astaxie/beego/logs"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// error codes of admin api
+const (
+	AdminCodeInvalidArgument = "invalid_argument"
+	AdminCodeUnauthorized    = "unauthorized"
+	AdminCodeNotFound        = "not_found"
+	AdminCodeConflict        = "conflict"
+	AdminCodeInternal        = "internal"
+)
+
+// AdminError is the body of failed admin api requests
+type AdminError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AdminServer serves admin http api for listeners, clients, sessions,
+// ssl and oidc users
+// changes are applied to gateway first, so errors such as address in use
+// are replied, and then saved to store
+type AdminServer struct {
+	conf        *AdminConfig
+	gw          *Gateway
+	store       Store
+	listenerMgr *ListenerManager
+	sessionMgr  *SessionManager
+	startAt     time.Time
+	server      *http.Server
+	// serializes changes
+	mu sync.Mutex
+}
+
+func NewAdminServer(conf *AdminConfig, gw *Gateway, store Store) *AdminServer {
+	s := &AdminServer{
+		conf:        conf,
+		gw:          gw,
+		store:       store,
+		listenerMgr: gw.listenerMgr,
+		sessionMgr:  gw.sessionMgr,
+		startAt:     time.Now(),
+	}
+	s.server = &http.Server{Addr: conf.ListenAddr, Handler: s.handler()}
+	return s
+}
+
+// ListenAndServe serves https if cert_file and key_file are configured
+// http.ErrServerClosed is returned after Close
+func (s *AdminServer) ListenAndServe() error {
+	if s.conf.CertFile != "" {
+		logs.Info("admin api listening on %s with tls", s.conf.ListenAddr)
+		return s.server.ListenAndServeTLS(s.conf.CertFile, s.conf.KeyFile)
+	}
+	logs.Info("admin api listening on %s", s.conf.ListenAddr)
+	return s.server.ListenAndServe()
+}
+
+func (s *AdminServer) Close() error {
+	return s.server.Close()
+}
+
+func (s *AdminServer) handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+	// listener id of client registered listener contains "/"
+	// it is escaped as %2F in path
+	r.UseRawPath = true
+	r.UnescapePathValues = true
+	r.NoRoute(func(c *gin.Context) {
+		abort(c, http.StatusNotFound, AdminCodeNotFound, "no such api")
+	})
+
+	api := r.Group("/api/v1", s.authenticate)
+	api.GET("/health", s.health)
+	api.GET("/listeners", s.listListeners)
+	api.GET("/listeners/:id", s.getListener)
+	api.POST("/listeners", s.createListener)
+	api.PUT("/listeners/:id", s.updateListener)
+	api.DELETE("/listeners/:id", s.deleteListener)
+	api.GET("/clients", s.listClients)
+	api.PUT("/clients/:client_id", s.updateClient)
+	api.DELETE("/clients/:client_id", s.deleteClient)
+	api.GET("/sessions", s.listSessions)
+	api.DELETE("/sessions/:client_id/:instance_id", s.kickSession)
+	api.GET("/ssl", s.listSSLs)
+	api.GET("/ssl/:id", s.getSSL)
+	api.PUT("/ssl/:id", s.updateSSL)
+	api.DELETE("/ssl/:id", s.deleteSSL)
+	api.GET("/oidc_users", s.listOIDCUsers)
+	api.PUT("/oidc_users/:auth_id/:client_id/:username", s.updateOIDCUser)
+	api.DELETE("/oidc_users/:auth_id/:client_id/:username", s.deleteOIDCUser)
+	return r
+}
+
+func abort(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, &AdminError{Code: code, Message: message})
+}
+
+func (s *AdminServer) authenticate(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.Token)) != 1 {
+		abort(c, http.StatusUnauthorized, AdminCodeUnauthorized, "invalid token")
+		return
+	}
+	c.Next()
+}
+
+func (s *AdminServer) health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "ok",
+		"start_at":   s.startAt,
+		"uptime":     time.Since(s.startAt).Truncate(time.Second).String(),
+		"version":    common.ProtocolVersion,
+		"sessions":   len(s.sessionMgr.Sessions()),
+		"listeners":  len(s.listenerMgr.Listeners()),
+		"goroutines": runtime.NumGoroutine(),
+	})
+}
+
+type listenerView struct {
+	*ListenerConfig
+	CompressRaw   int64   `json:"compress_raw"`
+	CompressWire  int64   `json:"compress_wire"`
+	CompressRatio float64 `json:"compress_ratio"`
+}
+
+func newListenerView(l *Listener) *listenerView {
+	raw, wire, ratio := l.CompressStats()
+	return &listenerView{
+		ListenerConfig: l.listenerConfig,
+		CompressRaw:    raw,
+		CompressWire:   wire,
+		CompressRatio:  ratio,
+	}
+}
+
+func (s *AdminServer) listListeners(c *gin.Context) {
+	views := make([]*listenerView, 0)
+	for _, l := range s.listenerMgr.Listeners() {
+		views = append(views, newListenerView(l))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func (s *AdminServer) getListener(c *gin.Context) {
+	id := c.Param("id")
+	l := s.listenerMgr.GetListener(id)
+	if l == nil {
+		abort(c, http.StatusNotFound, AdminCodeNotFound,
+			fmt.Sprintf("listener %s not found", id))
+		return
+	}
+	c.JSON(http.StatusOK, newListenerView(l))
+}
+
+func (s *AdminServer) createListener(c *gin.Context) {
+	conf := &ListenerConfig{}
+	err := c.ShouldBindJSON(conf)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	err = validateListener(conf)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listenerMgr.GetListener(conf.ID) != nil {
+		abort(c, http.StatusConflict, AdminCodeConflict,
+			fmt.Sprintf("listener %s already exists", conf.ID))
+		return
+	}
+
+	err = s.listenerMgr.ApplyListener(conf)
+	if err != nil {
+		abort(c, http.StatusConflict, AdminCodeConflict, err.Error())
+		return
+	}
+
+	err = storePut(s.store, StoreKindListener, conf.ID, conf)
+	if err != nil {
+		s.listenerMgr.CloseListener(conf.ID)
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	logs.Info("admin add listener %+v", conf)
+	s.replyListener(c, http.StatusCreated, conf.ID)
+}
+
+// updateListener replaces listener id in store
+// the old one keeps serving if the new one fails to listen
+func (s *AdminServer) updateListener(c *gin.Context) {
+	id := c.Param("id")
+	conf := &ListenerConfig{}
+	err := c.ShouldBindJSON(conf)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	if conf.ID != "" && conf.ID != id {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument,
+			fmt.Sprintf("id %s mismatch listener %s", conf.ID, id))
+		return
+	}
+	conf.ID = id
+
+	err = validateListener(conf)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// listeners registered by clients are not in store
+	value, err := s.store.Get(StoreKindListener, id)
+	if err != nil {
+		s.abortStoreError(c, "listener", id, err)
+		return
+	}
+
+	err = s.listenerMgr.ApplyListener(conf)
+	if err != nil {
+		abort(c, http.StatusConflict, AdminCodeConflict, err.Error())
+		return
+	}
+
+	err = storePut(s.store, StoreKindListener, id, conf)
+	if err != nil {
+		if old, decodeErr := decodeListener(value); decodeErr == nil {
+			s.listenerMgr.ApplyListener(old)
+		}
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	logs.Info("admin update listener %+v", conf)
+	s.replyListener(c, http.StatusOK, id)
+}
+
+// deleteListener deletes listener from store
+// listener registered by client is closed directly
+func (s *AdminServer) deleteListener(c *gin.Context) {
+	id := c.Param("id")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.store.Delete(StoreKindListener, id)
+	if errors.Is(err, ErrRecordNotFound) {
+		l := s.listenerMgr.GetListener(id)
+		if l != nil {
+			s.listenerMgr.RemoveListener(id, l)
+			err = nil
+		}
+	}
+	if err != nil {
+		s.abortStoreError(c, "listener", id, err)
+		return
+	}
+	logs.Info("admin delete listener %s", id)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *AdminServer) replyListener(c *gin.Context, status int, id string) {
+	l := s.listenerMgr.GetListener(id)
+	if l == nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal,
+			fmt.Sprintf("listener %s is not running", id))
+		return
+	}
+	c.JSON(status, newListenerView(l))
+}
+
+func (s *AdminServer) abortStoreError(c *gin.Context, kind, id string, err error) {
+	if errors.Is(err, ErrRecordNotFound) {
+		abort(c, http.StatusNotFound, AdminCodeNotFound,
+			fmt.Sprintf("%s %s not found", kind, id))
+		return
+	}
+	abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+}
+
+// validateListener checks listener created by admin api
+// it is stricter than listener_file, which is trusted
+func validateListener(conf *ListenerConfig) error {
+	if conf.ID == "" || conf.ClientID == "" {
+		return fmt.Errorf("id and client_id are required")
+	}
+
+	switch conf.PublicProtocol {
+	case "tcp", "udp":
+		if conf.PublicPort == 0 {
+			return fmt.Errorf("public_port is required")
+		}
+	case "http", "https":
+		route := http_route.GetRoute(conf.HTTPRouteType)
+		if route == nil {
+			return fmt.Errorf("http route %s is not configured", conf.HTTPRouteType)
+		}
+		// stream routes proxy requests into streams, public address is not listened
+		if _, ok := route.(http_route.StreamRoute); !ok && conf.PublicPort == 0 {
+			return fmt.Errorf("public_port is required")
+		}
+		if len(conf.HTTPParam) == 0 {
+			return fmt.Errorf("http_param is required")
+		}
+	default:
+		return fmt.Errorf("public_protocol %s is not supported", conf.PublicProtocol)
+	}
+
+	switch conf.InternalProtocol {
+	case "":
+		conf.InternalProtocol = "tcp"
+		if conf.PublicProtocol == "udp" {
+			conf.InternalProtocol = "udp"
+		}
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("internal_protocol %s is not supported", conf.InternalProtocol)
+	}
+
+	if conf.InternalService == "" && (conf.InternalIP == "" || conf.InternalPort == 0) {
+		return fmt.Errorf("internal_service or internal_ip and internal_port are required")
+	}
+	return conf.validate()
+}
+
+type sessionView struct {
+	ClientID   string `json:"client_id"`
+	InstanceID string `json:"instance_id"`
+	Group      string `json:"group,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	Version    int    `json:"version"`
+	Features   string `json:"features"`
+	Transport  string `json:"transport"`
+	Mux        string `json:"mux"`
+	Streams    int    `json:"streams"`
+	// only measured if heartbeat is negotiated
+	RTT    string `json:"rtt,omitempty"`
+	Jitter string `json:"jitter,omitempty"`
+}
+
+func (s *AdminServer) listSessions(c *gin.Context) {
+	views := make([]*sessionView, 0)
+	for _, sess := range s.sessionMgr.Sessions() {
+		view := &sessionView{
+			ClientID:   sess.ClientID,
+			InstanceID: sess.InstanceID,
+			Group:      sess.Group,
+			RemoteAddr: sess.RemoteAddr,
+			Version:    sess.Version,
+			Features:   common.FeatureString(sess.Features),
+			Transport:  sess.Transport,
+			Mux:        sess.Mux,
+			Streams:    sess.Connection.NumStreams(),
+		}
+		if rtt := sess.RTT.Get(); rtt.Samples > 0 {
+			view.RTT = rtt.Smoothed.String()
+			view.Jitter = rtt.Jitter.String()
+		}
+		views = append(views, view)
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func (s *AdminServer) kickSession(c *gin.Context) {
+	sess, err := s.sessionMgr.KickSession(c.Param("client_id"), c.Param("instance_id"))
+	if err != nil {
+		abort(c, http.StatusNotFound, AdminCodeNotFound, err.Error())
+		return
+	}
+	logs.Info("admin kick session %s", sess)
+	c.Status(http.StatusNoContent)
+}
+
+type sslView struct {
+	*SSLConfig
+	// key is never replied
+	Key string `json:"key,omitempty"`
+}
+
+// listSSLs replies certificates in store
+func (s *AdminServer) listSSLs(c *gin.Context) {
+	confs, err := storeSSLs(s.store)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+
+	sort.Slice(confs, func(i, j int) bool {
+		return confs[i].ID < confs[j].ID
+	})
+	views := make([]*sslView, 0, len(confs))
+	for _, conf := range confs {
+		views = append(views, &sslView{SSLConfig: conf})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func (s *AdminServer) getSSL(c *gin.Context) {
+	id := c.Param("id")
+	value, err := s.store.Get(StoreKindSSL, id)
+	if err != nil {
+		s.abortStoreError(c, "ssl", id, err)
+		return
+	}
+
+	conf, err := decodeSSL(value)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &sslView{SSLConfig: conf})
+}
+
+type sslRequest struct {
+	HTTPRouteType string   `json:"http_route_type"`
+	Cert          string   `json:"cert"`
+	Key           string   `json:"key"`
+	SNIs          []string `json:"snis"`
+}
+
+// updateSSL creates or replaces certificate id of http route
+func (s *AdminServer) updateSSL(c *gin.Context) {
+	id := c.Param("id")
+	req := &sslRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	route := http_route.GetRoute(req.HTTPRouteType)
+	if route == nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument,
+			fmt.Sprintf("http route %s is not configured", req.HTTPRouteType))
+		return
+	}
+
+	if len(req.SNIs) == 0 {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, "snis are required")
+		return
+	}
+
+	_, err = tls.X509KeyPair([]byte(req.Cert), []byte(req.Key))
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument,
+			fmt.Sprintf("invalid cert or key: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = route.UpdateSSL(id, req.Cert, req.Key, req.SNIs)
+	if err != nil {
+		abort(c, http.StatusBadGateway, AdminCodeInternal, err.Error())
+		return
+	}
+
+	// certificate is saved inline
+	conf := &SSLConfig{
+		ID:            id,
+		HTTPRouteType: req.HTTPRouteType,
+		Cert:          req.Cert,
+		Key:           req.Key,
+		SNIs:          req.SNIs,
+	}
+	err = storePut(s.store, StoreKindSSL, id, conf)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	logs.Info("admin update ssl %s for %v", id, req.SNIs)
+	c.JSON(http.StatusOK, gin.H{"id": id, "snis": req.SNIs})
+}
+
+// deleteSSL deletes certificate id from store and http routes
+func (s *AdminServer) deleteSSL(c *gin.Context) {
+	id := c.Param("id")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.store.Delete(StoreKindSSL, id)
+	if err != nil {
+		s.abortStoreError(c, "ssl", id, err)
+		return
+	}
+	logs.Info("admin delete ssl %s", id)
+	c.Status(http.StatusNoContent)
+}
+
+type clientView struct {
+	*ClientConfig
+	// secret is never replied
+	Secret string `json:"secret,omitempty"`
+}
+
+func (s *AdminServer) listClients(c *gin.Context) {
+	clients, err := storeClients(s.store)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+	views := make([]*clientView, 0, len(clients))
+	for _, client := range clients {
+		views = append(views, &clientView{ClientConfig: client})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// updateClient creates or replaces client credential
+// online sessions are not affected
+func (s *AdminServer) updateClient(c *gin.Context) {
+	id := c.Param("client_id")
+	conf := &ClientConfig{}
+	err := c.ShouldBindJSON(conf)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	if conf.ClientID != "" && conf.ClientID != id {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument,
+			fmt.Sprintf("client_id %s mismatch client %s", conf.ClientID, id))
+		return
+	}
+	conf.ClientID = id
+
+	err = conf.validate()
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = storePut(s.store, StoreKindClient, id, conf)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	logs.Info("admin update client %s", id)
+	c.JSON(http.StatusOK, &clientView{ClientConfig: conf})
+}
+
+// deleteClient deletes client credential
+// online sessions of the client are not kicked
+func (s *AdminServer) deleteClient(c *gin.Context) {
+	id := c.Param("client_id")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.store.Delete(StoreKindClient, id)
+	if err != nil {
+		s.abortStoreError(c, "client", id, err)
+		return
+	}
+	logs.Info("admin delete client %s", id)
+	c.Status(http.StatusNoContent)
+}
+
+type oidcUserView struct {
+	*OIDCUser
+	// password is never replied
+	Password string `json:"password,omitempty"`
+}
+
+func (s *AdminServer) listOIDCUsers(c *gin.Context) {
+	users, err := storeOIDCUsers(s.store)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID() < users[j].ID()
+	})
+	views := make([]*oidcUserView, 0, len(users))
+	for _, user := range users {
+		views = append(views, &oidcUserView{OIDCUser: user})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// updateOIDCUser creates or replaces user of oidc client
+// body is {"password", "email"}
+func (s *AdminServer) updateOIDCUser(c *gin.Context) {
+	userInfo := authenticate.UserInfo{}
+	err := c.ShouldBindJSON(&userInfo)
+	if err != nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, err.Error())
+		return
+	}
+
+	user := &OIDCUser{
+		AuthID:   c.Param("auth_id"),
+		ClientID: c.Param("client_id"),
+		UserInfo: userInfo,
+	}
+	user.Username = c.Param("username")
+	if user.Password == "" {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument, "password is required")
+		return
+	}
+
+	if authenticate.GetAuthenticate(user.AuthID) == nil {
+		abort(c, http.StatusBadRequest, AdminCodeInvalidArgument,
+			fmt.Sprintf("authenticate %s is not running", user.AuthID))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = storePut(s.store, StoreKindOIDCUser, user.ID(), user)
+	if err != nil {
+		abort(c, http.StatusInternalServerError, AdminCodeInternal, err.Error())
+		return
+	}
+	logs.Info("admin update oidc user %s", user.ID())
+	c.JSON(http.StatusOK, &oidcUserView{OIDCUser: user})
+}
+
+func (s *AdminServer) deleteOIDCUser(c *gin.Context) {
+	id := oidcUserID(c.Param("auth_id"), c.Param("client_id"), c.Param("username"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.store.Delete(StoreKindOIDCUser, id)
+	if err != nil {
+		s.abortStoreError(c, "oidc user", id, err)
+		return
+	}
+	logs.Info("admin delete oidc user %s", id)
+	c.Status(http.StatusNoContent)
+}
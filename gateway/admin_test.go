@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminSSL(t *testing.T) {
+	convey.Convey("test admin ssl", t, func() {
+		sslFile := filepath.Join(t.TempDir(), "ssl.json")
+		os.WriteFile(sslFile, []byte(`[{"id": "s1", "http_route_type": "builtin",
+			"cert": "cert", "key": "key", "snis": ["a.example.com"]}]`), 0600)
+		s, err := newFileStore(map[string]string{StoreKindSSL: sslFile})
+		convey.So(err, convey.ShouldBeNil)
+
+		sessionMgr := NewSessionManager(false, time.Second, "")
+		gw := NewGateway(&GatewayConfig{}, sessionMgr, NewListenerManager(sessionMgr))
+		admin := NewAdminServer(&AdminConfig{ListenAddr: "127.0.0.1:0", Token: "t1"}, gw, s)
+		handler := admin.handler()
+		do := func(method, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/api/v1"+path, nil)
+			req.Header.Set("Authorization", "Bearer t1")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		w := do("GET", "/ssl")
+		convey.So(w.Code, convey.ShouldEqual, http.StatusOK)
+		views := make([]map[string]interface{}, 0)
+		json.Unmarshal(w.Body.Bytes(), &views)
+		convey.So(len(views), convey.ShouldEqual, 1)
+		convey.So(views[0]["id"], convey.ShouldEqual, "s1")
+		// key is never replied
+		convey.So(views[0]["key"], convey.ShouldBeNil)
+
+		convey.So(do("GET", "/ssl/s1").Code, convey.ShouldEqual, http.StatusOK)
+		convey.So(do("GET", "/ssl/s2").Code, convey.ShouldEqual, http.StatusNotFound)
+		convey.So(do("DELETE", "/ssl/s1").Code, convey.ShouldEqual, http.StatusNoContent)
+		convey.So(do("GET", "/ssl/s1").Code, convey.ShouldEqual, http.StatusNotFound)
+		convey.So(do("DELETE", "/ssl/s1").Code, convey.ShouldEqual, http.StatusNotFound)
+
+		// closed on shutdown
+		convey.So(admin.Close(), convey.ShouldBeNil)
+		convey.So(admin.ListenAndServe(), convey.ShouldEqual, http.ErrServerClosed)
+	})
+}
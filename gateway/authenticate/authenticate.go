@@ -3,6 +3,8 @@ package authenticate
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/astaxie/beego/logs"
 	"github.com/go-jose/go-jose/v4"
 	"github.com/go-jose/go-jose/v4/jose-util/generator"
 	"net/http"
@@ -26,8 +28,24 @@ type UserInfo struct {
 type Authenticate interface {
 	// AddClient add a client(eg: apisix)
 	AddClient(clientID, clientSecret, redirectUri string)
-	// AddUser add a user into client
+	// RemoveClient remove client and its users
+	RemoveClient(clientID string)
+	// AddUser add a user into client, the user of the same username is replaced
 	AddUser(clientID string, userInfo *UserInfo)
+	// RemoveUser remove user username from client
+	RemoveUser(clientID, username string)
+	// SetUsers replace users of all clients, client_id -> user list
+	SetUsers(users map[string][]*UserInfo)
+	// Reload apply configuration changed at runtime, eg: clients
+	// conf is validated by ParseConfig
+	Reload(conf json.RawMessage)
+}
+
+// Config of an authenticate service in http_authenticate file
+type Config struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	raw  json.RawMessage
 }
 
 // IDToken is the oidc id information reply for exchange code
@@ -42,25 +60,53 @@ type IDToken struct {
 	Name       string `json:"name,omitempty"`
 }
 
-// RunAuthenticateService base on config file
-func RunAuthenticateService(confFile string) error {
+// ParseConfig parse and validate http_authenticate file
+func ParseConfig(confFile string) ([]*Config, error) {
 	content, err := os.ReadFile(confFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var configs = make([]map[string]interface{}, 0)
-	err = json.Unmarshal(content, &configs)
+	var items = make([]json.RawMessage, 0)
+	err = json.Unmarshal(content, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*Config, 0, len(items))
+	for _, item := range items {
+		config := &Config{raw: item}
+		err := json.Unmarshal(item, config)
+		if err != nil {
+			return nil, err
+		}
+		if config.ID == "" || config.Type == "" {
+			return nil, fmt.Errorf("id and type are required")
+		}
+
+		switch config.Type {
+		case "OIDC":
+			err = json.Unmarshal(item, &OIDCConfig{})
+		default:
+			err = errNotSupportedAuthType
+		}
+		if err != nil {
+			return nil, fmt.Errorf("authenticate %s: %v", config.ID, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// RunAuthenticateService base on config file
+func RunAuthenticateService(confFile string) error {
+	configs, err := ParseConfig(confFile)
 	if err != nil {
 		return err
 	}
 
 	for _, config := range configs {
-		configBytes, _ := json.Marshal(config)
-		// just panic if type assert fail
-		id := config["id"].(string)
-		authType := config["type"].(string)
-		err := runAuthenticateService(id, authType, configBytes)
+		err := runAuthenticateService(config.ID, config.Type, config.raw)
 		if err != nil {
 			return err
 		}
@@ -69,13 +115,37 @@ func RunAuthenticateService(confFile string) error {
 	return nil
 }
 
-// WatchConfigChanges watch for config file update interval
-// support:
-//   - add/del clients
-//   - add/del client users
-//
-// TODO:
-func WatchConfigChanges(confFile string) {
+// Reload apply configs parsed by ParseConfig to running services
+// new services and removed services take effect after restart
+func Reload(configs []*Config) {
+	ids := make(map[string]bool)
+	for _, config := range configs {
+		ids[config.ID] = true
+		auth := authenticates[config.ID]
+		if auth == nil {
+			logs.Warn("authenticate %s is added, restart is required", config.ID)
+			continue
+		}
+		auth.Reload(config.raw)
+	}
+
+	for id := range authenticates {
+		if !ids[id] {
+			logs.Warn("authenticate %s is removed, restart is required", id)
+		}
+	}
+}
+
+// GetAuthenticate get authenticate service of id
+func GetAuthenticate(id string) Authenticate {
+	return authenticates[id]
+}
+
+// Range iterates all authenticate services
+func Range(f func(id string, auth Authenticate)) {
+	for id, auth := range authenticates {
+		f(id, auth)
+	}
 }
 
 func runAuthenticateService(id, authType string, conf json.RawMessage) error {
@@ -47,6 +47,13 @@ func (s *MemStorage) SetClient(id string, client osin.Client) error {
 	return nil
 }
 
+func (s *MemStorage) RemoveClient(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, id)
+	return nil
+}
+
 func (s *MemStorage) SaveAuthorize(data *osin.AuthorizeData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
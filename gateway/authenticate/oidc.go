@@ -294,5 +294,91 @@ func (o *OIDC) AddClient(clientID, clientSecret, redirectUri string) {
 func (o *OIDC) AddUser(clientID string, userInfo *UserInfo) {
 	o.usersMu.Lock()
 	defer o.usersMu.Unlock()
+	for i, u := range o.users[clientID] {
+		if u.Username == userInfo.Username {
+			o.users[clientID][i] = userInfo
+			return
+		}
+	}
 	o.users[clientID] = append(o.users[clientID], userInfo)
 }
+
+// RemoveUser remove UserInfo of username from storage
+// concurrency safety
+func (o *OIDC) RemoveUser(clientID, username string) {
+	o.usersMu.Lock()
+	defer o.usersMu.Unlock()
+	userList := o.users[clientID]
+	for i, u := range userList {
+		if u.Username == username {
+			o.users[clientID] = append(userList[:i], userList[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetUsers replace all UserInfo in storage
+// concurrency safety
+func (o *OIDC) SetUsers(users map[string][]*UserInfo) {
+	o.usersMu.Lock()
+	defer o.usersMu.Unlock()
+	o.users = make(map[string][]*UserInfo)
+	for clientID, userList := range users {
+		o.users[clientID] = append([]*UserInfo{}, userList...)
+	}
+}
+
+// RemoveClient remove osin.Client and its UserInfo from storage
+// concurrency safety
+func (o *OIDC) RemoveClient(clientID string) {
+	o.memStorage.RemoveClient(clientID)
+	o.usersMu.Lock()
+	defer o.usersMu.Unlock()
+	delete(o.users, clientID)
+}
+
+// Reload apply clients changed in rawConf
+// users are not touched, they are kept in gateway store
+// changes of other fields take effect after restart
+func (o *OIDC) Reload(rawConf json.RawMessage) {
+	var conf = &OIDCConfig{}
+	err := json.Unmarshal(rawConf, conf)
+	if err != nil {
+		logs.Error("reload oidc %s fail: %v", o.conf.ID, err)
+		return
+	}
+
+	if conf.Issuer != o.conf.Issuer ||
+		conf.ListenAddr != o.conf.ListenAddr ||
+		conf.PrivateKeyFile != o.conf.PrivateKeyFile ||
+		conf.PublicKeyFile != o.conf.PublicKeyFile ||
+		conf.StaticFolder != o.conf.StaticFolder {
+		logs.Warn("oidc %s config changed, restart is required", o.conf.ID)
+	}
+
+	clients := make(map[string]*ClientInfo)
+	for _, client := range conf.Clients {
+		clients[client.ClientID] = client
+	}
+
+	for _, old := range o.conf.Clients {
+		if _, ok := clients[old.ClientID]; !ok {
+			logs.Info("oidc %s remove client %s", o.conf.ID, old.ClientID)
+			o.RemoveClient(old.ClientID)
+		}
+	}
+
+	for _, client := range conf.Clients {
+		c, err := o.memStorage.GetClient(client.ClientID)
+		if err == nil && c.GetSecret() == client.ClientSecret &&
+			c.GetRedirectUri() == client.RedirectUri {
+			continue
+		}
+		logs.Info("oidc %s update client %s", o.conf.ID, client.ClientID)
+		o.AddClient(client.ClientID, client.ClientSecret, client.RedirectUri)
+	}
+
+	newConf := *o.conf
+	newConf.Clients = conf.Clients
+	o.conf = &newConf
+}
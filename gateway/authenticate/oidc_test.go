@@ -9,7 +9,7 @@ import (
 func TestOIDCAuthenticate(t *testing.T) {
 	convey.Convey("test oidc authenticate", t, func() {
 		convey.Convey("test new oidc instance", func() {
-			oidc, err := NewOIDCService([]byte("{}"))
+			oidc, err := NewOIDC([]byte("{}"))
 			convey.So(err, convey.ShouldNotBeNil)
 			convey.So(oidc, convey.ShouldBeNil)
 		})
@@ -1,9 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
 	"github.com/alecthomas/gometalinter/_linters/src/gopkg.in/yaml.v2"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -21,10 +27,109 @@ type Config struct {
 	HTTPAuthenticate string `yaml:"http_authenticate"`
 	ListenerFile     string `yaml:"listener_file"`
 	SSLFile          string `yaml:"ssl_file"`
+	ClientFile       string `yaml:"client_file"`
+	// where listeners, clients, ssl and oidc users are stored
+	// the files above are used by file store, default file store
+	Store *StoreConfig `yaml:"store"`
+	// optional admin http api
+	Admin *AdminConfig `yaml:"admin"`
+}
+
+// StoreConfig of listeners, clients, ssl and oidc users
+type StoreConfig struct {
+	// file(default) or bolt
+	Type string `yaml:"type"`
+	// database file of bolt store
+	// listener_file, client_file, ssl_file and users of http_authenticate
+	// are imported into empty database
+	Path string `yaml:"path"`
+}
+
+// AdminConfig of admin http api
+type AdminConfig struct {
+	// tcp address, eg: "127.0.0.1:12380"
+	ListenAddr string `yaml:"listen_addr"`
+	// requests must carry header "Authorization: Bearer <token>"
+	Token string `yaml:"token"`
+	// serves https if configured
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 type GatewayConfig struct {
+	ListenAddr string     `yaml:"listen_addr"`
+	TLS        *TLSConfig `yaml:"tls"`
+	// features clients must support, eg: heartbeat
+	RequiredFeatures []string `yaml:"required_features"`
+	// what to do when a client connects while its session is online
+	// reject: reject the new connection until the old session is offline (default)
+	// takeover: the new connection replaces the old session, the old one is drained
+	SessionPolicy string `yaml:"session_policy"`
+	// seconds to wait for the streams of a replaced session,
+	// a removed listener or on shutdown, default 30
+	DrainTimeout int `yaml:"drain_timeout"`
+	// default load balance strategy for clients with multiple instances
+	// round_robin(default), least_streams or hash
+	LoadBalance string `yaml:"load_balance"`
+	// seconds between heartbeats to clients supporting heartbeat, default 5
+	HeartbeatInterval int `yaml:"heartbeat_interval"`
+	// session is closed if client is silent for so many seconds, default 15
+	HeartbeatTimeout int `yaml:"heartbeat_timeout"`
+	// multiplexers offered to clients and tuning
+	Mux *mux.Config `yaml:"mux"`
+	// optional tunnel over quic, tls is required
+	QUIC *QUICConfig `yaml:"quic"`
+	// optional tunnel over websocket, https if tls is configured
+	WebSocket *WebSocketConfig `yaml:"websocket"`
+	// optional tunnel over kcp for lossy links, tls works over kcp too
+	KCP *KCPConfig `yaml:"kcp"`
+}
+
+// transports of tunnel
+const (
+	TransportTCP       = "tcp"
+	TransportQUIC      = "quic"
+	TransportWebSocket = "websocket"
+	TransportKCP       = "kcp"
+)
+
+type KCPConfig struct {
+	// udp address, eg: ":12361"
+	ListenAddr       string `yaml:"listen_addr"`
+	common.KCPConfig `yaml:",inline"`
+}
+
+// WebSocketConfig of tunnel over websocket
+type WebSocketConfig struct {
+	// tcp address, eg: ":443"
+	ListenAddr string `yaml:"listen_addr"`
+	// http path of websocket upgrade, default /zta
+	Path string `yaml:"path"`
+}
+
+// QUICConfig of tunnel over quic
+// each proxied connection is a quic stream and udp packets are datagrams
+type QUICConfig struct {
+	// udp address, eg: ":12360"
 	ListenAddr string `yaml:"listen_addr"`
+	// seconds without any packet before the connection is closed, default 30
+	IdleTimeout int `yaml:"idle_timeout"`
+}
+
+const (
+	SessionPolicyReject   = "reject"
+	SessionPolicyTakeover = "takeover"
+)
+
+// TLSConfig for tunnel between zta client and gateway
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ca to verify client certificate, enable mutual tls if set
+	ClientCAFile string `yaml:"client_ca_file"`
+	// client certificate CN or SAN must match the handshake client id
+	// only works with client_ca_file
+	VerifyClientID bool `yaml:"verify_client_id"`
 }
 
 func ParseConfig(confFile string) (*Config, error) {
@@ -38,6 +143,112 @@ func ParseConfig(confFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if cfg.GatewayConfig == nil {
+		return nil, fmt.Errorf("gateway is required")
+	}
+
+	tlsConf := cfg.GatewayConfig.TLS
+	if tlsConf != nil && tlsConf.VerifyClientID && tlsConf.ClientCAFile == "" {
+		return nil, fmt.Errorf("verify_client_id requires client_ca_file")
+	}
+
+	switch cfg.GatewayConfig.SessionPolicy {
+	case "":
+		cfg.GatewayConfig.SessionPolicy = SessionPolicyReject
+	case SessionPolicyReject, SessionPolicyTakeover:
+	default:
+		return nil, fmt.Errorf("invalid session_policy %s", cfg.GatewayConfig.SessionPolicy)
+	}
+
+	if cfg.GatewayConfig.DrainTimeout <= 0 {
+		cfg.GatewayConfig.DrainTimeout = 30
+	}
+
+	if quicConf := cfg.GatewayConfig.QUIC; quicConf != nil {
+		if quicConf.ListenAddr == "" || tlsConf == nil {
+			return nil, fmt.Errorf("quic requires listen_addr and tls")
+		}
+		if quicConf.IdleTimeout <= 0 {
+			quicConf.IdleTimeout = 30
+		}
+	}
+
+	if wsConf := cfg.GatewayConfig.WebSocket; wsConf != nil {
+		if wsConf.ListenAddr == "" {
+			return nil, fmt.Errorf("websocket requires listen_addr")
+		}
+		if wsConf.Path == "" {
+			wsConf.Path = "/zta"
+		}
+	}
+
+	if kcpConf := cfg.GatewayConfig.KCP; kcpConf != nil {
+		if kcpConf.ListenAddr == "" {
+			return nil, fmt.Errorf("kcp requires listen_addr")
+		}
+		err = kcpConf.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.GatewayConfig.Mux == nil {
+		cfg.GatewayConfig.Mux = &mux.Config{}
+	}
+	err = cfg.GatewayConfig.Mux.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.GatewayConfig.HeartbeatInterval <= 0 {
+		cfg.GatewayConfig.HeartbeatInterval = 5
+	}
+	if cfg.GatewayConfig.HeartbeatTimeout <= 0 {
+		cfg.GatewayConfig.HeartbeatTimeout = 15
+	}
+	if cfg.GatewayConfig.HeartbeatTimeout <= cfg.GatewayConfig.HeartbeatInterval {
+		return nil, fmt.Errorf("heartbeat_timeout should be greater than heartbeat_interval")
+	}
+
+	if cfg.GatewayConfig.LoadBalance == "" {
+		cfg.GatewayConfig.LoadBalance = BalanceRoundRobin
+	}
+	err = validateLoadBalance(cfg.GatewayConfig.LoadBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Store == nil {
+		cfg.Store = &StoreConfig{}
+	}
+	switch cfg.Store.Type {
+	case "":
+		cfg.Store.Type = StoreTypeFile
+	case StoreTypeFile:
+	case StoreTypeBolt:
+		if cfg.Store.Path == "" {
+			return nil, fmt.Errorf("bolt store requires path")
+		}
+	default:
+		return nil, fmt.Errorf("invalid store type %s", cfg.Store.Type)
+	}
+
+	if cfg.Admin != nil && (cfg.Admin.ListenAddr == "" || cfg.Admin.Token == "") {
+		return nil, fmt.Errorf("admin requires listen_addr and token")
+	}
+	if cfg.Admin != nil && (cfg.Admin.CertFile == "") != (cfg.Admin.KeyFile == "") {
+		return nil, fmt.Errorf("admin requires cert_file and key_file together")
+	}
+
+	required, err := common.ParseFeatures(cfg.GatewayConfig.RequiredFeatures)
+	if err != nil {
+		return nil, err
+	}
+	if missing := required &^ common.SupportedFeatures; missing != 0 {
+		return nil, fmt.Errorf("required features %s are not supported",
+			common.FeatureString(missing))
+	}
 	return &cfg, nil
 }
 
@@ -52,56 +263,171 @@ type ListenerConfig struct {
 	InternalPort     uint16                 `json:"internal_port"`
 	HTTPRouteType    string                 `json:"http_route_type"`
 	HTTPParam        map[string]interface{} `json:"http_param"`
+	// override gateway load_balance for this listener
+	LoadBalance string `json:"load_balance"`
+	// service name declared in client config, replace internal_ip and internal_port
+	InternalService string `json:"internal_service"`
+	// snappy or zstd, compress the streams of tcp, http and https listeners
+	// clients not supporting compression are not affected, default none
+	Compression string `json:"compression"`
 }
 
-func ParseListenerConfig(confFile string) ([]*ListenerConfig, error) {
-	content, err := os.ReadFile(confFile)
-	if err != nil {
-		return nil, err
+func (c *ListenerConfig) validate() error {
+	if c.LoadBalance != "" {
+		err := validateLoadBalance(c.LoadBalance)
+		if err != nil {
+			return err
+		}
 	}
 
-	var cfg = make([]*ListenerConfig, 0)
-	err = json.Unmarshal(content, &cfg)
+	err := common.ValidateCompression(c.Compression)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if c.Compression != "" && c.PublicProtocol == "udp" {
+		return fmt.Errorf("listener %s: compression is not supported for udp", c.ID)
 	}
-	return cfg, nil
+	return nil
 }
 
 type SSLConfig struct {
 	ID            string   `json:"id"`
 	HTTPRouteType string   `json:"http_route_type"`
-	Cert          string   `json:"-"`
-	Key           string   `json:"-"`
-	CertFile      string   `json:"cert_file"`
-	KeyFile       string   `json:"key_file"`
+	Cert          string   `json:"cert,omitempty"`
+	Key           string   `json:"key,omitempty"`
+	CertFile      string   `json:"cert_file,omitempty"`
+	KeyFile       string   `json:"key_file,omitempty"`
 	SNIs          []string `json:"snis"`
+	// sha256 of cert_file and key_file, set by store
+	// so changes of the files are changes of the record
+	Digest string `json:"digest,omitempty"`
 }
 
-func ParseSSLConfig(confFile string) ([]*SSLConfig, error) {
-	content, err := os.ReadFile(confFile)
-	if err != nil {
-		return nil, err
+// load reads certificate and key from cert_file and key_file
+// certificate and key may also be inline, eg: created by admin api
+func (c *SSLConfig) load() error {
+	if c.CertFile != "" {
+		crt, err := os.ReadFile(c.CertFile)
+		if err != nil {
+			return err
+		}
+		c.Cert = string(crt)
 	}
 
-	var cfgs = make([]*SSLConfig, 0)
-	err = json.Unmarshal(content, &cfgs)
-	if err != nil {
-		return nil, err
+	if c.KeyFile != "" {
+		key, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return err
+		}
+		c.Key = string(key)
 	}
 
-	for _, cfg := range cfgs {
-		// load cert and key from file
-		crt, err := os.ReadFile(cfg.CertFile)
+	if c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("ssl %s: cert and key are required", c.ID)
+	}
+	return nil
+}
+
+// digest returns sha256 of loaded certificate and key
+func (c *SSLConfig) digest() string {
+	sum := sha256.Sum256([]byte(c.Cert + "\n" + c.Key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientConfig is the credential of a zta client
+// secret is never sent over the wire, client proves it holds the
+// secret by signing the challenge nonce
+type ClientConfig struct {
+	ClientID string `json:"client_id"`
+	Secret   string `json:"secret"`
+	// service groups the client is allowed to join
+	Groups []string `json:"groups"`
+	// max instances online at the same time, default 1
+	// instances share the listeners of the client id or group
+	MaxInstances int `json:"max_instances"`
+	// listeners the client is allowed to register by itself
+	// registration is rejected if not set
+	Quota *ClientQuota `json:"quota"`
+	// transports the client is allowed to use, tcp, quic, websocket or kcp
+	// allow all if empty
+	Transports []string `json:"transports"`
+}
+
+// ClientQuota limits the listeners registered by client
+type ClientQuota struct {
+	MaxListeners int `json:"max_listeners"`
+	// allowed public protocols, allow all if empty
+	Protocols []string `json:"protocols"`
+	// allowed public ports, eg: "20000-20100,30000"
+	Ports string `json:"ports"`
+	// public ip of tcp and udp listeners, default 0.0.0.0
+	PublicIP string `json:"public_ip"`
+	// allowed hostnames of http and https listeners
+	// "*.example.com" matches any subdomain of example.com
+	Hosts []string `json:"hosts"`
+	// http route of http and https listeners
+	HTTPRouteType string `json:"http_route_type"`
+
+	portRanges [][2]uint16
+}
+
+func (c *ClientConfig) validate() error {
+	if c.ClientID == "" || c.Secret == "" {
+		return fmt.Errorf("client_id and secret are required")
+	}
+
+	for _, transport := range c.Transports {
+		switch transport {
+		case TransportTCP, TransportQUIC, TransportWebSocket, TransportKCP:
+		default:
+			return fmt.Errorf("client %s: invalid transport %s", c.ClientID, transport)
+		}
+	}
+
+	if c.Quota != nil {
+		portRanges, err := parsePortRanges(c.Quota.Ports)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("client %s: %v", c.ClientID, err)
+		}
+		c.Quota.portRanges = portRanges
+		if c.Quota.PublicIP == "" {
+			c.Quota.PublicIP = "0.0.0.0"
 		}
-		key, err := os.ReadFile(cfg.KeyFile)
+	}
+	return nil
+}
+
+func validateLoadBalance(balance string) error {
+	switch balance {
+	case BalanceRoundRobin, BalanceLeastStreams, BalanceHash:
+		return nil
+	default:
+		return fmt.Errorf("invalid load_balance %s", balance)
+	}
+}
+
+func parsePortRanges(ports string) ([][2]uint16, error) {
+	ranges := make([][2]uint16, 0)
+	if ports == "" {
+		return ranges, nil
+	}
+
+	for _, item := range strings.Split(ports, ",") {
+		item = strings.TrimSpace(item)
+		lo, hi, isRange := strings.Cut(item, "-")
+		start, err := strconv.ParseUint(lo, 10, 16)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid ports %s", ports)
+		}
+
+		end := start
+		if isRange {
+			end, err = strconv.ParseUint(hi, 10, 16)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid ports %s", ports)
+			}
 		}
-		cfg.Cert = string(crt)
-		cfg.Key = string(key)
+		ranges = append(ranges, [2]uint16{uint16(start), uint16(end)})
 	}
-	return cfgs, nil
+	return ranges, nil
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	convey.Convey("test parse config", t, func() {
+		confFile := filepath.Join(t.TempDir(), "gateway.yaml")
+		parse := func(content string) (*Config, error) {
+			os.WriteFile(confFile, []byte(content), 0644)
+			return ParseConfig(confFile)
+		}
+
+		_, err := parse("listener_file: listener.json\n")
+		convey.So(err, convey.ShouldNotBeNil)
+
+		_, err = parse("gateway:\n  listen_addr: 127.0.0.1:0\n  tls:\n    verify_client_id: true\n")
+		convey.So(err, convey.ShouldNotBeNil)
+
+		_, err = parse("gateway:\n  listen_addr: 127.0.0.1:0\nadmin:\n  listen_addr: 127.0.0.1:0\n  token: t1\n  cert_file: admin.crt\n")
+		convey.So(err, convey.ShouldNotBeNil)
+
+		conf, err := parse("gateway:\n  listen_addr: 127.0.0.1:0\n")
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(conf.GatewayConfig.SessionPolicy, convey.ShouldEqual, SessionPolicyReject)
+	})
+}
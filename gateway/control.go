@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/gateway/http_route"
+	"github.com/astaxie/beego/logs"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controlSession serves the control streams opened by client
+type controlSession struct {
+	gw   *Gateway
+	sess *Session
+
+	// listeners registered by client, name -> listener
+	listenersMu sync.Mutex
+	listeners   map[string]*Listener
+}
+
+// serveControl accepts streams opened by client until the session ends
+// listeners registered by client are closed when the session ends
+func (gw *Gateway) serveControl(sess *Session) {
+	cs := &controlSession{
+		gw:        gw,
+		sess:      sess,
+		listeners: make(map[string]*Listener),
+	}
+	defer cs.close()
+
+	for {
+		stream, err := sess.Connection.AcceptStream()
+		if err != nil {
+			logs.Debug("session %s control closed: %v", sess, err)
+			return
+		}
+
+		go cs.serveStream(stream)
+	}
+}
+
+func (cs *controlSession) serveStream(stream net.Conn) {
+	defer stream.Close()
+
+	var writeMu sync.Mutex
+	write := func(buf []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := stream.Write(buf)
+		stream.SetWriteDeadline(time.Time{})
+		return err
+	}
+
+	// frames from gateway, eg: goaway, are sent over the latest control stream
+	cs.sess.setControl(stream, write)
+
+	conf := cs.gw.conf
+	hb := common.NewHeartbeat(
+		time.Duration(conf.HeartbeatInterval)*time.Second,
+		time.Duration(conf.HeartbeatTimeout)*time.Second,
+		cs.sess.RTT, write)
+	if cs.sess.Features&common.FeatureHeartbeat != 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			err := hb.Run(done)
+			if err != nil {
+				// half-open connection, close the session so it goes offline
+				logs.Warn("session %s heartbeat fail: %v", cs.sess, err)
+				cs.sess.Connection.Close()
+			}
+		}()
+	}
+
+	for {
+		frame, err := common.ReadFrame(stream)
+		if err != nil {
+			return
+		}
+
+		handled, err := hb.HandleFrame(frame)
+		if err != nil {
+			logs.Warn("session %s handle heartbeat fail: %v", cs.sess, err)
+			return
+		}
+		if handled {
+			continue
+		}
+
+		switch frame.Cmd {
+		case common.CmdRegisterListener:
+			req := &common.RegisterListenerReq{}
+			err = frame.Decode(req)
+			if err != nil {
+				logs.Warn("session %s decode register listener fail: %v", cs.sess, err)
+				return
+			}
+
+			reply := cs.register(req)
+			buf, err := reply.Encode()
+			if err != nil {
+				logs.Warn("encode register listener reply fail: %v", err)
+				return
+			}
+
+			err = write(buf)
+			if err != nil {
+				logs.Warn("session %s write control stream fail: %v", cs.sess, err)
+				return
+			}
+		default:
+			logs.Warn("session %s unknown control cmd %d", cs.sess, frame.Cmd)
+		}
+	}
+}
+
+func (cs *controlSession) register(req *common.RegisterListenerReq) *common.RegisterListenerReply {
+	reply := &common.RegisterListenerReply{Name: req.Name}
+	l, err := cs.createListener(req)
+	if err != nil {
+		logs.Warn("session %s register listener %s fail: %v", cs.sess, req.Name, err)
+		reply.Code = common.CodeForbidden
+		reply.Message = err.Error()
+		return reply
+	}
+
+	reply.Code = common.CodeOK
+	reply.ListenerID = l.listenerConfig.ID
+	reply.PublicPort = l.listenerConfig.PublicPort
+	logs.Info("session %s register listener %+v", cs.sess, l.listenerConfig)
+	return reply
+}
+
+func (cs *controlSession) createListener(req *common.RegisterListenerReq) (*Listener, error) {
+	client := cs.gw.getClient(cs.sess.ClientID)
+	if client == nil || client.Quota == nil {
+		return nil, fmt.Errorf("listener registration is not allowed")
+	}
+	quota := client.Quota
+
+	if req.Name == "" || req.Service == "" {
+		return nil, fmt.Errorf("name and service are required")
+	}
+
+	if len(quota.Protocols) > 0 && !contains(quota.Protocols, req.PublicProtocol) {
+		return nil, fmt.Errorf("protocol %s is not allowed", req.PublicProtocol)
+	}
+
+	cs.listenersMu.Lock()
+	defer cs.listenersMu.Unlock()
+
+	id := fmt.Sprintf("%s/%s/%s", cs.sess.ClientID, cs.sess.InstanceID, req.Name)
+	conf := &ListenerConfig{
+		ID:               id,
+		ClientID:         cs.sess.Key(),
+		PublicProtocol:   req.PublicProtocol,
+		InternalProtocol: req.ServiceProtocol,
+		InternalService:  req.Service,
+		Compression:      req.Compression,
+	}
+	err := conf.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// ports to try, tcp and udp use the requested port
+	// http and https listen on loopback and allocate port from quota
+	ports := make([]uint16, 0)
+	switch req.PublicProtocol {
+	case "tcp", "udp":
+		if !quota.allowPort(req.PublicPort) {
+			return nil, fmt.Errorf("port %d is not allowed", req.PublicPort)
+		}
+		conf.PublicIP = quota.PublicIP
+		ports = append(ports, req.PublicPort)
+	case "http", "https":
+		if len(req.Hosts) == 0 {
+			return nil, fmt.Errorf("hosts are required")
+		}
+		for _, host := range req.Hosts {
+			if !quota.allowHost(host) {
+				return nil, fmt.Errorf("host %s is not allowed", host)
+			}
+		}
+		if quota.HTTPRouteType == "" {
+			return nil, fmt.Errorf("http route is not configured")
+		}
+		route := http_route.GetRoute(quota.HTTPRouteType)
+		if route == nil {
+			return nil, fmt.Errorf("http route %s is not initialized", quota.HTTPRouteType)
+		}
+		conf.HTTPRouteType = quota.HTTPRouteType
+		// stream routes proxy into streams of the listener, no port is listened
+		if _, ok := route.(http_route.StreamRoute); ok {
+			ports = append(ports, 0)
+			break
+		}
+		conf.PublicIP = "127.0.0.1"
+		ports = quota.ports()
+	default:
+		return nil, fmt.Errorf("protocol %s is not supported", req.PublicProtocol)
+	}
+
+	if conf.InternalProtocol == "" {
+		conf.InternalProtocol = "tcp"
+	}
+
+	// the quota is reserved before listening, so the lock is not held
+	// while closing the replaced listener or listening ports
+	err = cs.gw.reserve(cs.sess.ClientID, id, quota.MaxListeners)
+	if err != nil {
+		return nil, err
+	}
+
+	// the listener re-registered by the same instance is replaced
+	// eg: the session is taken over
+	cs.gw.listenerMgr.CloseListener(id)
+
+	l, err := cs.listen(conf, ports, req.Hosts)
+	cs.gw.commitReserved(cs.sess.ClientID, id, l)
+	if err != nil {
+		return nil, err
+	}
+	cs.listeners[req.Name] = l
+	return l, nil
+}
+
+// listen tries ports in order and serves the listener of the first available one
+func (cs *controlSession) listen(conf *ListenerConfig, ports []uint16, hosts []string) (*Listener, error) {
+	var lastErr error
+	for _, port := range ports {
+		conf.PublicPort = port
+		if conf.HTTPRouteType != "" {
+			conf.HTTPParam = registeredHTTPParam(conf, hosts)
+		}
+
+		l := NewListener(conf, cs.gw.sessionMgr)
+		err := l.Listen()
+		if err != nil {
+			// try next port only if the port is in use
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		cs.gw.listenerMgr.AddListener(conf.ID, l)
+		go l.Serve()
+		return l, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no port available")
+	}
+	return nil, lastErr
+}
+
+func (cs *controlSession) close() {
+	cs.listenersMu.Lock()
+	defer cs.listenersMu.Unlock()
+	for name, l := range cs.listeners {
+		logs.Info("session %s closed, remove listener %s", cs.sess, l.listenerConfig.ID)
+		cs.gw.listenerMgr.RemoveListener(l.listenerConfig.ID, l)
+		cs.gw.unregister(cs.sess.ClientID, l)
+		delete(cs.listeners, name)
+	}
+}
+
+// reserve counts listener id of clientID in its quota
+// listeners of all instances of the client are counted
+// the reservation is nil until commitReserved
+func (gw *Gateway) reserve(clientID, id string, maxListeners int) error {
+	gw.registeredMu.Lock()
+	defer gw.registeredMu.Unlock()
+	registered := gw.registered[clientID]
+	if _, ok := registered[id]; !ok && len(registered) >= maxListeners {
+		return fmt.Errorf("exceed max listeners %d", maxListeners)
+	}
+	if registered == nil {
+		registered = make(map[string]*Listener)
+		gw.registered[clientID] = registered
+	}
+	registered[id] = nil
+	return nil
+}
+
+// commitReserved sets the listener of reserved id, or releases it if l is nil
+// the reservation taken by another registration in the meantime is kept
+func (gw *Gateway) commitReserved(clientID, id string, l *Listener) {
+	gw.registeredMu.Lock()
+	defer gw.registeredMu.Unlock()
+	registered := gw.registered[clientID]
+	current, ok := registered[id]
+	if !ok || current != nil {
+		return
+	}
+	if l != nil {
+		registered[id] = l
+		return
+	}
+	delete(registered, id)
+	if len(registered) == 0 {
+		delete(gw.registered, clientID)
+	}
+}
+
+// unregister removes listener l registered by clientID
+// the listener replaced by the same instance is kept
+func (gw *Gateway) unregister(clientID string, l *Listener) {
+	gw.registeredMu.Lock()
+	defer gw.registeredMu.Unlock()
+	registered := gw.registered[clientID]
+	if registered[l.listenerConfig.ID] != l {
+		return
+	}
+	delete(registered, l.listenerConfig.ID)
+	if len(registered) == 0 {
+		delete(gw.registered, clientID)
+	}
+}
+
+// registeredHTTPParam builds route param for client registered listener
+// the upstream is the loopback address listened, stream routes have no upstream
+func registeredHTTPParam(conf *ListenerConfig, hosts []string) map[string]interface{} {
+	routeID := "zta_" + strings.NewReplacer("/", "_", ":", "_").Replace(conf.ID)
+	param := map[string]interface{}{
+		"id":    routeID,
+		"uri":   "/*",
+		"hosts": hosts,
+	}
+	if _, ok := http_route.GetRoute(conf.HTTPRouteType).(http_route.StreamRoute); ok {
+		return param
+	}
+
+	upstream := fmt.Sprintf("%s:%d", conf.PublicIP, conf.PublicPort)
+	param["upstream"] = map[string]interface{}{
+		"type": "roundrobin",
+		"nodes": map[string]interface{}{
+			upstream: 1,
+		},
+	}
+	return param
+}
+
+func (q *ClientQuota) allowPort(port uint16) bool {
+	for _, r := range q.portRanges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *ClientQuota) ports() []uint16 {
+	ports := make([]uint16, 0)
+	for _, r := range q.portRanges {
+		for port := int(r[0]); port <= int(r[1]); port++ {
+			ports = append(ports, uint16(port))
+		}
+	}
+	return ports
+}
+
+func (q *ClientQuota) allowHost(host string) bool {
+	for _, pattern := range q.Hosts {
+		if pattern == host {
+			return true
+		}
+
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/gateway/http_route"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+func freePort() uint16 {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestRegisterListener(t *testing.T) {
+	convey.Convey("test register listener", t, func() {
+		sessionMgr := NewSessionManager(false, time.Second, "")
+		gw := NewGateway(&GatewayConfig{}, sessionMgr, NewListenerManager(sessionMgr))
+		port1, port2 := freePort(), freePort()
+		client := &ClientConfig{
+			ClientID: "c1",
+			Secret:   "s1",
+			Quota: &ClientQuota{
+				MaxListeners: 1,
+				Ports:        fmt.Sprintf("%d,%d", port1, port2),
+				PublicIP:     "127.0.0.1",
+			},
+		}
+		convey.So(client.validate(), convey.ShouldBeNil)
+		gw.SetClients([]*ClientConfig{client})
+
+		instance := func(id string) *controlSession {
+			return &controlSession{
+				gw:        gw,
+				sess:      &Session{ClientID: "c1", InstanceID: id},
+				listeners: make(map[string]*Listener),
+			}
+		}
+		req := func(name string, port uint16) *common.RegisterListenerReq {
+			return &common.RegisterListenerReq{
+				Name:           name,
+				PublicProtocol: "tcp",
+				PublicPort:     port,
+				Service:        "web",
+			}
+		}
+
+		// max_listeners is shared by instances of the client
+		cs1, cs2 := instance("i1"), instance("i2")
+		_, err := cs1.createListener(req("web", port1))
+		convey.So(err, convey.ShouldBeNil)
+		_, err = cs2.createListener(req("web", port2))
+		convey.So(err, convey.ShouldNotBeNil)
+
+		// registered again by the same instance
+		_, err = cs1.createListener(req("web", port1))
+		convey.So(err, convey.ShouldBeNil)
+
+		cs1.close()
+		_, err = cs2.createListener(req("web", port2))
+		convey.So(err, convey.ShouldBeNil)
+		cs2.close()
+		convey.So(len(gw.registered), convey.ShouldEqual, 0)
+	})
+}
+
+func TestRegisterHTTPListener(t *testing.T) {
+	convey.Convey("test register http listener", t, func() {
+		err := http_route.InitRoute(http_route.TypeBuiltin, json.RawMessage(`{"http_addr": "127.0.0.1:0"}`))
+		convey.So(err, convey.ShouldBeNil)
+		defer http_route.GetRoute(http_route.TypeBuiltin).(http_route.Service).Close()
+
+		sessionMgr := NewSessionManager(false, time.Second, "")
+		gw := NewGateway(&GatewayConfig{}, sessionMgr, NewListenerManager(sessionMgr))
+		client := &ClientConfig{
+			ClientID: "c1",
+			Secret:   "s1",
+			Quota: &ClientQuota{
+				MaxListeners:  1,
+				Hosts:         []string{"*.example.com"},
+				HTTPRouteType: http_route.TypeBuiltin,
+			},
+		}
+		convey.So(client.validate(), convey.ShouldBeNil)
+		gw.SetClients([]*ClientConfig{client})
+		cs := &controlSession{
+			gw:        gw,
+			sess:      &Session{ClientID: "c1", InstanceID: "i1"},
+			listeners: make(map[string]*Listener),
+		}
+
+		// builtin route proxies into streams, no port is allocated
+		l, err := cs.createListener(&common.RegisterListenerReq{
+			Name:           "web",
+			PublicProtocol: "http",
+			Hosts:          []string{"a.example.com"},
+			Service:        "web",
+		})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(l.listenerConfig.PublicPort, convey.ShouldEqual, 0)
+		convey.So(l.listenerConfig.HTTPParam["upstream"], convey.ShouldBeNil)
+		cs.close()
+		convey.So(len(gw.registered), convey.ShouldEqual, 0)
+	})
+}
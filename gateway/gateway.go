@@ -1,87 +1,570 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/ICKelin/zta/gateway/authenticate"
+	"github.com/ICKelin/zta/gateway/http_route"
 	"github.com/astaxie/beego/logs"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+var (
+	handshakeTimeout = time.Second * 10
+	ErrGatewayClosed = errors.New("gateway closed")
+)
+
 type Gateway struct {
-	conf       *GatewayConfig
-	clientIDs  map[string]struct{}
-	sessionMgr *SessionManager
+	conf             *GatewayConfig
+	requiredFeatures uint32
+	clientsMu        sync.Mutex
+	clients          map[string]*ClientConfig
+	sessionMgr       *SessionManager
+	listenerMgr      *ListenerManager
+
+	// listeners registered by clients, client_id -> listener id -> listener
+	// max_listeners of quota is shared by all instances of a client
+	registeredMu sync.Mutex
+	registered   map[string]map[string]*Listener
+
+	// tunnel listeners are closed at the beginning of shutdown
+	// tunnel transports shared by sessions are closed after sessions drained
+	closeMu    sync.Mutex
+	closing    bool
+	listeners  []io.Closer
+	transports []io.Closer
 }
 
-func NewGateway(conf *GatewayConfig, sessionMgr *SessionManager) *Gateway {
+func NewGateway(conf *GatewayConfig, sessionMgr *SessionManager, listenerMgr *ListenerManager) *Gateway {
+	// already validated in ParseConfig
+	requiredFeatures, _ := common.ParseFeatures(conf.RequiredFeatures)
 	gw := &Gateway{
-		conf:       conf,
-		sessionMgr: sessionMgr,
+		conf:             conf,
+		requiredFeatures: requiredFeatures,
+		clients:          make(map[string]*ClientConfig),
+		sessionMgr:       sessionMgr,
+		listenerMgr:      listenerMgr,
+		registered:       make(map[string]map[string]*Listener),
 	}
 	go gw.checkOnlineInterval()
 	return gw
 }
 
-func (gw *Gateway) SetAvailableClientIDs(clientIDs []string) {
-	clientIDsMap := make(map[string]struct{})
-	for _, clientID := range clientIDs {
-		clientIDsMap[clientID] = struct{}{}
+func (gw *Gateway) SetClients(clients []*ClientConfig) {
+	clientsMap := make(map[string]*ClientConfig)
+	for _, client := range clients {
+		clientsMap[client.ClientID] = client
 	}
-	gw.clientIDs = clientIDsMap
+
+	gw.clientsMu.Lock()
+	defer gw.clientsMu.Unlock()
+	gw.clients = clientsMap
+}
+
+// PutClient adds or replaces client credential
+// online sessions of the client are not affected
+func (gw *Gateway) PutClient(client *ClientConfig) {
+	gw.clientsMu.Lock()
+	defer gw.clientsMu.Unlock()
+	gw.clients[client.ClientID] = client
+}
+
+func (gw *Gateway) DeleteClient(clientID string) {
+	gw.clientsMu.Lock()
+	defer gw.clientsMu.Unlock()
+	delete(gw.clients, clientID)
 }
 
+func (gw *Gateway) getClient(clientID string) *ClientConfig {
+	gw.clientsMu.Lock()
+	defer gw.clientsMu.Unlock()
+	return gw.clients[clientID]
+}
+
+// ListenAndServe serves tunnels until error or Shutdown
+// ErrGatewayClosed is returned after Shutdown
 func (gw *Gateway) ListenAndServe() error {
 	listener, err := net.Listen("tcp", gw.conf.ListenAddr)
 	if err != nil {
 		return err
 	}
+
+	if gw.conf.TLS != nil {
+		tlsConfig, err := newTLSConfig(gw.conf.TLS)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	defer listener.Close()
+	gw.track(listener, nil)
+
+	if gw.conf.QUIC != nil {
+		quicListener, quicTransport, err := gw.listenQUIC()
+		if err != nil {
+			return err
+		}
+		gw.track(quicListener, quicTransport)
+		go func() {
+			err := gw.serveQUIC(quicListener)
+			if !gw.isClosing() {
+				logs.Error("serve quic fail: %v", err)
+			}
+		}()
+	}
+
+	if gw.conf.KCP != nil {
+		kcpListener, err := gw.listenKCP()
+		if err != nil {
+			return err
+		}
+		// sessions share the socket of kcp listener
+		// new sessions are closed by serve during shutdown
+		gw.track(nil, kcpListener)
+		go func() {
+			err := gw.serveKCP(kcpListener)
+			if !gw.isClosing() {
+				logs.Error("serve kcp fail: %v", err)
+			}
+		}()
+	}
+
+	if gw.conf.WebSocket != nil {
+		wsListener, err := gw.listenWebSocket()
+		if err != nil {
+			return err
+		}
+		gw.track(wsListener, nil)
+		go func() {
+			err := gw.serveWebSocket(wsListener)
+			if !gw.isClosing() {
+				logs.Error("serve websocket fail: %v", err)
+			}
+		}()
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if gw.isClosing() {
+				return ErrGatewayClosed
+			}
 			return err
 		}
 
-		go gw.handleConn(conn)
+		go gw.handleConn(conn, TransportTCP)
 	}
 }
 
-func (gw *Gateway) handleConn(conn net.Conn) {
-	handshakeReq := &common.HandshakeReq{}
-	err := handshakeReq.Decode(conn)
+// track records tunnel listener and transport to close on shutdown
+// they are closed at once if shutdown is in progress
+func (gw *Gateway) track(listener, transport io.Closer) {
+	gw.closeMu.Lock()
+	defer gw.closeMu.Unlock()
+	if listener != nil {
+		if gw.closing {
+			listener.Close()
+		}
+		gw.listeners = append(gw.listeners, listener)
+	}
+	if transport != nil {
+		gw.transports = append(gw.transports, transport)
+	}
+}
+
+func (gw *Gateway) isClosing() bool {
+	gw.closeMu.Lock()
+	defer gw.closeMu.Unlock()
+	return gw.closing
+}
+
+// Shutdown stops accepting tunnels and visitors, sends goaway to clients
+// and waits for streams in progress up to drain_timeout
+func (gw *Gateway) Shutdown() {
+	gw.closeMu.Lock()
+	if gw.closing {
+		gw.closeMu.Unlock()
+		return
+	}
+	gw.closing = true
+	listeners := gw.listeners
+	gw.closeMu.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	// listeners stop accepting before sessions go away
+	drainTimeout := time.Duration(gw.conf.DrainTimeout) * time.Second
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gw.listenerMgr.Shutdown(drainTimeout)
+	}()
+	gw.sessionMgr.Shutdown("gateway shutdown")
+	<-done
+
+	gw.closeMu.Lock()
+	transports := gw.transports
+	gw.closeMu.Unlock()
+	for _, transport := range transports {
+		transport.Close()
+	}
+}
+
+// handleConn serves tunnel over a tcp, tls or kcp connection
+func (gw *Gateway) handleConn(conn net.Conn, transport string) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			logs.Warn("tls handshake from %s fail: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	gw.serve(conn, transport, func(sess *Session) (mux.Session, error) {
+		return mux.Server(conn, sess.Mux, gw.conf.Mux)
+	})
+}
+
+// serve authenticates the client on conn and serves the session
+// newMux creates mux session of the negotiated type after handshake
+func (gw *Gateway) serve(conn net.Conn, transport string, newMux func(*Session) (mux.Session, error)) {
+	if gw.isClosing() {
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	sess, err := gw.handshake(conn, transport)
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && gw.conf.TLS != nil && gw.conf.TLS.VerifyClientID {
+		err = verifyClientCert(conn, sess.ClientID)
+		if err != nil {
+			err = &common.ReplyError{Code: common.CodeAuthFail, Message: err.Error()}
+		}
+	}
+	if err != nil {
+		logs.Warn("handshake from %s fail: %v", conn.RemoteAddr(), err)
+		gw.reply(conn, err)
+		conn.Close()
+		return
+	}
+
+	err = gw.sessionMgr.CheckSession(sess)
 	if err != nil {
-		logs.Error("decode handshake fail: %v", err)
+		logs.Warn("session %s rejected: %v", sess, err)
+		gw.reply(conn, err)
+		conn.Close()
 		return
 	}
 
-	if _, ok := gw.clientIDs[handshakeReq.ClientID]; !ok {
-		logs.Warn("client %s is not configured", handshakeReq.ClientID)
+	err = gw.replyAccepted(conn, sess)
+	if err != nil {
+		logs.Error("reply handshake to %s fail: %v", sess.ClientID, err)
 		conn.Close()
 		return
 	}
 
-	logs.Debug("handshake from %s", handshakeReq.ClientID)
+	logs.Info("handshake from %s, protocol version %d, features %s, mux %s",
+		sess, sess.Version, common.FeatureString(sess.Features), sess.Mux)
+
+	muxSess, err := newMux(sess)
+	if err != nil {
+		logs.Error("create mux for %s fail: %v", sess, err)
+		conn.Close()
+		return
+	}
 
-	_, err = gw.sessionMgr.CreateSession(handshakeReq.ClientID, conn)
+	_, err = gw.sessionMgr.CreateSession(sess, muxSess)
 	if err != nil {
 		logs.Error("create session fail: %v", err)
+		muxSess.Close()
 		return
 	}
+
+	gw.serveControl(sess)
+}
+
+// handshake authenticate client with challenge-response
+// 1. client sends HandshakeReq with its clientID
+// 2. gateway replies Challenge with a random nonce
+// 3. client sends HandshakeAuth with HMAC(secret, clientID:nonce)
+// protocol version and features are negotiated before authentication
+// transport is the tunnel conn belongs to, the client must be allowed to use it
+func (gw *Gateway) handshake(conn net.Conn, transport string) (*Session, error) {
+	handshakeReq := &common.HandshakeReq{}
+	err := handshakeReq.Decode(conn)
+	if err != nil {
+		return nil, fmt.Errorf("decode handshake fail: %v", err)
+	}
+
+	ver, features, err := common.Negotiate(handshakeReq.MinVersion, handshakeReq.Version,
+		handshakeReq.Features, common.SupportedFeatures, gw.requiredFeatures)
+	if err != nil {
+		return nil, err
+	}
+
+	// quic streams are multiplexed by quic itself
+	muxTypes := gw.conf.Mux.Types
+	if transport == TransportQUIC {
+		muxTypes = []string{mux.TypeQUIC}
+	}
+	muxType, err := mux.Negotiate(handshakeReq.Muxes, muxTypes)
+	if err != nil {
+		return nil, &common.ReplyError{
+			Code:    common.CodeProtocolUnsupported,
+			Message: err.Error(),
+		}
+	}
+
+	nonce, err := common.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &common.Challenge{Nonce: nonce}
+	buf, err := challenge.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &common.HandshakeAuth{}
+	err = auth.Decode(conn)
+	if err != nil {
+		return nil, fmt.Errorf("decode auth fail: %v", err)
+	}
+
+	// challenge is sent for unknown client too
+	// so every handshake goes through the same steps
+	client := gw.getClient(handshakeReq.ClientID)
+	if client == nil {
+		return nil, &common.ReplyError{
+			Code:    common.CodeUnknownClient,
+			Message: handshakeReq.ClientID,
+		}
+	}
+
+	if !common.Verify(client.Secret, client.ClientID, nonce, auth.Signature) {
+		return nil, &common.ReplyError{Code: common.CodeAuthFail}
+	}
+
+	if len(client.Transports) > 0 && !contains(client.Transports, transport) {
+		return nil, &common.ReplyError{
+			Code:    common.CodeForbidden,
+			Message: fmt.Sprintf("transport %s is not allowed", transport),
+		}
+	}
+
+	if handshakeReq.Group != "" && !contains(client.Groups, handshakeReq.Group) {
+		return nil, &common.ReplyError{
+			Code:    common.CodeAuthFail,
+			Message: fmt.Sprintf("group %s is not allowed", handshakeReq.Group),
+		}
+	}
+
+	return &Session{
+		ClientID:     client.ClientID,
+		InstanceID:   handshakeReq.InstanceID,
+		Group:        handshakeReq.Group,
+		MaxInstances: client.MaxInstances,
+		RemoteAddr:   conn.RemoteAddr().String(),
+		Version:      ver,
+		Features:     features,
+		Transport:    transport,
+		Mux:          muxType,
+		RTT:          &common.RTTStats{},
+	}, nil
+}
+
+// reply handshake rejected to client
+// *common.ReplyError carries the code
+func (gw *Gateway) reply(conn net.Conn, err error) error {
+	reply := &common.HandshakeReply{
+		Code:    common.CodeInternalError,
+		Message: err.Error(),
+	}
+
+	var replyErr *common.ReplyError
+	if errors.As(err, &replyErr) {
+		reply.Code = replyErr.Code
+		reply.Message = replyErr.Message
+	}
+	return gw.writeReply(conn, reply)
+}
+
+// replyAccepted replies negotiated version and features to client
+func (gw *Gateway) replyAccepted(conn net.Conn, sess *Session) error {
+	reply := &common.HandshakeReply{
+		Code:     common.CodeOK,
+		Version:  sess.Version,
+		Features: sess.Features,
+		Mux:      sess.Mux,
+	}
+	return gw.writeReply(conn, reply)
+}
+
+func (gw *Gateway) writeReply(conn net.Conn, reply *common.HandshakeReply) error {
+	buf, err := reply.Encode()
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// HandleStoreEvent applies record changed in store
+func (gw *Gateway) HandleStoreEvent(ev *StoreEvent) {
+	err := gw.applyStoreEvent(ev)
+	if err != nil {
+		logs.Warn("apply %s %s fail: %v", ev.Kind, ev.ID, err)
+	}
+}
+
+func (gw *Gateway) applyStoreEvent(ev *StoreEvent) error {
+	switch ev.Kind {
+	case StoreKindListener:
+		return gw.applyListener(ev)
+	case StoreKindClient:
+		return gw.applyClient(ev)
+	case StoreKindSSL:
+		return applySSL(ev)
+	case StoreKindOIDCUser:
+		return applyOIDCUser(ev)
+	}
+	return nil
+}
+
+func (gw *Gateway) applyListener(ev *StoreEvent) error {
+	if ev.Value == nil {
+		logs.Info("delete listener %s", ev.ID)
+		gw.listenerMgr.CloseListener(ev.ID)
+		return nil
+	}
+
+	conf, err := decodeListener(ev.Value)
+	if err != nil {
+		return err
+	}
+	return gw.listenerMgr.ApplyListener(conf)
+}
+
+func (gw *Gateway) applyClient(ev *StoreEvent) error {
+	if ev.Value == nil {
+		logs.Info("delete client %s", ev.ID)
+		gw.DeleteClient(ev.ID)
+		return nil
+	}
+
+	conf, err := decodeClient(ev.Value)
+	if err != nil {
+		return err
+	}
+	logs.Info("update/add client %s", conf.ClientID)
+	gw.PutClient(conf)
+	return nil
+}
+
+func applySSL(ev *StoreEvent) error {
+	if ev.Value == nil {
+		// route type of the deleted ssl is unknown, ssl id is uniq in store
+		logs.Info("delete ssl %s", ev.ID)
+		var err error
+		http_route.Range(func(routeType string, route http_route.HTTPRoute) {
+			deleteErr := route.DeleteSSL(ev.ID)
+			if deleteErr != nil {
+				err = fmt.Errorf("route %s: %v", routeType, deleteErr)
+			}
+		})
+		return err
+	}
+
+	conf, err := decodeSSL(ev.Value)
+	if err != nil {
+		return err
+	}
+
+	route := http_route.GetRoute(conf.HTTPRouteType)
+	if route == nil {
+		return fmt.Errorf("route %s is not initialize", conf.HTTPRouteType)
+	}
+	logs.Info("update ssl %s for %v", conf.ID, conf.SNIs)
+	return route.UpdateSSL(conf.ID, conf.Cert, conf.Key, conf.SNIs)
+}
+
+func applyOIDCUser(ev *StoreEvent) error {
+	authID, clientID, username, err := parseOIDCUserID(ev.ID)
+	if err != nil {
+		return err
+	}
+
+	auth := authenticate.GetAuthenticate(authID)
+	if auth == nil {
+		return fmt.Errorf("authenticate %s is not running", authID)
+	}
+
+	if ev.Value == nil {
+		logs.Info("delete oidc user %s", ev.ID)
+		auth.RemoveUser(clientID, username)
+		return nil
+	}
+
+	user, err := decodeOIDCUser(ev.Value)
+	if err != nil {
+		return err
+	}
+	logs.Info("update/add oidc user %s", ev.ID)
+	auth.AddUser(clientID, &user.UserInfo)
+	return nil
 }
 
 func (gw *Gateway) checkOnlineInterval() {
 	tick := time.NewTicker(time.Second * 3)
 	defer tick.Stop()
 	for range tick.C {
-		gw.sessionMgr.Range(func(k string, v *Session) bool {
+		gw.sessionMgr.Range(func(v *Session) bool {
 			if v.Connection.IsClosed() {
-				logs.Info("session %s is offline", v.ClientID)
+				logs.Info("session %s is offline", v)
 				return false
 			}
 
-			logs.Debug("session %s is online", v.ClientID)
+			if v.Features&common.FeatureHeartbeat != 0 {
+				rtt := v.RTT.Get()
+				logs.Debug("session %s is online, rtt %s jitter %s",
+					v, rtt.Smoothed, rtt.Jitter)
+			} else {
+				logs.Debug("session %s is online", v)
+			}
 			return true
 		})
 	}
 }
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package http_route
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"io"
+	"net/http"
+	"time"
+)
+
+var errAdminNotFound = errors.New("not found")
+
+var (
+	// admin api calls are retried on network error or http code 5xx
+	adminRetries       = 3
+	adminRetryInterval = time.Millisecond * 500
+)
+
+// adminClient calls the json admin api of apisix and caddy
+type adminClient struct {
+	// name of the api in logs, eg: apisix
+	name string
+	// address of the api, eg: http://127.0.0.1:9180
+	api string
+	// headers set in every request, eg: X-API-KEY of apisix
+	header map[string]string
+}
+
+func newAdminClient(name, api string, header map[string]string) *adminClient {
+	return &adminClient{
+		name:   name,
+		api:    api,
+		header: header,
+	}
+}
+
+// request returns the reply content of path
+// it is retried with backoff on network error or http code 5xx
+// errAdminNotFound is returned for http code 404
+func (c *adminClient) request(method, path string, reqForm interface{}) ([]byte, error) {
+	var body []byte
+	if reqForm != nil {
+		var err error
+		body, err = json.Marshal(reqForm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	interval := adminRetryInterval
+	for i := 1; ; i++ {
+		content, retry, err := c.requestOnce(method, c.api+path, body)
+		if err == nil || !retry || i >= adminRetries {
+			return content, err
+		}
+
+		logs.Warn("%s %s %s fail: %v, retry after %s", c.name, method, path, err, interval)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// requestOnce returns whether the request may succeed if retried
+func (c *adminClient) requestOnce(method, url string, body []byte) ([]byte, bool, error) {
+	cli := &http.Client{
+		Timeout: time.Second * 5,
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, errAdminNotFound
+	}
+
+	if resp.StatusCode != http.StatusCreated &&
+		resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= http.StatusInternalServerError,
+			fmt.Errorf("invalid http code %d msg %s", resp.StatusCode, string(content))
+	}
+	return content, false, nil
+}
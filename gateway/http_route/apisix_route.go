@@ -1,23 +1,57 @@
 package http_route
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"github.com/astaxie/beego/logs"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
-var _ HTTPRoute = &ApisixRouter{}
+var (
+	_ HTTPRoute = &ApisixRouter{}
+	_ Service   = &ApisixRouter{}
+)
+
+// objects created by gateway are labeled, so objects created by others,
+// eg: through apisix dashboard, are never touched
+// the owner label tells gateways sharing an apisix apart
+const (
+	apisixLabelKey   = "managed_by"
+	apisixLabelValue = "zta"
+	apisixOwnerKey   = "zta_owner"
+)
 
 type ApisixConfig struct {
 	Api string `json:"api"`
 	Key string `json:"key"`
+	// value of owner label, default hostname
+	// gateways sharing an apisix must have different owners
+	Owner string `json:"owner"`
+	// seconds between reconciliations, default 60, negative disables
+	ReconcileInterval int `json:"reconcile_interval"`
 }
 
+// ApisixRouter keeps routes, upstreams and ssls applied by gateway
+// and reconciles them with apisix periodically
+// an inline upstream of route is created as upstream of the route id
 type ApisixRouter struct {
-	conf *ApisixConfig
+	conf  *ApisixConfig
+	admin *adminClient
+
+	// objects applied by gateway, id -> object
+	// mu also serializes the changes made to apisix
+	mu        sync.Mutex
+	routes    map[string]map[string]interface{}
+	upstreams map[string]map[string]interface{}
+	ssls      map[string]map[string]interface{}
+
+	closeOnce sync.Once
+	close     chan struct{}
 }
 
 func NewApisixRoute(conf json.RawMessage) (*ApisixRouter, error) {
@@ -26,60 +60,385 @@ func NewApisixRoute(conf json.RawMessage) (*ApisixRouter, error) {
 	if err != nil {
 		return nil, err
 	}
+	if apisixConf.ReconcileInterval == 0 {
+		apisixConf.ReconcileInterval = 60
+	}
+	if apisixConf.Owner == "" {
+		apisixConf.Owner, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("get hostname as owner fail: %v", err)
+		}
+	}
+
+	return &ApisixRouter{
+		conf:      &apisixConf,
+		admin:     newAdminClient("apisix", apisixConf.Api, map[string]string{"X-API-KEY": apisixConf.Key}),
+		routes:    make(map[string]map[string]interface{}),
+		upstreams: make(map[string]map[string]interface{}),
+		ssls:      make(map[string]map[string]interface{}),
+		close:     make(chan struct{}),
+	}, nil
+}
+
+// Start runs reconciler in background
+func (apisix *ApisixRouter) Start() error {
+	if apisix.conf.ReconcileInterval > 0 {
+		go apisix.reconcileInterval(time.Second * time.Duration(apisix.conf.ReconcileInterval))
+	}
+	return nil
+}
 
-	return &ApisixRouter{conf: &apisixConf}, nil
+func (apisix *ApisixRouter) Close() error {
+	apisix.closeOnce.Do(func() {
+		close(apisix.close)
+	})
+	return nil
 }
 
 func (apisix *ApisixRouter) UpdateSSL(id, cert, key string, snis []string) error {
-	reqForm := map[string]interface{}{
+	reqForm, err := apisix.object(map[string]interface{}{
 		"cert": cert,
 		"key":  key,
-		"snis": snis,
+		"snis": lowerSNIs(snis),
+	})
+	if err != nil {
+		return err
 	}
-	url := fmt.Sprintf("%s/apisix/admin/ssls/%s", apisix.conf.Api, id)
-	err := apisix.doReq("PUT", url, reqForm)
+
+	apisix.mu.Lock()
+	defer apisix.mu.Unlock()
+	err = apisix.put("ssls", id, reqForm)
 	if err != nil {
 		return fmt.Errorf("create ssl fail: %v", err)
 	}
+	apisix.ssls[id] = reqForm
 	return nil
 }
 
 func (apisix *ApisixRouter) UpdateRoute(param map[string]interface{}) error {
-	url := fmt.Sprintf("%s/apisix/admin/routes", apisix.conf.Api)
-	return apisix.doReq("PUT", url, param)
+	id, _ := param["id"].(string)
+	if id == "" {
+		return fmt.Errorf("route id is required")
+	}
+
+	route, err := apisix.object(param)
+	if err != nil {
+		return err
+	}
+
+	var upstream map[string]interface{}
+	if inline, ok := route["upstream"].(map[string]interface{}); ok {
+		upstream, err = apisix.object(inline)
+		if err != nil {
+			return err
+		}
+		upstream["id"] = id
+		delete(route, "upstream")
+		route["upstream_id"] = id
+	}
+
+	apisix.mu.Lock()
+	defer apisix.mu.Unlock()
+	if upstream != nil {
+		err = apisix.put("upstreams", id, upstream)
+		if err != nil {
+			return fmt.Errorf("create upstream fail: %v", err)
+		}
+		apisix.upstreams[id] = upstream
+	}
+
+	err = apisix.put("routes", id, route)
+	if err != nil {
+		return fmt.Errorf("create route fail: %v", err)
+	}
+	apisix.routes[id] = route
+	return nil
 }
 
-func (apisix *ApisixRouter) doReq(method, url string, reqForm interface{}) error {
-	cli := &http.Client{
-		Timeout: time.Second * 5,
+func (apisix *ApisixRouter) DeleteRoute(id string) error {
+	apisix.mu.Lock()
+	defer apisix.mu.Unlock()
+	delete(apisix.routes, id)
+	err := apisix.delete("routes", id)
+	if err != nil {
+		return fmt.Errorf("delete route fail: %v", err)
 	}
 
-	body, err := json.Marshal(reqForm)
+	// upstream is deleted after the route referencing it
+	if _, ok := apisix.upstreams[id]; ok {
+		delete(apisix.upstreams, id)
+		err = apisix.delete("upstreams", id)
+		if err != nil {
+			return fmt.Errorf("delete upstream fail: %v", err)
+		}
+	}
+	return nil
+}
+
+func (apisix *ApisixRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	return apisix.list("routes")
+}
+
+func (apisix *ApisixRouter) DeleteSSL(id string) error {
+	apisix.mu.Lock()
+	defer apisix.mu.Unlock()
+	delete(apisix.ssls, id)
+	err := apisix.delete("ssls", id)
 	if err != nil {
-		return err
+		return fmt.Errorf("delete ssl fail: %v", err)
 	}
+	return nil
+}
+
+func (apisix *ApisixRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	return apisix.list("ssls")
+}
+
+func (apisix *ApisixRouter) reconcileInterval(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-apisix.close:
+			return
+		case <-tick.C:
+		}
+
+		err := apisix.Reconcile()
+		if err != nil {
+			logs.Error("apisix reconcile fail: %v", err)
+		}
+	}
+}
+
+// apisixKinds are reconciled in order
+// upstreams are created before routes, and deleted after routes
+var apisixKinds = []string{"upstreams", "routes", "ssls"}
+
+// apisixDrift is an object differs from the one applied by gateway
+type apisixDrift struct {
+	kind string
+	id   string
+	// missing, modified or orphaned
+	reason string
+}
+
+func (d *apisixDrift) String() string {
+	return fmt.Sprintf("%s %s %s", strings.TrimSuffix(d.kind, "s"), d.id, d.reason)
+}
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+// Reconcile compares objects in apisix with the ones applied by gateway
+// missing and modified objects are applied again
+// orphaned objects labeled with owner of gateway are deleted
+func (apisix *ApisixRouter) Reconcile() error {
+	actual := make(map[string]map[string]map[string]interface{})
+	for _, kind := range apisixKinds {
+		objects, err := apisix.list(kind)
+		if err != nil {
+			return fmt.Errorf("list %s fail: %v", kind, err)
+		}
+		actual[kind] = objects
+	}
+
+	apisix.mu.Lock()
+	defer apisix.mu.Unlock()
+
+	drifts := make([]*apisixDrift, 0)
+	for _, kind := range apisixKinds {
+		for id, object := range apisix.desired(kind) {
+			current, ok := actual[kind][id]
+			if !ok {
+				drifts = append(drifts, &apisixDrift{kind, id, "missing"})
+				continue
+			}
+			if !jsonContains(current, apisixComparable(kind, object)) {
+				drifts = append(drifts, &apisixDrift{kind, id, "modified"})
+			}
+		}
+	}
+
+	// routes are deleted before upstreams referenced by them
+	for i := len(apisixKinds) - 1; i >= 0; i-- {
+		kind := apisixKinds[i]
+		for id, object := range actual[kind] {
+			if _, ok := apisix.desired(kind)[id]; ok || !apisix.owned(object) {
+				continue
+			}
+			drifts = append(drifts, &apisixDrift{kind, id, "orphaned"})
+		}
+	}
+
+	if len(drifts) == 0 {
+		logs.Debug("apisix has no drift")
+		return nil
+	}
+
+	report := make([]string, 0, len(drifts))
+	for _, drift := range drifts {
+		report = append(report, drift.String())
+	}
+	logs.Warn("apisix drift: %s", strings.Join(report, ", "))
+
+	failed := 0
+	for _, drift := range drifts {
+		var err error
+		if drift.reason == "orphaned" {
+			err = apisix.delete(drift.kind, drift.id)
+		} else {
+			err = apisix.put(drift.kind, drift.id, apisix.desired(drift.kind)[drift.id])
+		}
+		if err != nil {
+			logs.Error("apisix fix %s fail: %v", drift, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d drifts are not fixed", failed, len(drifts))
+	}
+	logs.Info("apisix %d drifts are fixed", len(drifts))
+	return nil
+}
+
+// desired returns objects of kind applied by gateway
+func (apisix *ApisixRouter) desired(kind string) map[string]map[string]interface{} {
+	switch kind {
+	case "routes":
+		return apisix.routes
+	case "upstreams":
+		return apisix.upstreams
+	default:
+		return apisix.ssls
+	}
+}
+
+// object returns a copy of object labeled by gateway
+// the copy is normalized by json, so it is comparable with the one listed
+func (apisix *ApisixRouter) object(object map[string]interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(object)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Header.Set("X-API-KEY", apisix.conf.Key)
 
-	resp, err := cli.Do(req)
+	result := make(map[string]interface{})
+	err = json.Unmarshal(buf, &result)
 	if err != nil {
+		return nil, err
+	}
+
+	labels, _ := result["labels"].(map[string]interface{})
+	if labels == nil {
+		labels = make(map[string]interface{})
+	}
+	labels[apisixLabelKey] = apisixLabelValue
+	labels[apisixOwnerKey] = apisix.conf.Owner
+	result["labels"] = labels
+	return result, nil
+}
+
+// apisixComparable returns fields of object which apisix replies as is
+// key of ssl may be encrypted by apisix
+func apisixComparable(kind string, object map[string]interface{}) map[string]interface{} {
+	if kind != "ssls" {
+		return object
+	}
+	result := make(map[string]interface{})
+	for k, v := range object {
+		if k != "key" {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// owned reports whether object is labeled by this gateway
+// objects of other gateways sharing the apisix are not owned
+func (apisix *ApisixRouter) owned(object map[string]interface{}) bool {
+	labels, _ := object["labels"].(map[string]interface{})
+	return labels[apisixLabelKey] == apisixLabelValue &&
+		labels[apisixOwnerKey] == apisix.conf.Owner
+}
+
+// jsonContains reports whether actual has all fields of expected
+// fields filled by the server, eg: create_time of apisix, are ignored
+func jsonContains(actual, expected interface{}) bool {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range e {
+			if !jsonContains(a[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for i := range e {
+			if !jsonContains(a[i], e[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(actual, expected)
+	}
+}
+
+func (apisix *ApisixRouter) put(kind, id string, object map[string]interface{}) error {
+	_, err := apisix.admin.request("PUT", fmt.Sprintf("/apisix/admin/%s/%s", kind, id), object)
+	return err
+}
+
+// delete deletes object of kind, deleting object not found is not an error
+func (apisix *ApisixRouter) delete(kind, id string) error {
+	_, err := apisix.admin.request("DELETE", fmt.Sprintf("/apisix/admin/%s/%s", kind, id), nil)
+	if err != nil && err != errAdminNotFound {
 		return err
 	}
-	defer resp.Body.Close()
+	return nil
+}
+
+// apisixNode is an object in list reply
+type apisixNode struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
 
-	content, err := io.ReadAll(resp.Body)
+// list returns objects of kind, id -> object
+// apisix v3 replies {"list": [...]}, v2 replies {"node": {"nodes": [...]}}
+func (apisix *ApisixRouter) list(kind string) (map[string]map[string]interface{}, error) {
+	content, err := apisix.admin.request("GET", "/apisix/admin/"+kind, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusCreated &&
-		resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid http code %d msg %s",
-			resp.StatusCode, string(content))
+	var reply struct {
+		List []*apisixNode `json:"list"`
+		Node struct {
+			Nodes []*apisixNode `json:"nodes"`
+		} `json:"node"`
 	}
-	return nil
+	err = json.Unmarshal(content, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := append(reply.List, reply.Node.Nodes...)
+	objects := make(map[string]map[string]interface{})
+	for _, node := range nodes {
+		if node.Value == nil {
+			continue
+		}
+		id, _ := node.Value["id"].(string)
+		if id == "" {
+			id = path.Base(node.Key)
+		}
+		objects[id] = node.Value
+	}
+	return objects, nil
 }
@@ -0,0 +1,136 @@
+package http_route
+
+import (
+	"encoding/json"
+	"github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockApisix keeps objects of admin api in memory, kind -> id -> object
+type mockApisix struct {
+	mu      sync.Mutex
+	objects map[string]map[string]map[string]interface{}
+	// replies 503 for the next failures requests
+	failures int
+}
+
+func (m *mockApisix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/apisix/admin/"), "/")
+	kind := fields[0]
+	if m.objects[kind] == nil {
+		m.objects[kind] = make(map[string]map[string]interface{})
+	}
+
+	switch r.Method {
+	case "GET":
+		list := make([]map[string]interface{}, 0)
+		for id, object := range m.objects[kind] {
+			list = append(list, map[string]interface{}{
+				"key":   "/apisix/" + kind + "/" + id,
+				"value": object,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"list": list})
+	case "PUT":
+		object := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&object)
+		object["create_time"] = float64(time.Now().Unix())
+		m.objects[kind][fields[1]] = object
+	case "DELETE":
+		if _, ok := m.objects[kind][fields[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(m.objects[kind], fields[1])
+	}
+}
+
+func (m *mockApisix) get(kind, id string) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.objects[kind][id]
+}
+
+func TestApisixRouter(t *testing.T) {
+	convey.Convey("test apisix router", t, func() {
+		adminRetryInterval = time.Millisecond
+		mock := &mockApisix{objects: make(map[string]map[string]map[string]interface{})}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		router, err := NewApisixRoute(json.RawMessage(`{"api": "` + srv.URL + `", "owner": "gw1"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		// failed request is retried
+		mock.failures = 1
+		err = router.UpdateRoute(map[string]interface{}{
+			"id":    "r1",
+			"uri":   "/*",
+			"hosts": []string{"a.example.com"},
+			"upstream": map[string]interface{}{
+				"type":  "roundrobin",
+				"nodes": map[string]interface{}{"127.0.0.1:10000": 1},
+			},
+		})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(router.UpdateSSL("s1", "cert", "key", []string{"a.example.com"}), convey.ShouldBeNil)
+
+		route := mock.get("routes", "r1")
+		convey.So(route["upstream_id"], convey.ShouldEqual, "r1")
+		convey.So(route["upstream"], convey.ShouldBeNil)
+		convey.So(router.owned(route), convey.ShouldBeTrue)
+		convey.So(router.owned(mock.get("upstreams", "r1")), convey.ShouldBeTrue)
+
+		convey.So(router.Reconcile(), convey.ShouldBeNil)
+
+		// changed through dashboard
+		mock.mu.Lock()
+		delete(mock.objects["routes"], "r1")
+		mock.objects["upstreams"]["r1"]["nodes"] = map[string]interface{}{"127.0.0.1:20000": 1}
+		mock.objects["ssls"]["s2"] = map[string]interface{}{
+			"id":     "s2",
+			"labels": map[string]interface{}{apisixLabelKey: apisixLabelValue, apisixOwnerKey: "gw1"},
+		}
+		// created by another gateway sharing the apisix
+		mock.objects["ssls"]["s3"] = map[string]interface{}{
+			"id":     "s3",
+			"labels": map[string]interface{}{apisixLabelKey: apisixLabelValue, apisixOwnerKey: "gw2"},
+		}
+		mock.objects["routes"]["legacy"] = map[string]interface{}{
+			"id":     "legacy",
+			"labels": map[string]interface{}{apisixLabelKey: apisixLabelValue},
+		}
+		mock.objects["routes"]["other"] = map[string]interface{}{"id": "other"}
+		mock.mu.Unlock()
+
+		convey.So(router.Reconcile(), convey.ShouldBeNil)
+		convey.So(mock.get("routes", "r1"), convey.ShouldNotBeNil)
+		nodes := mock.get("upstreams", "r1")["nodes"].(map[string]interface{})
+		convey.So(nodes["127.0.0.1:10000"], convey.ShouldEqual, 1)
+		convey.So(mock.get("ssls", "s2"), convey.ShouldBeNil)
+		// owned by others
+		convey.So(mock.get("ssls", "s3"), convey.ShouldNotBeNil)
+		convey.So(mock.get("routes", "legacy"), convey.ShouldNotBeNil)
+		// not created by gateway
+		convey.So(mock.get("routes", "other"), convey.ShouldNotBeNil)
+
+		convey.So(router.DeleteRoute("r1"), convey.ShouldBeNil)
+		convey.So(mock.get("routes", "r1"), convey.ShouldBeNil)
+		convey.So(mock.get("upstreams", "r1"), convey.ShouldBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+	})
+}
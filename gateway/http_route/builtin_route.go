@@ -0,0 +1,376 @@
+package http_route
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ HTTPRoute   = &BuiltinRouter{}
+	_ Service     = &BuiltinRouter{}
+	_ StreamRoute = &BuiltinRouter{}
+	_ Reloadable  = &BuiltinRouter{}
+)
+
+var builtinReadHeaderTimeout = time.Second * 10
+
+type BuiltinConfig struct {
+	// http listen address, eg: ":80", empty disables http
+	HTTPAddr string `json:"http_addr"`
+	// https listen address, eg: ":443", empty disables https
+	HTTPSAddr string `json:"https_addr"`
+}
+
+// builtinRule routes requests of hosts and path into streams of dial
+type builtinRule struct {
+	*routeMatch
+	param map[string]interface{}
+	dial  DialFunc
+}
+
+type builtinSSL struct {
+	snis []string
+	cert *tls.Certificate
+}
+
+// BuiltinRouter is an in-process reverse proxy shared by http listeners
+// requests are routed by host and path into tunnel streams,
+// https is terminated with certificates of ssl, selected by sni
+// rules are compatible with apisix route, eg: {"id", "uri": "/*", "hosts"}
+type BuiltinRouter struct {
+	mu    sync.RWMutex
+	rules map[string]*builtinRule
+	ssls  map[string]*builtinSSL
+	proxy *httputil.ReverseProxy
+
+	serversMu   sync.Mutex
+	conf        *BuiltinConfig
+	httpServer  *http.Server
+	httpsServer *http.Server
+}
+
+// builtinTarget is passed to the dialer of proxy by request context
+type builtinTarget struct {
+	rule        *builtinRule
+	visitorAddr string
+}
+
+type builtinTargetKey struct{}
+
+func NewBuiltinRoute(conf json.RawMessage) (*BuiltinRouter, error) {
+	builtinConf, err := parseBuiltinConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &BuiltinRouter{
+		conf:  builtinConf,
+		rules: make(map[string]*builtinRule),
+		ssls:  make(map[string]*builtinSSL),
+	}
+	r.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				target := ctx.Value(builtinTargetKey{}).(*builtinTarget)
+				return target.rule.dial(target.visitorAddr)
+			},
+			// one stream per request, so a deleted listener is not kept
+			// by idle connections
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			target := req.Context().Value(builtinTargetKey{}).(*builtinTarget)
+			logs.Warn("builtin route %s proxy %s%s for %s fail: %v",
+				target.rule.id, req.Host, req.URL.Path, req.RemoteAddr, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return r, nil
+}
+
+func parseBuiltinConfig(conf json.RawMessage) (*BuiltinConfig, error) {
+	builtinConf := &BuiltinConfig{}
+	err := json.Unmarshal(conf, builtinConf)
+	if err != nil {
+		return nil, err
+	}
+	if builtinConf.HTTPAddr == "" && builtinConf.HTTPSAddr == "" {
+		return nil, fmt.Errorf("http_addr or https_addr is required")
+	}
+	return builtinConf, nil
+}
+
+// Start listens http_addr and https_addr
+func (r *BuiltinRouter) Start() error {
+	r.serversMu.Lock()
+	defer r.serversMu.Unlock()
+	return r.serve(r.conf)
+}
+
+func (r *BuiltinRouter) Close() error {
+	r.serversMu.Lock()
+	defer r.serversMu.Unlock()
+	for _, srv := range []*http.Server{r.httpServer, r.httpsServer} {
+		if srv != nil {
+			srv.Close()
+		}
+	}
+	r.httpServer, r.httpsServer = nil, nil
+	return nil
+}
+
+// Reload applies conf in place, servers of unchanged address keep serving
+func (r *BuiltinRouter) Reload(conf json.RawMessage) error {
+	builtinConf, err := parseBuiltinConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	r.serversMu.Lock()
+	defer r.serversMu.Unlock()
+	return r.serve(builtinConf)
+}
+
+// serve starts servers of conf whose address changed, then closes the replaced ones
+// nothing is changed if any server fails to listen
+func (r *BuiltinRouter) serve(conf *BuiltinConfig) error {
+	// http and https
+	running := []*http.Server{r.httpServer, r.httpsServer}
+	addrs := []string{conf.HTTPAddr, conf.HTTPSAddr}
+	servers := make([]*http.Server, len(running))
+	for i, addr := range addrs {
+		if running[i] != nil && running[i].Addr == addr {
+			servers[i] = running[i]
+			continue
+		}
+		if addr == "" {
+			continue
+		}
+
+		var tlsConfig *tls.Config
+		if i == 1 {
+			tlsConfig = &tls.Config{GetCertificate: r.getCertificate}
+		}
+		srv, err := r.listen(addr, tlsConfig)
+		if err != nil {
+			for j := range servers {
+				if servers[j] != nil && servers[j] != running[j] {
+					servers[j].Close()
+				}
+			}
+			return err
+		}
+		servers[i] = srv
+	}
+
+	for i := range running {
+		if running[i] != nil && running[i] != servers[i] {
+			running[i].Close()
+		}
+	}
+	r.conf = conf
+	r.httpServer, r.httpsServer = servers[0], servers[1]
+	return nil
+}
+
+// listen serves addr in background, https if tlsConfig is not nil
+func (r *BuiltinRouter) listen(addr string, tlsConfig *tls.Config) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           r,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: builtinReadHeaderTimeout,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			logs.Error("builtin route serve %s fail: %v", addr, err)
+		}
+	}()
+	logs.Info("builtin route listen %s", addr)
+	return srv, nil
+}
+
+func (r *BuiltinRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rule := r.match(req.Host, req.URL.Path)
+	if rule == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	target := &builtinTarget{rule: rule, visitorAddr: req.RemoteAddr}
+	ctx := context.WithValue(req.Context(), builtinTargetKey{}, target)
+	r.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// match returns the rule of host and path
+// exact host is preferred to wildcard host, then the longest path
+func (r *BuiltinRouter) match(host, path string) *builtinRule {
+	host = hostname(host)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var best *builtinRule
+	bestHost := -1
+	for _, rule := range r.rules {
+		hostScore := -1
+		if len(rule.hosts) == 0 {
+			hostScore = 0
+		}
+		for _, pattern := range rule.hosts {
+			if pattern == host {
+				hostScore = 2
+				break
+			}
+			if wildcardMatch(pattern, host) {
+				hostScore = 1
+			}
+		}
+		if hostScore < 0 {
+			continue
+		}
+
+		if rule.prefix && !strings.HasPrefix(path, rule.path) ||
+			!rule.prefix && path != rule.path {
+			continue
+		}
+
+		if best == nil || hostScore > bestHost ||
+			hostScore == bestHost && builtinPathLonger(rule, best) {
+			best, bestHost = rule, hostScore
+		}
+	}
+	return best
+}
+
+// builtinPathLonger reports whether path of a is more specific than b
+func builtinPathLonger(a, b *builtinRule) bool {
+	if len(a.path) != len(b.path) {
+		return len(a.path) > len(b.path)
+	}
+	return !a.prefix && b.prefix
+}
+
+// getCertificate selects certificate by sni, exact sni is preferred to wildcard
+func (r *BuiltinRouter) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sni := hostname(hello.ServerName)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var wildcard *tls.Certificate
+	for _, ssl := range r.ssls {
+		for _, pattern := range ssl.snis {
+			if pattern == sni {
+				return ssl.cert, nil
+			}
+			if wildcard == nil && wildcardMatch(pattern, sni) {
+				wildcard = ssl.cert
+			}
+		}
+	}
+	if wildcard == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return wildcard, nil
+}
+
+func (r *BuiltinRouter) UpdateSSL(id, cert, key string, snis []string) error {
+	certificate, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return fmt.Errorf("ssl %s: %v", id, err)
+	}
+
+	ssl := &builtinSSL{cert: &certificate, snis: lowerSNIs(snis)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ssls[id] = ssl
+	return nil
+}
+
+func (r *BuiltinRouter) DeleteSSL(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ssls, id)
+	return nil
+}
+
+func (r *BuiltinRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ssls := make(map[string]map[string]interface{})
+	for id, ssl := range r.ssls {
+		ssls[id] = map[string]interface{}{
+			"id":   id,
+			"snis": ssl.snis,
+		}
+	}
+	return ssls, nil
+}
+
+// UpdateRoute is not supported, requests are proxied into tunnel streams only
+func (r *BuiltinRouter) UpdateRoute(param map[string]interface{}) error {
+	return fmt.Errorf("builtin route requires a tunnel stream")
+}
+
+// UpdateStreamRoute adds or replaces rule of param["id"], see parseRouteMatch
+// a rule of the same hosts and uri as another one is rejected
+func (r *BuiltinRouter) UpdateStreamRoute(param map[string]interface{}, dial DialFunc) error {
+	match, err := parseRouteMatch(param)
+	if err != nil {
+		return err
+	}
+	rule := &builtinRule{routeMatch: match, param: param, dial: dial}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, other := range r.rules {
+		if id != rule.id && rule.conflicts(other.routeMatch) {
+			return fmt.Errorf("route %s conflicts with route %s", rule.id, id)
+		}
+	}
+	r.rules[rule.id] = rule
+	return nil
+}
+
+func (r *BuiltinRouter) DeleteRoute(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rules, id)
+	return nil
+}
+
+func (r *BuiltinRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make(map[string]map[string]interface{})
+	for id, rule := range r.rules {
+		routes[id] = rule.param
+	}
+	return routes, nil
+}
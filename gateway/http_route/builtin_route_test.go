@@ -0,0 +1,136 @@
+package http_route
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// backendDial dials the backend instead of a tunnel stream
+func backendDial(backend *httptest.Server) DialFunc {
+	return func(visitorAddr string) (net.Conn, error) {
+		return net.Dial("tcp", backend.Listener.Addr().String())
+	}
+}
+
+func newBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.Host+r.URL.Path)
+	}))
+}
+
+func selfSignedCert(host string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(keyPem)
+}
+
+func TestBuiltinRouter(t *testing.T) {
+	convey.Convey("test builtin router", t, func() {
+		_, err := NewBuiltinRoute(json.RawMessage(`{}`))
+		convey.So(err, convey.ShouldNotBeNil)
+
+		router, err := NewBuiltinRoute(json.RawMessage(`{"http_addr": "127.0.0.1:0"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		web, api := newBackend("web"), newBackend("api")
+		defer web.Close()
+		defer api.Close()
+
+		convey.So(router.UpdateRoute(map[string]interface{}{"id": "r1"}), convey.ShouldNotBeNil)
+		err = router.UpdateStreamRoute(map[string]interface{}{
+			"id":    "web",
+			"uri":   "/*",
+			"hosts": []string{"a.example.com"},
+		}, backendDial(web))
+		convey.So(err, convey.ShouldBeNil)
+		err = router.UpdateStreamRoute(map[string]interface{}{
+			"id":    "api",
+			"uri":   "/api/*",
+			"hosts": []interface{}{"*.example.com"},
+		}, backendDial(api))
+		convey.So(err, convey.ShouldBeNil)
+
+		// same hosts and uri
+		err = router.UpdateStreamRoute(map[string]interface{}{
+			"id":   "web2",
+			"uri":  "/*",
+			"host": "A.example.com",
+		}, backendDial(web))
+		convey.So(err, convey.ShouldNotBeNil)
+
+		get := func(host, path string) (int, string) {
+			req := httptest.NewRequest("GET", "http://"+host+path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code, w.Body.String()
+		}
+
+		code, body := get("a.example.com:80", "/index.html")
+		convey.So(code, convey.ShouldEqual, http.StatusOK)
+		convey.So(body, convey.ShouldEqual, "web a.example.com:80/index.html")
+
+		// exact host is preferred to wildcard host
+		_, body = get("a.example.com", "/api/users")
+		convey.So(body, convey.ShouldEqual, "web a.example.com/api/users")
+		_, body = get("b.example.com", "/api/users")
+		convey.So(body, convey.ShouldEqual, "api b.example.com/api/users")
+
+		code, _ = get("b.example.com", "/index.html")
+		convey.So(code, convey.ShouldEqual, http.StatusNotFound)
+		code, _ = get("example.com", "/api/users")
+		convey.So(code, convey.ShouldEqual, http.StatusNotFound)
+
+		convey.So(router.DeleteRoute("web"), convey.ShouldBeNil)
+		code, _ = get("a.example.com", "/index.html")
+		convey.So(code, convey.ShouldEqual, http.StatusNotFound)
+		routes, err := router.ListRoutes()
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(len(routes), convey.ShouldEqual, 1)
+
+		// certificate is selected by sni
+		cert, key := selfSignedCert("*.example.com")
+		convey.So(router.UpdateSSL("s1", cert, key, []string{"*.example.com"}), convey.ShouldBeNil)
+		convey.So(router.UpdateSSL("s2", "cert", "key", nil), convey.ShouldNotBeNil)
+		_, err = router.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+		convey.So(err, convey.ShouldBeNil)
+		_, err = router.getCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+		convey.So(err, convey.ShouldNotBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		_, err = router.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+		convey.So(err, convey.ShouldNotBeNil)
+
+		// servers of unchanged address are kept on reload
+		convey.So(router.Start(), convey.ShouldBeNil)
+		defer router.Close()
+		httpServer := router.httpServer
+		convey.So(router.Reload(json.RawMessage(`{"http_addr": "127.0.0.1:0"}`)), convey.ShouldBeNil)
+		convey.So(router.httpServer, convey.ShouldEqual, httpServer)
+		convey.So(router.Reload(json.RawMessage(`{"https_addr": "127.0.0.1:0"}`)), convey.ShouldBeNil)
+		convey.So(router.httpServer, convey.ShouldBeNil)
+		convey.So(router.httpsServer, convey.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,522 @@
+package http_route
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ HTTPRoute = &CaddyRouter{}
+	_ Service   = &CaddyRouter{}
+)
+
+type CaddyConfig struct {
+	// caddy admin api, default http://127.0.0.1:2019
+	Api string `json:"api"`
+	// name of the http servers created in caddy, default zta
+	// http server is named server, https server is named server_tls
+	Server string `json:"server"`
+	// default [":80"] and [":443"], empty disables the server
+	HTTPListen  []string `json:"http_listen"`
+	HTTPSListen []string `json:"https_listen"`
+	// obtain certificates by caddy for hosts without certificate of ssl
+	AutoHTTPS bool `json:"auto_https"`
+	// seconds between reconciliations, default 60, negative disables
+	ReconcileInterval int `json:"reconcile_interval"`
+}
+
+// caddyRoute is the route param, compatible with apisix route
+// eg: {"id", "uri": "/*", "hosts", "upstream": {"type", "nodes": {"127.0.0.1:10002": 1}}}
+type caddyRoute struct {
+	*routeMatch
+	param    map[string]interface{}
+	upstream *routeUpstream
+}
+
+type caddySSL struct {
+	cert string
+	key  string
+	snis []string
+}
+
+// CaddyRouter drives the json admin api of caddy like ApisixRouter
+// routes are kept in the http servers of gateway, which are replaced on change
+// certificates are loaded into tls app with @id, so certificates of others are never touched
+// caddy config is reconciled periodically, eg: caddy restarted without --resume
+type CaddyRouter struct {
+	conf  *CaddyConfig
+	admin *adminClient
+
+	// routes and ssls applied by gateway, id -> route or ssl
+	// mu also serializes the changes made to caddy
+	mu     sync.Mutex
+	routes map[string]*caddyRoute
+	ssls   map[string]*caddySSL
+
+	closeOnce sync.Once
+	close     chan struct{}
+}
+
+func NewCaddyRoute(conf json.RawMessage) (*CaddyRouter, error) {
+	caddyConf := &CaddyConfig{}
+	err := json.Unmarshal(conf, caddyConf)
+	if err != nil {
+		return nil, err
+	}
+	if caddyConf.Api == "" {
+		caddyConf.Api = "http://127.0.0.1:2019"
+	}
+	if caddyConf.Server == "" {
+		caddyConf.Server = "zta"
+	}
+	if caddyConf.HTTPListen == nil {
+		caddyConf.HTTPListen = []string{":80"}
+	}
+	if caddyConf.HTTPSListen == nil {
+		caddyConf.HTTPSListen = []string{":443"}
+	}
+	if caddyConf.ReconcileInterval == 0 {
+		caddyConf.ReconcileInterval = 60
+	}
+
+	return &CaddyRouter{
+		conf:   caddyConf,
+		admin:  newAdminClient("caddy", caddyConf.Api, nil),
+		routes: make(map[string]*caddyRoute),
+		ssls:   make(map[string]*caddySSL),
+		close:  make(chan struct{}),
+	}, nil
+}
+
+// Start runs reconciler in background
+func (c *CaddyRouter) Start() error {
+	if c.conf.ReconcileInterval > 0 {
+		go c.reconcileInterval(time.Second * time.Duration(c.conf.ReconcileInterval))
+	}
+	return nil
+}
+
+func (c *CaddyRouter) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.close)
+	})
+	return nil
+}
+
+func (c *CaddyRouter) UpdateSSL(id, cert, key string, snis []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ssl := &caddySSL{cert: cert, key: key, snis: lowerSNIs(snis)}
+	err := c.putSSL(id, ssl)
+	if err != nil {
+		return fmt.Errorf("load caddy certificate fail: %v", err)
+	}
+
+	old, ok := c.ssls[id]
+	c.ssls[id] = ssl
+	err = c.putServers()
+	if err != nil {
+		// certificate loaded in caddy is rolled back too
+		var rollbackErr error
+		if ok {
+			c.ssls[id] = old
+			rollbackErr = c.putSSL(id, old)
+		} else {
+			delete(c.ssls, id)
+			_, rollbackErr = c.admin.request("DELETE", "/id/"+caddySSLID(id), nil)
+			if rollbackErr == errAdminNotFound {
+				rollbackErr = nil
+			}
+		}
+		if rollbackErr != nil {
+			logs.Error("rollback caddy certificate %s fail: %v", id, rollbackErr)
+		}
+		return fmt.Errorf("update caddy server fail: %v", err)
+	}
+	return nil
+}
+
+// DeleteSSL removes the connection policy of ssl first, then its certificate
+func (c *CaddyRouter) DeleteSSL(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, ok := c.ssls[id]
+	if ok {
+		delete(c.ssls, id)
+		err := c.putServers()
+		if err != nil {
+			c.ssls[id] = old
+			return fmt.Errorf("update caddy server fail: %v", err)
+		}
+	}
+
+	_, err := c.admin.request("DELETE", "/id/"+caddySSLID(id), nil)
+	if err != nil && err != errAdminNotFound {
+		return fmt.Errorf("delete caddy certificate fail: %v", err)
+	}
+	return nil
+}
+
+func (c *CaddyRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ssls := make(map[string]map[string]interface{})
+	for id, ssl := range c.ssls {
+		ssls[id] = map[string]interface{}{
+			"id":   id,
+			"snis": ssl.snis,
+		}
+	}
+	return ssls, nil
+}
+
+// UpdateRoute adds or replaces route of param["id"]
+// a route of the same hosts and uri as another one is rejected
+func (c *CaddyRouter) UpdateRoute(param map[string]interface{}) error {
+	match, err := parseRouteMatch(param)
+	if err != nil {
+		return err
+	}
+	upstream, err := parseRouteUpstream(match.id, param)
+	if err != nil {
+		return err
+	}
+	route := &caddyRoute{routeMatch: match, param: param, upstream: upstream}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, other := range c.routes {
+		if id != route.id && route.conflicts(other.routeMatch) {
+			return fmt.Errorf("route %s conflicts with route %s", route.id, id)
+		}
+	}
+
+	old, ok := c.routes[route.id]
+	c.routes[route.id] = route
+	err = c.putServers()
+	if err != nil {
+		if ok {
+			c.routes[route.id] = old
+		} else {
+			delete(c.routes, route.id)
+		}
+		return fmt.Errorf("update caddy server fail: %v", err)
+	}
+	return nil
+}
+
+func (c *CaddyRouter) DeleteRoute(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, ok := c.routes[id]
+	if !ok {
+		return nil
+	}
+	delete(c.routes, id)
+	err := c.putServers()
+	if err != nil {
+		c.routes[id] = old
+		return fmt.Errorf("update caddy server fail: %v", err)
+	}
+	return nil
+}
+
+func (c *CaddyRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	routes := make(map[string]map[string]interface{})
+	for id, route := range c.routes {
+		routes[id] = route.param
+	}
+	return routes, nil
+}
+
+func (c *CaddyRouter) reconcileInterval(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.close:
+			return
+		case <-tick.C:
+		}
+
+		err := c.Reconcile()
+		if err != nil {
+			logs.Error("caddy reconcile fail: %v", err)
+		}
+	}
+}
+
+// Reconcile compares servers and certificates of gateway with caddy config
+// missing or modified ones are applied again
+func (c *CaddyRouter) Reconcile() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var config interface{}
+	err := c.get(caddyPath(), &config)
+	if err != nil {
+		return err
+	}
+
+	drift := make([]string, 0)
+	for name, server := range c.servers() {
+		current := caddyLookup(config, "apps", "http", "servers", name)
+		if current == nil {
+			drift = append(drift, "server "+name+" missing")
+		} else if !jsonContains(current, jsonObject(server)) {
+			drift = append(drift, "server "+name+" modified")
+		}
+	}
+
+	sslIDs := make([]string, 0, len(c.ssls))
+	for id := range c.ssls {
+		sslIDs = append(sslIDs, id)
+	}
+	sort.Strings(sslIDs)
+	loaded := make(map[string]interface{})
+	pems, _ := caddyLookup(config, "apps", "tls", "certificates", "load_pem").([]interface{})
+	for _, pem := range pems {
+		if object, ok := pem.(map[string]interface{}); ok {
+			id, _ := object["@id"].(string)
+			loaded[id] = object
+		}
+	}
+	for _, id := range sslIDs {
+		current, ok := loaded[caddySSLID(id)]
+		if !ok || !jsonContains(current, jsonObject(c.sslObject(id, c.ssls[id]))) {
+			drift = append(drift, "ssl "+id+" missing or modified")
+			err = c.putSSL(id, c.ssls[id])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(drift) == 0 {
+		return nil
+	}
+	logs.Warn("caddy drift: %s", strings.Join(drift, ", "))
+	return c.putServers()
+}
+
+// servers returns http servers of gateway, name -> server
+func (c *CaddyRouter) servers() map[string]map[string]interface{} {
+	routes := make([]*caddyRoute, 0, len(c.routes))
+	for _, route := range c.routes {
+		routes = append(routes, route)
+	}
+	// caddy runs the first matched route
+	// exact host is preferred to wildcard host, then the longest path
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.hostRank() != b.hostRank() {
+			return a.hostRank() > b.hostRank()
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		if a.prefix != b.prefix {
+			return !a.prefix
+		}
+		return a.id < b.id
+	})
+
+	objects := make([]interface{}, 0, len(routes))
+	for _, route := range routes {
+		objects = append(objects, route.object())
+	}
+
+	servers := make(map[string]map[string]interface{})
+	if len(c.conf.HTTPListen) > 0 {
+		servers[c.conf.Server] = map[string]interface{}{
+			"listen":          c.conf.HTTPListen,
+			"routes":          objects,
+			"automatic_https": map[string]interface{}{"disable": true},
+		}
+	}
+
+	if len(c.conf.HTTPSListen) > 0 {
+		// certificate of ssl is selected by sni, the others are left to caddy
+		ids := make([]string, 0, len(c.ssls))
+		for id := range c.ssls {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		policies := make([]interface{}, 0, len(ids)+1)
+		for _, id := range ids {
+			if len(c.ssls[id].snis) == 0 {
+				continue
+			}
+			policies = append(policies, map[string]interface{}{
+				"match": map[string]interface{}{"sni": c.ssls[id].snis},
+				"certificate_selection": map[string]interface{}{
+					"any_tag": []string{caddySSLID(id)},
+				},
+			})
+		}
+		policies = append(policies, map[string]interface{}{})
+
+		autoHTTPS := map[string]interface{}{"disable": true}
+		if c.conf.AutoHTTPS {
+			// http server keeps serving plain http
+			autoHTTPS = map[string]interface{}{"disable_redirects": true}
+		}
+		servers[c.conf.Server+"_tls"] = map[string]interface{}{
+			"listen":                  c.conf.HTTPSListen,
+			"routes":                  objects,
+			"tls_connection_policies": policies,
+			"automatic_https":         autoHTTPS,
+		}
+	}
+	return servers
+}
+
+// object returns the route of caddy http server
+func (r *caddyRoute) object() map[string]interface{} {
+	path := r.path
+	if r.prefix {
+		path += "*"
+	}
+	match := map[string]interface{}{"path": []string{path}}
+	if len(r.hosts) > 0 {
+		match["host"] = r.hosts
+	}
+
+	nodes := make([]string, 0, len(r.upstream.Nodes))
+	for node := range r.upstream.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	upstreams := make([]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		upstreams = append(upstreams, map[string]interface{}{"dial": node})
+	}
+
+	handler := map[string]interface{}{
+		"handler":   "reverse_proxy",
+		"upstreams": upstreams,
+	}
+	if r.upstream.Type == "least_conn" {
+		handler["load_balancing"] = map[string]interface{}{
+			"selection_policy": map[string]interface{}{"policy": "least_conn"},
+		}
+	}
+
+	return map[string]interface{}{
+		"match":    []interface{}{match},
+		"handle":   []interface{}{handler},
+		"terminal": true,
+	}
+}
+
+// putServers replaces http servers of gateway
+func (c *CaddyRouter) putServers() error {
+	err := c.ensure(map[string]interface{}{}, "apps", "http", "servers")
+	if err != nil {
+		return err
+	}
+	for name, server := range c.servers() {
+		_, err = c.admin.request("POST", caddyPath("apps", "http", "servers", name), server)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSSL replaces certificate of ssl id, or appends it to load_pem of tls app
+func (c *CaddyRouter) putSSL(id string, ssl *caddySSL) error {
+	object := c.sslObject(id, ssl)
+	_, err := c.admin.request("PATCH", "/id/"+caddySSLID(id), object)
+	if err != errAdminNotFound {
+		return err
+	}
+
+	err = c.ensure([]interface{}{}, "apps", "tls", "certificates", "load_pem")
+	if err != nil {
+		return err
+	}
+	_, err = c.admin.request("POST", caddyPath("apps", "tls", "certificates", "load_pem"), object)
+	return err
+}
+
+func (c *CaddyRouter) sslObject(id string, ssl *caddySSL) map[string]interface{} {
+	return map[string]interface{}{
+		"@id":         caddySSLID(id),
+		"certificate": ssl.cert,
+		"key":         ssl.key,
+		"tags":        []string{caddySSLID(id)},
+	}
+}
+
+// ensure creates value at the config path if it does not exist
+// missing parents are created as well
+func (c *CaddyRouter) ensure(value interface{}, paths ...string) error {
+	for i := 0; i <= len(paths); i++ {
+		var current interface{}
+		err := c.get(caddyPath(paths[:i]...), &current)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			continue
+		}
+
+		// paths[:i] is missing, value is wrapped by the keys below it
+		for j := len(paths) - 1; j >= i; j-- {
+			value = map[string]interface{}{paths[j]: value}
+		}
+		_, err = c.admin.request("POST", caddyPath(paths[:i]...), value)
+		return err
+	}
+	return nil
+}
+
+func (c *CaddyRouter) get(path string, result interface{}) error {
+	content, err := c.admin.request("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, result)
+}
+
+func caddyPath(paths ...string) string {
+	return "/config/" + strings.Join(paths, "/")
+}
+
+func caddySSLID(id string) string {
+	return "zta_ssl_" + id
+}
+
+// caddyLookup returns the value of keys in config, nil if not found
+func caddyLookup(config interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		object, ok := config.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		config = object[key]
+	}
+	return config
+}
+
+// jsonObject converts object to the form decoded from json
+func jsonObject(object interface{}) interface{} {
+	buf, err := json.Marshal(object)
+	if err != nil {
+		return nil
+	}
+	var result interface{}
+	json.Unmarshal(buf, &result)
+	return result
+}
@@ -0,0 +1,229 @@
+package http_route
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	errMockNotFound  = errors.New("not found")
+	errMockTraversal = errors.New("invalid traversal path")
+)
+
+// mockCaddy keeps caddy config in memory like the admin api
+type mockCaddy struct {
+	mu     sync.Mutex
+	config interface{}
+	// changes of http servers are rejected
+	failServers bool
+}
+
+func (m *mockCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failServers && r.Method != "GET" && strings.Contains(r.URL.Path, "/servers") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var parts []string
+	if strings.HasPrefix(r.URL.Path, "/id/") {
+		parts = mockFindID(m.config, strings.TrimPrefix(r.URL.Path, "/id/"))
+		if parts == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/config"), "/")
+		if path != "" {
+			parts = strings.Split(path, "/")
+		}
+	}
+
+	var body interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	var result interface{}
+	config, err := mockApply(m.config, parts, func(current interface{}) (interface{}, bool, error) {
+		switch r.Method {
+		case "GET":
+			result = current
+			return current, false, nil
+		case "POST":
+			if list, ok := current.([]interface{}); ok {
+				return append(list, body), false, nil
+			}
+			return body, false, nil
+		case "PATCH":
+			if current == nil {
+				return nil, false, errMockNotFound
+			}
+			return body, false, nil
+		case "DELETE":
+			if current == nil {
+				return nil, false, errMockNotFound
+			}
+			return nil, true, nil
+		}
+		return current, false, nil
+	})
+	switch err {
+	case nil:
+		m.config = config
+		json.NewEncoder(w).Encode(result)
+	case errMockNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// mockApply replaces the value at parts of node with the result of f
+func mockApply(node interface{}, parts []string,
+	f func(current interface{}) (interface{}, bool, error)) (interface{}, error) {
+	if len(parts) == 0 {
+		value, _, err := f(node)
+		return value, err
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(parts) > 1 {
+			child, err := mockApply(n[parts[0]], parts[1:], f)
+			n[parts[0]] = child
+			return n, err
+		}
+		value, remove, err := f(n[parts[0]])
+		if err == nil && remove {
+			delete(n, parts[0])
+		} else if err == nil {
+			n[parts[0]] = value
+		}
+		return n, err
+	case []interface{}:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i >= len(n) {
+			return n, errMockTraversal
+		}
+		if len(parts) > 1 {
+			child, err := mockApply(n[i], parts[1:], f)
+			n[i] = child
+			return n, err
+		}
+		value, remove, err := f(n[i])
+		if err == nil && remove {
+			return append(n[:i], n[i+1:]...), nil
+		} else if err == nil {
+			n[i] = value
+		}
+		return n, err
+	default:
+		return node, errMockTraversal
+	}
+}
+
+// mockFindID returns path of the object of @id
+func mockFindID(node interface{}, id string) []string {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["@id"] == id {
+			return []string{}
+		}
+		for k, v := range n {
+			if parts := mockFindID(v, id); parts != nil {
+				return append([]string{k}, parts...)
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if parts := mockFindID(v, id); parts != nil {
+				return append([]string{strconv.Itoa(i)}, parts...)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mockCaddy) lookup(keys ...string) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return jsonObject(caddyLookup(m.config, keys...))
+}
+
+func TestCaddyRouter(t *testing.T) {
+	convey.Convey("test caddy router", t, func() {
+		adminRetryInterval = time.Millisecond
+		mock := &mockCaddy{}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		router, err := NewCaddyRoute(json.RawMessage(`{"api": "` + srv.URL + `"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		pathsOf := func(server string) []interface{} {
+			paths := make([]interface{}, 0)
+			routes, _ := mock.lookup("apps", "http", "servers", server, "routes").([]interface{})
+			for _, r := range routes {
+				match := r.(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{})
+				paths = append(paths, match["path"].([]interface{})[0])
+			}
+			return paths
+		}
+
+		convey.So(router.UpdateRoute(testRoute("api", "/api/*", "*.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web", "/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web-api", "/api/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web2", "/*", "a.example.com")), convey.ShouldNotBeNil)
+
+		// more specific routes first
+		convey.So(pathsOf("zta"), convey.ShouldResemble, []interface{}{"/api/*", "/*", "/api/*"})
+		convey.So(pathsOf("zta_tls"), convey.ShouldResemble, pathsOf("zta"))
+
+		convey.So(router.UpdateSSL("s1", "cert", "key", []string{"a.example.com"}), convey.ShouldBeNil)
+		convey.So(router.UpdateSSL("s1", "cert2", "key2", []string{"a.example.com"}), convey.ShouldBeNil)
+		pems := mock.lookup("apps", "tls", "certificates", "load_pem").([]interface{})
+		convey.So(len(pems), convey.ShouldEqual, 1)
+		convey.So(pems[0].(map[string]interface{})["certificate"], convey.ShouldEqual, "cert2")
+		policies := mock.lookup("apps", "http", "servers", "zta_tls", "tls_connection_policies").([]interface{})
+		convey.So(len(policies), convey.ShouldEqual, 2)
+
+		// certificate is rolled back if servers fail to update
+		mock.mu.Lock()
+		mock.failServers = true
+		mock.mu.Unlock()
+		convey.So(router.UpdateSSL("s1", "cert3", "key3", []string{"b.example.com"}), convey.ShouldNotBeNil)
+		convey.So(router.UpdateSSL("s2", "cert", "key", []string{"b.example.com"}), convey.ShouldNotBeNil)
+		pems = mock.lookup("apps", "tls", "certificates", "load_pem").([]interface{})
+		convey.So(len(pems), convey.ShouldEqual, 1)
+		convey.So(pems[0].(map[string]interface{})["certificate"], convey.ShouldEqual, "cert2")
+		mock.mu.Lock()
+		mock.failServers = false
+		mock.mu.Unlock()
+
+		convey.So(router.Reconcile(), convey.ShouldBeNil)
+
+		// caddy restarted without config
+		mock.mu.Lock()
+		mock.config = nil
+		mock.mu.Unlock()
+		convey.So(router.Reconcile(), convey.ShouldBeNil)
+		convey.So(len(pathsOf("zta")), convey.ShouldEqual, 3)
+		convey.So(len(mock.lookup("apps", "tls", "certificates", "load_pem").([]interface{})), convey.ShouldEqual, 1)
+
+		convey.So(router.DeleteRoute("web"), convey.ShouldBeNil)
+		convey.So(len(pathsOf("zta")), convey.ShouldEqual, 2)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		convey.So(len(mock.lookup("apps", "tls", "certificates", "load_pem").([]interface{})), convey.ShouldEqual, 0)
+		policies = mock.lookup("apps", "http", "servers", "zta_tls", "tls_connection_policies").([]interface{})
+		convey.So(len(policies), convey.ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,711 @@
+package http_route
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	_ HTTPRoute  = &EnvoyRouter{}
+	_ Service    = &EnvoyRouter{}
+	_ Reloadable = &EnvoyRouter{}
+)
+
+const (
+	envoyListenerType = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	envoyClusterType  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	envoyRouteType    = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+	envoySecretType   = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+	// route configuration of all listeners
+	envoyRouteConfig = "zta_routes"
+)
+
+// rest-json xds endpoints, path -> type url
+var envoyDiscoveryTypes = map[string]string{
+	"/v3/discovery:listeners": envoyListenerType,
+	"/v3/discovery:clusters":  envoyClusterType,
+	"/v3/discovery:routes":    envoyRouteType,
+	"/v3/discovery:secrets":   envoySecretType,
+}
+
+type EnvoyConfig struct {
+	// listen address of the xds management server, eg: 127.0.0.1:18000
+	// sds replies private keys, so a non loopback address requires client_ca_file
+	XDSAddr string `json:"xds_addr"`
+	// certificate of the xds server, it serves https if configured
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// envoy must present a client certificate issued by the ca if configured
+	ClientCAFile string `json:"client_ca_file"`
+	// cluster of the xds server in envoy bootstrap, config source of rds and sds, default zta_xds
+	XDSCluster string `json:"xds_cluster"`
+	// seconds between polls of rds and sds, default 1
+	RefreshDelay int `json:"refresh_delay"`
+	// addresses of envoy listeners, eg: 0.0.0.0:80 and 0.0.0.0:443, empty disables
+	HTTPListen  string `json:"http_listen"`
+	HTTPSListen string `json:"https_listen"`
+}
+
+// envoyRoute is the route param, compatible with apisix route
+// eg: {"id", "uri": "/*", "hosts", "upstream": {"type", "nodes": {"127.0.0.1:10002": 1}}}
+type envoyRoute struct {
+	*routeMatch
+	param    map[string]interface{}
+	upstream *routeUpstream
+}
+
+type envoySSL struct {
+	cert string
+	key  string
+	snis []string
+}
+
+// EnvoyRouter is a rest-json xds (lds, cds, rds and sds) management server
+// envoy polls listeners, clusters of routes, the route configuration and certificates
+// version of resources is the hash of them, unchanged resources are replied with 304
+type EnvoyRouter struct {
+	mu     sync.RWMutex
+	conf   *EnvoyConfig
+	routes map[string]*envoyRoute
+	ssls   map[string]*envoySSL
+
+	serverMu sync.Mutex
+	server   *http.Server
+	// config the server listens with
+	serverConf *EnvoyConfig
+}
+
+func NewEnvoyRoute(conf json.RawMessage) (*EnvoyRouter, error) {
+	envoyConf, err := parseEnvoyConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnvoyRouter{
+		conf:   envoyConf,
+		routes: make(map[string]*envoyRoute),
+		ssls:   make(map[string]*envoySSL),
+	}, nil
+}
+
+func parseEnvoyConfig(conf json.RawMessage) (*EnvoyConfig, error) {
+	envoyConf := &EnvoyConfig{}
+	err := json.Unmarshal(conf, envoyConf)
+	if err != nil {
+		return nil, err
+	}
+	if envoyConf.XDSAddr == "" {
+		return nil, fmt.Errorf("xds_addr is required")
+	}
+	if (envoyConf.CertFile == "") != (envoyConf.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file are required together")
+	}
+	if envoyConf.ClientCAFile != "" && envoyConf.CertFile == "" {
+		return nil, fmt.Errorf("client_ca_file requires cert_file and key_file")
+	}
+	if envoyConf.ClientCAFile == "" && !isLoopback(envoyConf.XDSAddr) {
+		return nil, fmt.Errorf("xds_addr %s is not loopback, client_ca_file is required", envoyConf.XDSAddr)
+	}
+	if envoyConf.HTTPListen == "" && envoyConf.HTTPSListen == "" {
+		return nil, fmt.Errorf("http_listen or https_listen is required")
+	}
+	for _, addr := range []string{envoyConf.HTTPListen, envoyConf.HTTPSListen} {
+		if addr == "" {
+			continue
+		}
+		_, err = envoyAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if envoyConf.XDSCluster == "" {
+		envoyConf.XDSCluster = "zta_xds"
+	}
+	if envoyConf.RefreshDelay <= 0 {
+		envoyConf.RefreshDelay = 1
+	}
+	return envoyConf, nil
+}
+
+// Start listens xds_addr
+func (e *EnvoyRouter) Start() error {
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	return e.serve(e.conf)
+}
+
+func (e *EnvoyRouter) Close() error {
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	if e.server != nil {
+		e.server.Close()
+		e.server = nil
+		e.serverConf = nil
+	}
+	return nil
+}
+
+// Reload applies conf in place, the xds server keeps serving if xds_addr and tls files are unchanged
+func (e *EnvoyRouter) Reload(conf json.RawMessage) error {
+	envoyConf, err := parseEnvoyConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	e.serverMu.Lock()
+	defer e.serverMu.Unlock()
+	err = e.serve(envoyConf)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conf = envoyConf
+	return nil
+}
+
+// serve starts the xds server of conf if changed, then closes the replaced one
+func (e *EnvoyRouter) serve(conf *EnvoyConfig) error {
+	old := e.serverConf
+	if e.server != nil && old.XDSAddr == conf.XDSAddr && old.CertFile == conf.CertFile &&
+		old.KeyFile == conf.KeyFile && old.ClientCAFile == conf.ClientCAFile {
+		return nil
+	}
+
+	var tlsConfig *tls.Config
+	if conf.CertFile != "" {
+		var err error
+		tlsConfig, err = envoyTLSConfig(conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	addr := conf.XDSAddr
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	srv := &http.Server{Addr: listener.Addr().String(), Handler: e}
+	go func() {
+		err := srv.Serve(listener)
+		if err != http.ErrServerClosed {
+			logs.Error("envoy xds serve %s fail: %v", addr, err)
+		}
+	}()
+	logs.Info("envoy xds listen %s", srv.Addr)
+
+	if e.server != nil {
+		e.server.Close()
+	}
+	e.server = srv
+	e.serverConf = conf
+	return nil
+}
+
+func envoyTLSConfig(conf *EnvoyConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.ClientCAFile != "" {
+		content, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// isLoopback reports whether addr listens on loopback only
+// empty host listens on all interfaces
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// discoveryRequest is the DiscoveryRequest of envoy in json
+type discoveryRequest struct {
+	VersionInfo string `json:"version_info"`
+	Node        struct {
+		ID string `json:"id"`
+	} `json:"node"`
+	ResourceNames []string `json:"resource_names"`
+	ErrorDetail   *struct {
+		Message string `json:"message"`
+	} `json:"error_detail"`
+}
+
+func (e *EnvoyRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	typeURL, ok := envoyDiscoveryTypes[req.URL.Path]
+	if !ok || req.Method != http.MethodPost {
+		http.NotFound(w, req)
+		return
+	}
+
+	discovery := &discoveryRequest{}
+	err := json.NewDecoder(req.Body).Decode(discovery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if discovery.ErrorDetail != nil {
+		logs.Warn("envoy %s rejected %s version %s: %s", discovery.Node.ID,
+			typeURL, discovery.VersionInfo, discovery.ErrorDetail.Message)
+	}
+
+	resources, version := e.resources(typeURL)
+	if discovery.VersionInfo == version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// rds and sds request resources by name
+	if len(discovery.ResourceNames) > 0 {
+		names := make(map[string]bool)
+		for _, name := range discovery.ResourceNames {
+			names[name] = true
+		}
+		requested := make([]interface{}, 0, len(discovery.ResourceNames))
+		for _, resource := range resources {
+			if names[resource["name"].(string)] {
+				requested = append(requested, resource)
+			}
+		}
+		resourcesReply(w, version, typeURL, requested)
+		return
+	}
+
+	all := make([]interface{}, 0, len(resources))
+	for _, resource := range resources {
+		all = append(all, resource)
+	}
+	resourcesReply(w, version, typeURL, all)
+}
+
+func resourcesReply(w http.ResponseWriter, version, typeURL string, resources []interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version_info": version,
+		"type_url":     typeURL,
+		"resources":    resources,
+	})
+}
+
+// resources returns resources of typeURL and their version
+func (e *EnvoyRouter) resources(typeURL string) ([]map[string]interface{}, string) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var resources []map[string]interface{}
+	switch typeURL {
+	case envoyListenerType:
+		resources = e.listeners()
+	case envoyClusterType:
+		resources = e.clusters()
+	case envoyRouteType:
+		resources = []map[string]interface{}{e.routeConfiguration()}
+	case envoySecretType:
+		resources = e.secrets()
+	}
+
+	content, _ := json.Marshal(resources)
+	sum := sha256.Sum256(content)
+	return resources, hex.EncodeToString(sum[:8])
+}
+
+func (e *EnvoyRouter) configSource() map[string]interface{} {
+	return map[string]interface{}{
+		"api_config_source": map[string]interface{}{
+			"api_type":              "REST",
+			"transport_api_version": "V3",
+			"cluster_names":         []string{e.conf.XDSCluster},
+			"refresh_delay":         fmt.Sprintf("%ds", e.conf.RefreshDelay),
+		},
+		"resource_api_version": "V3",
+	}
+}
+
+func (e *EnvoyRouter) httpConnectionManager(statPrefix string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": "envoy.filters.network.http_connection_manager",
+		"typed_config": map[string]interface{}{
+			"@type":               "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+			"stat_prefix":         statPrefix,
+			"strip_any_host_port": true,
+			"rds": map[string]interface{}{
+				"route_config_name": envoyRouteConfig,
+				"config_source":     e.configSource(),
+			},
+			"http_filters": []interface{}{
+				map[string]interface{}{
+					"name": "envoy.filters.http.router",
+					"typed_config": map[string]interface{}{
+						"@type": "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router",
+					},
+				},
+			},
+		},
+	}
+}
+
+// listeners returns zta_http and zta_https
+// zta_https has a filter chain for snis of each ssl, it is omitted if there is no ssl
+func (e *EnvoyRouter) listeners() []map[string]interface{} {
+	listeners := make([]map[string]interface{}, 0, 2)
+	if e.conf.HTTPListen != "" {
+		address, _ := envoyAddress(e.conf.HTTPListen)
+		listeners = append(listeners, map[string]interface{}{
+			"@type":   envoyListenerType,
+			"name":    "zta_http",
+			"address": address,
+			"filter_chains": []interface{}{
+				map[string]interface{}{
+					"filters": []interface{}{e.httpConnectionManager("zta_http")},
+				},
+			},
+		})
+	}
+
+	// a sni is served by the first ssl of it
+	ids := make([]string, 0, len(e.ssls))
+	for id := range e.ssls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	served := make(map[string]bool)
+	chains := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		snis := make([]string, 0, len(e.ssls[id].snis))
+		for _, sni := range e.ssls[id].snis {
+			if !served[sni] {
+				served[sni] = true
+				snis = append(snis, sni)
+			}
+		}
+		if len(snis) == 0 {
+			continue
+		}
+
+		chains = append(chains, map[string]interface{}{
+			"filter_chain_match": map[string]interface{}{"server_names": snis},
+			"filters":            []interface{}{e.httpConnectionManager("zta_https")},
+			"transport_socket": map[string]interface{}{
+				"name": "envoy.transport_sockets.tls",
+				"typed_config": map[string]interface{}{
+					"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"common_tls_context": map[string]interface{}{
+						"tls_certificate_sds_secret_configs": []interface{}{
+							map[string]interface{}{
+								"name":       envoySecretName(id),
+								"sds_config": e.configSource(),
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
+	if e.conf.HTTPSListen != "" && len(chains) > 0 {
+		address, _ := envoyAddress(e.conf.HTTPSListen)
+		listeners = append(listeners, map[string]interface{}{
+			"@type":   envoyListenerType,
+			"name":    "zta_https",
+			"address": address,
+			"listener_filters": []interface{}{
+				map[string]interface{}{
+					"name": "envoy.filters.listener.tls_inspector",
+					"typed_config": map[string]interface{}{
+						"@type": "type.googleapis.com/envoy.extensions.filters.listener.tls_inspector.v3.TlsInspector",
+					},
+				},
+			},
+			"filter_chains": chains,
+		})
+	}
+	return listeners
+}
+
+// clusters returns a cluster of upstream nodes for each route
+func (e *EnvoyRouter) clusters() []map[string]interface{} {
+	ids := make([]string, 0, len(e.routes))
+	for id := range e.routes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	clusters := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		route := e.routes[id]
+		nodes := make([]string, 0, len(route.upstream.Nodes))
+		for node := range route.upstream.Nodes {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+
+		discoveryType := "STATIC"
+		endpoints := make([]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			address, _ := envoyAddress(node)
+			host, _, _ := net.SplitHostPort(node)
+			if net.ParseIP(host) == nil {
+				discoveryType = "STRICT_DNS"
+			}
+			weight := route.upstream.Nodes[node]
+			if weight <= 0 {
+				weight = 1
+			}
+			endpoints = append(endpoints, map[string]interface{}{
+				"endpoint":              map[string]interface{}{"address": address},
+				"load_balancing_weight": weight,
+			})
+		}
+
+		lbPolicy := "ROUND_ROBIN"
+		if route.upstream.Type == "least_conn" {
+			lbPolicy = "LEAST_REQUEST"
+		}
+		name := envoyClusterName(id)
+		clusters = append(clusters, map[string]interface{}{
+			"@type":           envoyClusterType,
+			"name":            name,
+			"type":            discoveryType,
+			"connect_timeout": "5s",
+			"lb_policy":       lbPolicy,
+			"load_assignment": map[string]interface{}{
+				"cluster_name": name,
+				"endpoints": []interface{}{
+					map[string]interface{}{"lb_endpoints": endpoints},
+				},
+			},
+		})
+	}
+	return clusters
+}
+
+// routeConfiguration returns a virtual host for each host of routes
+// routes without host are in the virtual host of "*"
+// envoy selects the most specific virtual host, then the first matched route
+func (e *EnvoyRouter) routeConfiguration() map[string]interface{} {
+	hostRoutes := make(map[string][]*envoyRoute)
+	for _, route := range e.routes {
+		hosts := route.hosts
+		if len(hosts) == 0 {
+			hosts = []string{"*"}
+		}
+		for _, host := range hosts {
+			hostRoutes[host] = append(hostRoutes[host], route)
+		}
+	}
+	hosts := make([]string, 0, len(hostRoutes))
+	for host := range hostRoutes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	virtualHosts := make([]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		routes := hostRoutes[host]
+		// the longest path first
+		sort.Slice(routes, func(i, j int) bool {
+			a, b := routes[i], routes[j]
+			if len(a.path) != len(b.path) {
+				return len(a.path) > len(b.path)
+			}
+			if a.prefix != b.prefix {
+				return !a.prefix
+			}
+			return a.id < b.id
+		})
+
+		objects := make([]interface{}, 0, len(routes))
+		for _, route := range routes {
+			match := map[string]interface{}{"path": route.path}
+			if route.prefix {
+				match = map[string]interface{}{"prefix": route.path}
+			}
+			objects = append(objects, map[string]interface{}{
+				"name":  safeName(route.id),
+				"match": match,
+				"route": map[string]interface{}{"cluster": envoyClusterName(route.id)},
+			})
+		}
+		virtualHosts = append(virtualHosts, map[string]interface{}{
+			"name":    safeName(host),
+			"domains": []string{host},
+			"routes":  objects,
+		})
+	}
+
+	return map[string]interface{}{
+		"@type":         envoyRouteType,
+		"name":          envoyRouteConfig,
+		"virtual_hosts": virtualHosts,
+	}
+}
+
+func (e *EnvoyRouter) secrets() []map[string]interface{} {
+	ids := make([]string, 0, len(e.ssls))
+	for id := range e.ssls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	secrets := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		secrets = append(secrets, map[string]interface{}{
+			"@type": envoySecretType,
+			"name":  envoySecretName(id),
+			"tls_certificate": map[string]interface{}{
+				"certificate_chain": map[string]interface{}{"inline_string": e.ssls[id].cert},
+				"private_key":       map[string]interface{}{"inline_string": e.ssls[id].key},
+			},
+		})
+	}
+	return secrets
+}
+
+func envoyClusterName(id string) string {
+	return "zta_" + safeName(id)
+}
+
+func envoySecretName(id string) string {
+	return "zta_ssl_" + safeName(id)
+}
+
+// envoyAddress returns the socket address of addr, eg: 0.0.0.0:80
+func envoyAddress(addr string) (map[string]interface{}, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portValue, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port of %s", addr)
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return map[string]interface{}{
+		"socket_address": map[string]interface{}{
+			"address":    host,
+			"port_value": portValue,
+		},
+	}, nil
+}
+
+func (e *EnvoyRouter) UpdateSSL(id, cert, key string, snis []string) error {
+	_, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return fmt.Errorf("ssl %s: %v", id, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ssls[id] = &envoySSL{cert: cert, key: key, snis: lowerSNIs(snis)}
+	return nil
+}
+
+func (e *EnvoyRouter) DeleteSSL(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.ssls, id)
+	return nil
+}
+
+func (e *EnvoyRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ssls := make(map[string]map[string]interface{})
+	for id, ssl := range e.ssls {
+		ssls[id] = map[string]interface{}{
+			"id":   id,
+			"snis": ssl.snis,
+		}
+	}
+	return ssls, nil
+}
+
+// UpdateRoute adds or replaces route of param["id"]
+// a route of the same hosts and uri as another one is rejected
+func (e *EnvoyRouter) UpdateRoute(param map[string]interface{}) error {
+	match, err := parseRouteMatch(param)
+	if err != nil {
+		return err
+	}
+	upstream, err := parseRouteUpstream(match.id, param)
+	if err != nil {
+		return err
+	}
+	for node := range upstream.Nodes {
+		_, err = envoyAddress(node)
+		if err != nil {
+			return fmt.Errorf("route %s: invalid upstream node %s: %v", match.id, node, err)
+		}
+	}
+	route := &envoyRoute{routeMatch: match, param: param, upstream: upstream}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, other := range e.routes {
+		if id != route.id && route.conflicts(other.routeMatch) {
+			return fmt.Errorf("route %s conflicts with route %s", route.id, id)
+		}
+	}
+	e.routes[route.id] = route
+	return nil
+}
+
+func (e *EnvoyRouter) DeleteRoute(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.routes, id)
+	return nil
+}
+
+func (e *EnvoyRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	routes := make(map[string]map[string]interface{})
+	for id, route := range e.routes {
+		routes[id] = route.param
+	}
+	return routes, nil
+}
@@ -0,0 +1,159 @@
+package http_route
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvoyRouter(t *testing.T) {
+	convey.Convey("test envoy router", t, func() {
+		router, err := NewEnvoyRoute(json.RawMessage(`{"xds_addr": "127.0.0.1:0",
+			"http_listen": "0.0.0.0:80", "https_listen": "0.0.0.0:443"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		discover := func(kind, version string, names ...string) (int, map[string]interface{}) {
+			body, _ := json.Marshal(map[string]interface{}{
+				"version_info":   version,
+				"node":           map[string]interface{}{"id": "envoy"},
+				"resource_names": names,
+			})
+			req := httptest.NewRequest("POST", "/v3/discovery:"+kind, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			reply := make(map[string]interface{})
+			json.Unmarshal(w.Body.Bytes(), &reply)
+			return w.Code, reply
+		}
+
+		code, reply := discover("listeners", "")
+		convey.So(code, convey.ShouldEqual, http.StatusOK)
+		// no https listener without ssl
+		convey.So(len(reply["resources"].([]interface{})), convey.ShouldEqual, 1)
+		version := reply["version_info"].(string)
+		code, _ = discover("listeners", version)
+		convey.So(code, convey.ShouldEqual, http.StatusNotModified)
+
+		convey.So(router.UpdateRoute(testRoute("web", "/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web-api", "/api/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("health", "/health")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web2", "/*", "a.example.com")), convey.ShouldNotBeNil)
+
+		_, reply = discover("clusters", "")
+		convey.So(len(reply["resources"].([]interface{})), convey.ShouldEqual, 3)
+
+		_, reply = discover("routes", "", envoyRouteConfig)
+		resources := reply["resources"].([]interface{})
+		convey.So(len(resources), convey.ShouldEqual, 1)
+		virtualHosts := resources[0].(map[string]interface{})["virtual_hosts"].([]interface{})
+		convey.So(len(virtualHosts), convey.ShouldEqual, 2)
+		// the longest path first
+		host := virtualHosts[1].(map[string]interface{})
+		convey.So(host["domains"], convey.ShouldResemble, []interface{}{"a.example.com"})
+		routes := host["routes"].([]interface{})
+		convey.So(routes[0].(map[string]interface{})["match"], convey.ShouldResemble,
+			map[string]interface{}{"prefix": "/api/"})
+		convey.So(routes[1].(map[string]interface{})["route"], convey.ShouldResemble,
+			map[string]interface{}{"cluster": "zta_web"})
+
+		cert, key := selfSignedCert("a.example.com")
+		convey.So(router.UpdateSSL("s1", "cert", "key", []string{"a.example.com"}), convey.ShouldNotBeNil)
+		convey.So(router.UpdateSSL("s1", cert, key, []string{"A.example.com"}), convey.ShouldBeNil)
+		ssls, _ := router.ListSSLs()
+		convey.So(ssls["s1"]["snis"], convey.ShouldResemble, []string{"a.example.com"})
+		code, reply = discover("listeners", version)
+		convey.So(code, convey.ShouldEqual, http.StatusOK)
+		convey.So(len(reply["resources"].([]interface{})), convey.ShouldEqual, 2)
+
+		_, reply = discover("secrets", "", "zta_ssl_s1", "zta_ssl_unknown")
+		resources = reply["resources"].([]interface{})
+		convey.So(len(resources), convey.ShouldEqual, 1)
+		convey.So(resources[0].(map[string]interface{})["name"], convey.ShouldEqual, "zta_ssl_s1")
+
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		code, _ = discover("listeners", version)
+		convey.So(code, convey.ShouldEqual, http.StatusNotModified)
+
+		code, _ = discover("unknown", "")
+		convey.So(code, convey.ShouldEqual, http.StatusNotFound)
+
+		// xds server is replaced on address change only
+		convey.So(router.Start(), convey.ShouldBeNil)
+		server := router.server
+		convey.So(router.Reload(json.RawMessage(`{"xds_addr": "127.0.0.1:0", "http_listen": ":8080"}`)), convey.ShouldBeNil)
+		convey.So(router.server, convey.ShouldEqual, server)
+		convey.So(router.Close(), convey.ShouldBeNil)
+
+		_, err = NewEnvoyRoute(json.RawMessage(`{"xds_addr": "127.0.0.1:0"}`))
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+}
+
+func TestEnvoyXDSTLS(t *testing.T) {
+	convey.Convey("test envoy xds tls", t, func() {
+		dir := t.TempDir()
+		write := func(name, content string) string {
+			file := filepath.Join(dir, name)
+			os.WriteFile(file, []byte(content), 0600)
+			return file
+		}
+		serverCert, serverKey := selfSignedCert("zta_xds")
+		clientCert, clientKey := selfSignedCert("envoy")
+		certFile, keyFile := write("xds.crt", serverCert), write("xds.key", serverKey)
+		caFile := write("ca.crt", clientCert)
+
+		// sds replies private keys, not served on public address without client ca
+		_, err := NewEnvoyRoute(json.RawMessage(`{"xds_addr": "0.0.0.0:18000", "http_listen": ":80"}`))
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = NewEnvoyRoute(json.RawMessage(`{"xds_addr": ":18000", "http_listen": ":80",
+			"cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}`))
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = NewEnvoyRoute(json.RawMessage(`{"xds_addr": "127.0.0.1:0", "http_listen": ":80",
+			"client_ca_file": "` + caFile + `"}`))
+		convey.So(err, convey.ShouldNotBeNil)
+
+		router, err := NewEnvoyRoute(json.RawMessage(`{"xds_addr": "127.0.0.1:0", "http_listen": ":80", "https_listen": ":443",
+			"cert_file": "` + certFile + `", "key_file": "` + keyFile + `", "client_ca_file": "` + caFile + `"}`))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(router.Start(), convey.ShouldBeNil)
+		defer router.Close()
+		cert, key := selfSignedCert("a.example.com")
+		convey.So(router.UpdateSSL("s1", cert, key, []string{"a.example.com"}), convey.ShouldBeNil)
+
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM([]byte(serverCert))
+		discover := func(scheme string, certs ...tls.Certificate) (*http.Response, error) {
+			cli := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: "zta_xds", RootCAs: roots, Certificates: certs},
+			}}
+			body := `{"node": {"id": "envoy"}, "resource_names": ["zta_ssl_s1"]}`
+			return cli.Post(scheme+"://"+router.server.Addr+"/v3/discovery:secrets",
+				"application/json", bytes.NewReader([]byte(body)))
+		}
+
+		// unauthenticated requests are refused
+		resp, err := discover("http")
+		convey.So(err, convey.ShouldBeNil)
+		resp.Body.Close()
+		convey.So(resp.StatusCode, convey.ShouldEqual, http.StatusBadRequest)
+		_, err = discover("https")
+		convey.So(err, convey.ShouldNotBeNil)
+
+		pair, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+		convey.So(err, convey.ShouldBeNil)
+		resp, err = discover("https", pair)
+		convey.So(err, convey.ShouldBeNil)
+		defer resp.Body.Close()
+		convey.So(resp.StatusCode, convey.ShouldEqual, http.StatusOK)
+		reply := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&reply)
+		convey.So(len(reply["resources"].([]interface{})), convey.ShouldEqual, 1)
+	})
+}
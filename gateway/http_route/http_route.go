@@ -3,13 +3,19 @@ package http_route
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
 )
 
 var (
 	TypeApisix               = "apisix"
+	TypeBuiltin              = "builtin"
 	TypeNginx                = "nginx"
 	TypeCaddy                = "caddy"
+	TypeTraefik              = "traefik"
+	TypeEnvoy                = "envoy"
 	ErrRouteTypeNotSupported = fmt.Errorf("route type not supported")
+	routesMu                 sync.Mutex
 	routes                   = make(map[string]HTTPRoute)
 )
 
@@ -24,29 +30,144 @@ type HTTPRoute interface {
 	// UpdateRoute update http route rule
 	// param: route configuration
 	UpdateRoute(param map[string]interface{}) error
+
+	// DeleteRoute delete http route rule of id
+	// deleting a route which does not exist is not an error
+	DeleteRoute(id string) error
+
+	// ListRoutes list http route rules, id -> route configuration
+	ListRoutes() (map[string]map[string]interface{}, error)
+
+	// DeleteSSL delete ssl certificate of id
+	// deleting a ssl which does not exist is not an error
+	DeleteSSL(id string) error
+
+	// ListSSLs list ssl certificates, id -> ssl configuration
+	ListSSLs() (map[string]map[string]interface{}, error)
+}
+
+// Service is implemented by routes running in background
+// eg: the reconciler of apisix
+type Service interface {
+	// Start is called before the route becomes the global route
+	Start() error
+	// Close is called after the route is replaced
+	Close() error
+}
+
+// DialFunc opens a stream to the internal address of listener
+// visitorAddr is the remote address of the http request
+type DialFunc func(visitorAddr string) (net.Conn, error)
+
+// StreamRoute is implemented by routes proxying requests into tunnel streams
+// instead of the public address of listener, eg: builtin
+type StreamRoute interface {
+	// UpdateStreamRoute update http route rule, matched requests are sent to streams of dial
+	UpdateStreamRoute(param map[string]interface{}, dial DialFunc) error
+}
+
+// Reloadable is implemented by routes applying configuration in place
+// rules and ssl certificates are kept, eg: builtin keeps its address if unchanged
+type Reloadable interface {
+	Reload(conf json.RawMessage) error
+}
+
+// NewRoute create route instance base on routeType and configuration
+// currently supports apisix, builtin, nginx, caddy, traefik and envoy
+func NewRoute(routeType string, conf json.RawMessage) (HTTPRoute, error) {
+	switch routeType {
+	case TypeApisix:
+		apisix, err := NewApisixRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return apisix, nil
+	case TypeNginx:
+		nginx, err := NewNginxRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return nginx, nil
+	case TypeCaddy:
+		caddy, err := NewCaddyRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return caddy, nil
+	case TypeTraefik:
+		traefik, err := NewTraefikRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return traefik, nil
+	case TypeEnvoy:
+		envoy, err := NewEnvoyRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return envoy, nil
+	case TypeBuiltin:
+		builtin, err := NewBuiltinRoute(conf)
+		if err != nil {
+			return nil, err
+		}
+		return builtin, nil
+	default:
+		return nil, ErrRouteTypeNotSupported
+	}
 }
 
 // InitRoute create global route instance base on routeType and configuration
-// currently supports apisix only
 func InitRoute(routeType string, conf json.RawMessage) error {
-	if _, ok := routes[routeType]; ok {
+	if GetRoute(routeType) != nil {
 		return nil
 	}
 
-	switch routeType {
-	case TypeApisix:
-		apisix, err := NewApisixRoute(conf)
+	route, err := NewRoute(routeType, conf)
+	if err != nil {
+		return err
+	}
+	return SetRoute(routeType, route)
+}
+
+// SetRoute replace global route instance of routeType
+// the old instance is kept if the new one fails to start
+func SetRoute(routeType string, route HTTPRoute) error {
+	if svc, ok := route.(Service); ok {
+		err := svc.Start()
 		if err != nil {
 			return err
 		}
-		routes[routeType] = apisix
-		return nil
-	default:
-		return ErrRouteTypeNotSupported
+	}
+
+	routesMu.Lock()
+	old := routes[routeType]
+	routes[routeType] = route
+	routesMu.Unlock()
+
+	if svc, ok := old.(Service); ok {
+		svc.Close()
+	}
+	return nil
+}
+
+// Range iterates all global route instances
+func Range(f func(routeType string, route HTTPRoute)) {
+	routesMu.Lock()
+	all := make(map[string]HTTPRoute)
+	for routeType, route := range routes {
+		all[routeType] = route
+	}
+	routesMu.Unlock()
+
+	for routeType, route := range all {
+		f(routeType, route)
 	}
 }
 
 // GetRoute get global route instance of routeType
 func GetRoute(routeType string) HTTPRoute {
+	routesMu.Lock()
+	defer routesMu.Unlock()
 	return routes[routeType]
 }
@@ -0,0 +1,445 @@
+package http_route
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ HTTPRoute = &NginxRouter{}
+
+var nginxCmdTimeout = time.Second * 30
+
+// files rendered into conf_dir, relative to conf_dir
+const (
+	nginxConfFile = "zta.conf"
+	nginxCertDir  = "certs"
+)
+
+type NginxConfig struct {
+	// directory of rendered files, included by the http block of nginx.conf
+	// eg: include /etc/nginx/zta/*.conf;
+	ConfDir string `json:"conf_dir"`
+	// listen of server blocks, default 80 and 443
+	Listen    string `json:"listen"`
+	SSLListen string `json:"ssl_listen"`
+	// commands split by spaces, default "nginx -t" and "nginx -s reload"
+	TestCmd   string `json:"test_cmd"`
+	ReloadCmd string `json:"reload_cmd"`
+}
+
+// nginxRoute is the route param, compatible with apisix route
+// eg: {"id", "uri": "/*", "hosts", "upstream": {"type", "nodes": {"127.0.0.1:10002": 1}}}
+type nginxRoute struct {
+	*routeMatch
+	param map[string]interface{}
+	// address -> weight
+	nodes     map[string]int
+	leastConn bool
+}
+
+type nginxSSL struct {
+	cert string
+	key  string
+	snis []string
+}
+
+// NginxRouter renders server and upstream blocks of routes
+// and certificate files of ssls into conf_dir
+// every change is validated by test_cmd and applied by reload_cmd,
+// files of conf_dir are rolled back if any of them fails
+type NginxRouter struct {
+	conf *NginxConfig
+	// mu also serializes rendering and commands
+	mu     sync.Mutex
+	routes map[string]*nginxRoute
+	ssls   map[string]*nginxSSL
+}
+
+func NewNginxRoute(conf json.RawMessage) (*NginxRouter, error) {
+	nginxConf := &NginxConfig{}
+	err := json.Unmarshal(conf, nginxConf)
+	if err != nil {
+		return nil, err
+	}
+	if nginxConf.ConfDir == "" {
+		return nil, fmt.Errorf("conf_dir is required")
+	}
+	if nginxConf.Listen == "" {
+		nginxConf.Listen = "80"
+	}
+	if nginxConf.SSLListen == "" {
+		nginxConf.SSLListen = "443"
+	}
+	if nginxConf.TestCmd == "" {
+		nginxConf.TestCmd = "nginx -t"
+	}
+	if nginxConf.ReloadCmd == "" {
+		nginxConf.ReloadCmd = "nginx -s reload"
+	}
+	if !nginxSafe(nginxConf.Listen) || !nginxSafe(nginxConf.SSLListen) {
+		return nil, fmt.Errorf("invalid listen")
+	}
+
+	return &NginxRouter{
+		conf:   nginxConf,
+		routes: make(map[string]*nginxRoute),
+		ssls:   make(map[string]*nginxSSL),
+	}, nil
+}
+
+func (n *NginxRouter) UpdateSSL(id, cert, key string, snis []string) error {
+	for _, sni := range snis {
+		if !nginxSafe(sni) {
+			return fmt.Errorf("ssl %s: invalid sni %q", id, sni)
+		}
+	}
+	ssl := &nginxSSL{cert: cert, key: key, snis: lowerSNIs(snis)}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	old, ok := n.ssls[id]
+	n.ssls[id] = ssl
+	err := n.apply()
+	if err != nil {
+		if ok {
+			n.ssls[id] = old
+		} else {
+			delete(n.ssls, id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (n *NginxRouter) DeleteSSL(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	old, ok := n.ssls[id]
+	if !ok {
+		return nil
+	}
+	delete(n.ssls, id)
+	err := n.apply()
+	if err != nil {
+		n.ssls[id] = old
+		return err
+	}
+	return nil
+}
+
+func (n *NginxRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ssls := make(map[string]map[string]interface{})
+	for id, ssl := range n.ssls {
+		ssls[id] = map[string]interface{}{
+			"id":   id,
+			"snis": ssl.snis,
+		}
+	}
+	return ssls, nil
+}
+
+// UpdateRoute adds or replaces route of param["id"]
+// a route of the same hosts and uri as another one is rejected
+func (n *NginxRouter) UpdateRoute(param map[string]interface{}) error {
+	route, err := newNginxRoute(param)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, other := range n.routes {
+		if id != route.id && route.conflicts(other.routeMatch) {
+			return fmt.Errorf("route %s conflicts with route %s", route.id, id)
+		}
+	}
+
+	old, ok := n.routes[route.id]
+	n.routes[route.id] = route
+	err = n.apply()
+	if err != nil {
+		if ok {
+			n.routes[route.id] = old
+		} else {
+			delete(n.routes, route.id)
+		}
+		return err
+	}
+	return nil
+}
+
+func newNginxRoute(param map[string]interface{}) (*nginxRoute, error) {
+	match, err := parseRouteMatch(param)
+	if err != nil {
+		return nil, err
+	}
+	if len(match.hosts) == 0 {
+		return nil, fmt.Errorf("route %s: hosts are required", match.id)
+	}
+	for _, host := range match.hosts {
+		if !nginxSafe(host) {
+			return nil, fmt.Errorf("route %s: invalid host %q", match.id, host)
+		}
+	}
+	if !nginxSafe(match.path) {
+		return nil, fmt.Errorf("route %s: invalid uri %q", match.id, match.path)
+	}
+
+	upstream, err := parseRouteUpstream(match.id, param)
+	if err != nil {
+		return nil, err
+	}
+	for node := range upstream.Nodes {
+		if !nginxSafe(node) {
+			return nil, fmt.Errorf("route %s: invalid upstream node %q", match.id, node)
+		}
+	}
+
+	return &nginxRoute{
+		routeMatch: match,
+		param:      param,
+		nodes:      upstream.Nodes,
+		leastConn:  upstream.Type == "least_conn",
+	}, nil
+}
+
+func (n *NginxRouter) DeleteRoute(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	old, ok := n.routes[id]
+	if !ok {
+		return nil
+	}
+	delete(n.routes, id)
+	err := n.apply()
+	if err != nil {
+		n.routes[id] = old
+		return err
+	}
+	return nil
+}
+
+func (n *NginxRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	routes := make(map[string]map[string]interface{})
+	for id, route := range n.routes {
+		routes[id] = route.param
+	}
+	return routes, nil
+}
+
+// apply renders routes and ssls into conf_dir, then tests and reloads nginx
+// files of conf_dir are rolled back if test or reload fails
+func (n *NginxRouter) apply() error {
+	backup, err := n.readFiles()
+	if err != nil {
+		return err
+	}
+
+	err = n.writeFiles(n.render())
+	if err == nil {
+		err = n.run(n.conf.TestCmd)
+	}
+	if err == nil {
+		err = n.run(n.conf.ReloadCmd)
+	}
+	if err != nil {
+		rollbackErr := n.writeFiles(backup)
+		if rollbackErr != nil {
+			logs.Error("nginx rollback %s fail: %v", n.conf.ConfDir, rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (n *NginxRouter) run(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nginxCmdTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// readFiles returns the rendered files in conf_dir, relative path -> content
+func (n *NginxRouter) readFiles() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	content, err := os.ReadFile(filepath.Join(n.conf.ConfDir, nginxConfFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		files[nginxConfFile] = content
+	}
+
+	entries, err := os.ReadDir(filepath.Join(n.conf.ConfDir, nginxCertDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(nginxCertDir, entry.Name())
+		content, err := os.ReadFile(filepath.Join(n.conf.ConfDir, name))
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+// writeFiles replaces the rendered files in conf_dir with files
+func (n *NginxRouter) writeFiles(files map[string][]byte) error {
+	certDir := filepath.Join(n.conf.ConfDir, nginxCertDir)
+	err := os.MkdirAll(certDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	old, err := n.readFiles()
+	if err != nil {
+		return err
+	}
+	for name := range old {
+		if _, ok := files[name]; !ok {
+			err = os.Remove(filepath.Join(n.conf.ConfDir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, content := range files {
+		err = os.WriteFile(filepath.Join(n.conf.ConfDir, name), content, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render returns upstream and server blocks of routes and certificate files
+// routes of the same host are rendered as locations of one server block
+func (n *NginxRouter) render() map[string][]byte {
+	files := make(map[string][]byte)
+	certs := make(map[string]string)
+	for id, ssl := range n.ssls {
+		name := safeName(id)
+		certs[id] = filepath.Join(n.conf.ConfDir, nginxCertDir, name)
+		files[filepath.Join(nginxCertDir, name+".crt")] = []byte(ssl.cert)
+		files[filepath.Join(nginxCertDir, name+".key")] = []byte(ssl.key)
+	}
+
+	ids := make([]string, 0, len(n.routes))
+	hostRoutes := make(map[string][]*nginxRoute)
+	for id, route := range n.routes {
+		ids = append(ids, id)
+		for _, host := range route.hosts {
+			hostRoutes[host] = append(hostRoutes[host], route)
+		}
+	}
+	sort.Strings(ids)
+	hosts := make([]string, 0, len(hostRoutes))
+	for host := range hostRoutes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# generated by zta gateway, do not edit\n")
+	for _, id := range ids {
+		route := n.routes[id]
+		fmt.Fprintf(buf, "\nupstream zta_%s {\n", safeName(id))
+		if route.leastConn {
+			fmt.Fprintf(buf, "    least_conn;\n")
+		}
+		nodes := make([]string, 0, len(route.nodes))
+		for node := range route.nodes {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			fmt.Fprintf(buf, "    server %s weight=%d;\n", node, route.nodes[node])
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+
+	for _, host := range hosts {
+		fmt.Fprintf(buf, "\nserver {\n")
+		fmt.Fprintf(buf, "    listen %s;\n", n.conf.Listen)
+		if cert := n.sslOf(host, certs); cert != "" {
+			fmt.Fprintf(buf, "    listen %s ssl;\n", n.conf.SSLListen)
+			fmt.Fprintf(buf, "    ssl_certificate %s.crt;\n", cert)
+			fmt.Fprintf(buf, "    ssl_certificate_key %s.key;\n", cert)
+		}
+		fmt.Fprintf(buf, "    server_name %s;\n", host)
+
+		routes := hostRoutes[host]
+		sort.Slice(routes, func(i, j int) bool {
+			return routes[i].id < routes[j].id
+		})
+		for _, route := range routes {
+			location := route.path
+			if !route.prefix {
+				location = "= " + route.path
+			}
+			fmt.Fprintf(buf, "\n    location %s {\n", location)
+			fmt.Fprintf(buf, "        proxy_pass http://zta_%s;\n", safeName(route.id))
+			fmt.Fprintf(buf, "        proxy_set_header Host $host;\n")
+			fmt.Fprintf(buf, "        proxy_set_header X-Real-IP $remote_addr;\n")
+			fmt.Fprintf(buf, "        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+			fmt.Fprintf(buf, "        proxy_set_header X-Forwarded-Proto $scheme;\n")
+			fmt.Fprintf(buf, "    }\n")
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+
+	files[nginxConfFile] = buf.Bytes()
+	return files
+}
+
+// sslOf returns the certificate path without extension of host
+// exact sni is preferred to wildcard, empty if none
+func (n *NginxRouter) sslOf(host string, certs map[string]string) string {
+	ids := make([]string, 0, len(n.ssls))
+	for id := range n.ssls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	wildcard := ""
+	for _, id := range ids {
+		for _, sni := range n.ssls[id].snis {
+			if sni == host {
+				return certs[id]
+			}
+			if wildcard == "" && wildcardMatch(sni, host) {
+				wildcard = certs[id]
+			}
+		}
+	}
+	return wildcard
+}
+
+// nginxSafe reports whether s can be rendered into nginx config unquoted
+func nginxSafe(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\r\n;{}\"'#$\\")
+}
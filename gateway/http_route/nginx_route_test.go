@@ -0,0 +1,73 @@
+package http_route
+
+import (
+	"encoding/json"
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNginxRouter(t *testing.T) {
+	convey.Convey("test nginx router", t, func() {
+		dir := t.TempDir()
+		router, err := NewNginxRoute(json.RawMessage(`{"conf_dir": "` + dir +
+			`", "test_cmd": "true", "reload_cmd": "true"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		readConf := func() string {
+			content, _ := os.ReadFile(filepath.Join(dir, nginxConfFile))
+			return string(content)
+		}
+
+		convey.So(router.UpdateRoute(testRoute("web", "/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("api", "/api/*", "a.example.com", "b.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web2", "/*", "A.example.com")), convey.ShouldNotBeNil)
+		convey.So(router.UpdateRoute(testRoute("any", "/*")), convey.ShouldNotBeNil)
+		convey.So(router.UpdateRoute(testRoute("bad", "/a;b", "a.example.com")), convey.ShouldNotBeNil)
+		convey.So(router.UpdateSSL("s1", "cert", "key", []string{"*.example.com"}), convey.ShouldBeNil)
+
+		conf := readConf()
+		convey.So(conf, convey.ShouldContainSubstring, "upstream zta_web {\n    server 127.0.0.1:10000 weight=1;")
+		convey.So(conf, convey.ShouldContainSubstring, "server_name a.example.com;")
+		convey.So(conf, convey.ShouldContainSubstring, "location /api/ {")
+		convey.So(strings.Count(conf, "proxy_pass http://zta_api;"), convey.ShouldEqual, 2)
+		convey.So(conf, convey.ShouldContainSubstring, "ssl_certificate "+filepath.Join(dir, "certs", "s1.crt")+";")
+		key, err := os.ReadFile(filepath.Join(dir, "certs", "s1.key"))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(key), convey.ShouldEqual, "key")
+
+		// files are rolled back if test fails
+		router.conf.TestCmd = "false"
+		convey.So(router.UpdateRoute(testRoute("web", "/web/*", "a.example.com")), convey.ShouldNotBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldNotBeNil)
+		convey.So(readConf(), convey.ShouldEqual, conf)
+		_, err = os.Stat(filepath.Join(dir, "certs", "s1.crt"))
+		convey.So(err, convey.ShouldBeNil)
+		routes, _ := router.ListRoutes()
+		convey.So(routes["web"]["uri"], convey.ShouldEqual, "/*")
+
+		router.conf.TestCmd = "true"
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		convey.So(router.DeleteRoute("api"), convey.ShouldBeNil)
+		convey.So(router.DeleteRoute("api"), convey.ShouldBeNil)
+		conf = readConf()
+		convey.So(conf, convey.ShouldNotContainSubstring, "ssl_certificate")
+		convey.So(conf, convey.ShouldNotContainSubstring, "zta_api")
+		_, err = os.Stat(filepath.Join(dir, "certs", "s1.crt"))
+		convey.So(os.IsNotExist(err), convey.ShouldBeTrue)
+
+		// ids of the same safe name keep their own files
+		convey.So(router.UpdateSSL("a/b", "cert1", "key1", []string{"a.example.com"}), convey.ShouldBeNil)
+		convey.So(router.UpdateSSL("a_b", "cert2", "key2", []string{"b.example.com"}), convey.ShouldBeNil)
+		files, _ := filepath.Glob(filepath.Join(dir, "certs", "*.key"))
+		convey.So(len(files), convey.ShouldEqual, 2)
+		keys := make(map[string]bool)
+		for _, file := range files {
+			key, _ := os.ReadFile(file)
+			keys[string(key)] = true
+		}
+		convey.So(keys["key1"] && keys["key2"], convey.ShouldBeTrue)
+	})
+}
@@ -0,0 +1,164 @@
+package http_route
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// routeMatch is the apisix compatible match of route param
+// it is shared by routes other than apisix
+type routeMatch struct {
+	id string
+	// lower case, "*.example.com" matches subdomains, empty matches any host
+	hosts []string
+	// path is a prefix if prefix, otherwise the exact path
+	path   string
+	prefix bool
+}
+
+// parseRouteMatch parses {"id", "uri", "hosts"} of param, or "host" for a single host
+// uri is the exact path, or a prefix if it ends with "*", default "/*"
+func parseRouteMatch(param map[string]interface{}) (*routeMatch, error) {
+	id, _ := param["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("route id is required")
+	}
+
+	// param may be decoded from json or built by gateway
+	var fields struct {
+		URI   string   `json:"uri"`
+		Host  string   `json:"host"`
+		Hosts []string `json:"hosts"`
+	}
+	content, err := json.Marshal(param)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %v", id, err)
+	}
+
+	m := &routeMatch{id: id, path: fields.URI}
+	if m.path == "" {
+		m.path = "/*"
+	}
+	if !strings.HasPrefix(m.path, "/") {
+		return nil, fmt.Errorf("route %s: invalid uri %s", id, m.path)
+	}
+	if strings.HasSuffix(m.path, "*") {
+		m.path = strings.TrimSuffix(m.path, "*")
+		m.prefix = true
+	}
+
+	if fields.Host != "" {
+		fields.Hosts = append(fields.Hosts, fields.Host)
+	}
+	for _, host := range fields.Hosts {
+		m.hosts = append(m.hosts, strings.ToLower(host))
+	}
+	return m, nil
+}
+
+// routeUpstream is the inline upstream of apisix route
+type routeUpstream struct {
+	Type string `json:"type"`
+	// address -> weight
+	Nodes map[string]int `json:"nodes"`
+}
+
+// parseRouteUpstream parses param["upstream"] of route id, nodes are required
+func parseRouteUpstream(id string, param map[string]interface{}) (*routeUpstream, error) {
+	var fields struct {
+		Upstream routeUpstream `json:"upstream"`
+	}
+	content, err := json.Marshal(param)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %v", id, err)
+	}
+	if len(fields.Upstream.Nodes) == 0 {
+		return nil, fmt.Errorf("route %s: upstream nodes are required", id)
+	}
+	return &fields.Upstream, nil
+}
+
+// conflicts reports whether m and other share a host and the same path
+func (m *routeMatch) conflicts(other *routeMatch) bool {
+	if m.path != other.path || m.prefix != other.prefix {
+		return false
+	}
+	if len(m.hosts) == 0 || len(other.hosts) == 0 {
+		return len(m.hosts) == len(other.hosts)
+	}
+	for _, host := range m.hosts {
+		for _, otherHost := range other.hosts {
+			if host == otherHost {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostRank is 2 if m has exact host, 1 if wildcard hosts only, 0 if any host
+func (m *routeMatch) hostRank() int {
+	rank := 0
+	for _, host := range m.hosts {
+		if !strings.HasPrefix(host, "*.") {
+			return 2
+		}
+		rank = 1
+	}
+	return rank
+}
+
+// safeName converts id to a name of upstream, file, etc
+// hash of id is appended if id has '_' or any char is replaced,
+// so "a/b" and "a_b" never share a name
+func safeName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+	if name == id && !strings.Contains(id, "_") {
+		return name
+	}
+	sum := sha256.Sum256([]byte(id))
+	return name + "_" + hex.EncodeToString(sum[:8])
+}
+
+// hostname strips port and lowers host
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// lowerSNIs returns snis in lower case, sni matching is case insensitive
+func lowerSNIs(snis []string) []string {
+	lower := make([]string, 0, len(snis))
+	for _, sni := range snis {
+		lower = append(lower, strings.ToLower(sni))
+	}
+	return lower
+}
+
+// wildcardMatch matches "*.example.com" with subdomains of example.com
+func wildcardMatch(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+}
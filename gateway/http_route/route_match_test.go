@@ -0,0 +1,14 @@
+package http_route
+
+// testRoute returns http_param of a route to a single node
+func testRoute(id, uri string, hosts ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":    id,
+		"uri":   uri,
+		"hosts": hosts,
+		"upstream": map[string]interface{}{
+			"type":  "roundrobin",
+			"nodes": map[string]interface{}{"127.0.0.1:10000": 1},
+		},
+	}
+}
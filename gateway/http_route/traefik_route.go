@@ -0,0 +1,325 @@
+package http_route
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/gometalinter/_linters/src/gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var _ HTTPRoute = &TraefikRouter{}
+
+type TraefikConfig struct {
+	// dynamic config file watched by the file provider of traefik
+	File string `json:"file"`
+	// default ["web"] and ["websecure"], empty disables the routers
+	EntryPoints    []string `json:"entry_points"`
+	TLSEntryPoints []string `json:"tls_entry_points"`
+	// optional, certificate resolver of traefik for hosts without certificate of ssl
+	CertResolver string `json:"cert_resolver"`
+	// major version of traefik, 2 or 3, default 3
+	Version int `json:"version"`
+}
+
+// traefikRoute is the route param, compatible with apisix route
+// eg: {"id", "uri": "/*", "hosts", "upstream": {"nodes": {"127.0.0.1:10002": 1}}}
+type traefikRoute struct {
+	*routeMatch
+	param    map[string]interface{}
+	upstream *routeUpstream
+}
+
+type traefikSSL struct {
+	cert string
+	key  string
+	snis []string
+}
+
+// TraefikRouter writes routers, services and certificates of tls store
+// into the dynamic config file of traefik on every change
+// certificates are inline, traefik selects them by sni
+type TraefikRouter struct {
+	conf *TraefikConfig
+	// mu also serializes writing the file
+	mu     sync.Mutex
+	routes map[string]*traefikRoute
+	ssls   map[string]*traefikSSL
+}
+
+func NewTraefikRoute(conf json.RawMessage) (*TraefikRouter, error) {
+	traefikConf := &TraefikConfig{}
+	err := json.Unmarshal(conf, traefikConf)
+	if err != nil {
+		return nil, err
+	}
+	if traefikConf.File == "" {
+		return nil, fmt.Errorf("file is required")
+	}
+	if traefikConf.EntryPoints == nil {
+		traefikConf.EntryPoints = []string{"web"}
+	}
+	if traefikConf.TLSEntryPoints == nil {
+		traefikConf.TLSEntryPoints = []string{"websecure"}
+	}
+	switch traefikConf.Version {
+	case 0:
+		traefikConf.Version = 3
+	case 2, 3:
+	default:
+		return nil, fmt.Errorf("traefik version %d is not supported", traefikConf.Version)
+	}
+
+	return &TraefikRouter{
+		conf:   traefikConf,
+		routes: make(map[string]*traefikRoute),
+		ssls:   make(map[string]*traefikSSL),
+	}, nil
+}
+
+func (t *TraefikRouter) UpdateSSL(id, cert, key string, snis []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.ssls[id]
+	t.ssls[id] = &traefikSSL{cert: cert, key: key, snis: lowerSNIs(snis)}
+	err := t.write()
+	if err != nil {
+		if ok {
+			t.ssls[id] = old
+		} else {
+			delete(t.ssls, id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *TraefikRouter) DeleteSSL(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.ssls[id]
+	if !ok {
+		return nil
+	}
+	delete(t.ssls, id)
+	err := t.write()
+	if err != nil {
+		t.ssls[id] = old
+		return err
+	}
+	return nil
+}
+
+func (t *TraefikRouter) ListSSLs() (map[string]map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ssls := make(map[string]map[string]interface{})
+	for id, ssl := range t.ssls {
+		ssls[id] = map[string]interface{}{
+			"id":   id,
+			"snis": ssl.snis,
+		}
+	}
+	return ssls, nil
+}
+
+// UpdateRoute adds or replaces route of param["id"]
+// a route of the same hosts and uri as another one is rejected
+func (t *TraefikRouter) UpdateRoute(param map[string]interface{}) error {
+	match, err := parseRouteMatch(param)
+	if err != nil {
+		return err
+	}
+	for _, value := range append([]string{match.path}, match.hosts...) {
+		if strings.Contains(value, "`") {
+			return fmt.Errorf("route %s: invalid %q", match.id, value)
+		}
+	}
+	upstream, err := parseRouteUpstream(match.id, param)
+	if err != nil {
+		return err
+	}
+	route := &traefikRoute{routeMatch: match, param: param, upstream: upstream}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, other := range t.routes {
+		if id != route.id && route.conflicts(other.routeMatch) {
+			return fmt.Errorf("route %s conflicts with route %s", route.id, id)
+		}
+	}
+
+	old, ok := t.routes[route.id]
+	t.routes[route.id] = route
+	err = t.write()
+	if err != nil {
+		if ok {
+			t.routes[route.id] = old
+		} else {
+			delete(t.routes, route.id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *TraefikRouter) DeleteRoute(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.routes[id]
+	if !ok {
+		return nil
+	}
+	delete(t.routes, id)
+	err := t.write()
+	if err != nil {
+		t.routes[id] = old
+		return err
+	}
+	return nil
+}
+
+func (t *TraefikRouter) ListRoutes() (map[string]map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := make(map[string]map[string]interface{})
+	for id, route := range t.routes {
+		routes[id] = route.param
+	}
+	return routes, nil
+}
+
+// write replaces the dynamic config file by rename
+// so traefik never reads it half written
+func (t *TraefikRouter) write() error {
+	content, err := yaml.Marshal(t.render())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.conf.File), "."+filepath.Base(t.conf.File)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append([]byte("# generated by zta gateway, do not edit\n"), content...))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.conf.File)
+}
+
+// render returns the dynamic config
+// routers of a route are named zta_<id> and zta_<id>_tls, the service is named zta_<id>
+func (t *TraefikRouter) render() map[string]interface{} {
+	routers := make(map[string]interface{})
+	services := make(map[string]interface{})
+	for id, route := range t.routes {
+		name := "zta_" + safeName(id)
+		rule := route.rule(t.conf.Version)
+		// more specific routes first
+		// exact host is preferred to wildcard host, then the longest path
+		priority := route.hostRank()*100000 + len(route.path)*2
+		if !route.prefix {
+			priority++
+		}
+
+		if len(t.conf.EntryPoints) > 0 {
+			routers[name] = map[string]interface{}{
+				"rule":        rule,
+				"priority":    priority,
+				"service":     name,
+				"entryPoints": t.conf.EntryPoints,
+			}
+		}
+		if len(t.conf.TLSEntryPoints) > 0 {
+			tls := map[string]interface{}{}
+			if t.conf.CertResolver != "" {
+				tls["certResolver"] = t.conf.CertResolver
+			}
+			routers[name+"_tls"] = map[string]interface{}{
+				"rule":        rule,
+				"priority":    priority,
+				"service":     name,
+				"entryPoints": t.conf.TLSEntryPoints,
+				"tls":         tls,
+			}
+		}
+
+		nodes := make([]string, 0, len(route.upstream.Nodes))
+		for node := range route.upstream.Nodes {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		servers := make([]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			servers = append(servers, map[string]interface{}{"url": "http://" + node})
+		}
+		services[name] = map[string]interface{}{
+			"loadBalancer": map[string]interface{}{"servers": servers},
+		}
+	}
+
+	ids := make([]string, 0, len(t.ssls))
+	for id := range t.ssls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	certificates := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		ssl := t.ssls[id]
+		certificates = append(certificates, map[string]interface{}{
+			"certFile": ssl.cert,
+			"keyFile":  ssl.key,
+			"stores":   []string{"default"},
+		})
+	}
+
+	config := make(map[string]interface{})
+	if len(routers) > 0 {
+		config["http"] = map[string]interface{}{
+			"routers":  routers,
+			"services": services,
+		}
+	}
+	if len(certificates) > 0 {
+		config["tls"] = map[string]interface{}{"certificates": certificates}
+	}
+	return config
+}
+
+// rule returns the rule of traefik router
+// wildcard host matches one level of subdomain
+func (r *traefikRoute) rule(version int) string {
+	hosts := make([]string, 0, len(r.hosts))
+	for _, host := range r.hosts {
+		if !strings.HasPrefix(host, "*.") {
+			hosts = append(hosts, fmt.Sprintf("Host(`%s`)", host))
+			continue
+		}
+		if version == 2 {
+			hosts = append(hosts, fmt.Sprintf("HostRegexp(`{subdomain:[a-z0-9-]+}.%s`)", host[2:]))
+		} else {
+			hosts = append(hosts, fmt.Sprintf("HostRegexp(`^[a-z0-9-]+\\.%s$`)", regexp.QuoteMeta(host[2:])))
+		}
+	}
+
+	rules := make([]string, 0, 2)
+	if len(hosts) > 0 {
+		rules = append(rules, "("+strings.Join(hosts, " || ")+")")
+	}
+	if !r.prefix {
+		rules = append(rules, fmt.Sprintf("Path(`%s`)", r.path))
+	} else if r.path != "/" || len(rules) == 0 {
+		rules = append(rules, fmt.Sprintf("PathPrefix(`%s`)", r.path))
+	}
+	return strings.Join(rules, " && ")
+}
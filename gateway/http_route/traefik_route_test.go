@@ -0,0 +1,74 @@
+package http_route
+
+import (
+	"encoding/json"
+	"github.com/alecthomas/gometalinter/_linters/src/gopkg.in/yaml.v2"
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraefikRouter(t *testing.T) {
+	convey.Convey("test traefik router", t, func() {
+		file := filepath.Join(t.TempDir(), "zta.yaml")
+		router, err := NewTraefikRoute(json.RawMessage(`{"file": "` + file + `", "cert_resolver": "le"}`))
+		convey.So(err, convey.ShouldBeNil)
+
+		load := func() map[interface{}]interface{} {
+			content, err := os.ReadFile(file)
+			convey.So(err, convey.ShouldBeNil)
+			config := make(map[interface{}]interface{})
+			convey.So(yaml.Unmarshal(content, &config), convey.ShouldBeNil)
+			return config
+		}
+		routerOf := func(config map[interface{}]interface{}, name string) map[interface{}]interface{} {
+			routers := config["http"].(map[interface{}]interface{})["routers"].(map[interface{}]interface{})
+			r, _ := routers[name].(map[interface{}]interface{})
+			return r
+		}
+
+		convey.So(router.UpdateRoute(testRoute("web", "/*", "a.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("api", "/api/*", "*.example.com")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("health", "/health")), convey.ShouldBeNil)
+		convey.So(router.UpdateRoute(testRoute("web2", "/*", "a.example.com")), convey.ShouldNotBeNil)
+		convey.So(router.UpdateRoute(testRoute("bad", "/`", "a.example.com")), convey.ShouldNotBeNil)
+
+		config := load()
+		web := routerOf(config, "zta_web")
+		convey.So(web["rule"], convey.ShouldEqual, "(Host(`a.example.com`))")
+		api := routerOf(config, "zta_api")
+		convey.So(api["rule"], convey.ShouldEqual, "(HostRegexp(`^[a-z0-9-]+\\.example\\.com$`)) && PathPrefix(`/api/`)")
+		health := routerOf(config, "zta_health")
+		convey.So(health["rule"], convey.ShouldEqual, "Path(`/health`)")
+		// exact host first, then the longest path
+		convey.So(web["priority"], convey.ShouldBeGreaterThan, api["priority"])
+		convey.So(api["priority"], convey.ShouldBeGreaterThan, health["priority"])
+
+		tlsRouter := routerOf(config, "zta_web_tls")
+		convey.So(tlsRouter["entryPoints"], convey.ShouldResemble, []interface{}{"websecure"})
+		convey.So(tlsRouter["tls"], convey.ShouldResemble, map[interface{}]interface{}{"certResolver": "le"})
+
+		convey.So(router.UpdateSSL("s1", "cert", "key", []string{"A.example.com"}), convey.ShouldBeNil)
+		ssls, _ := router.ListSSLs()
+		convey.So(ssls["s1"]["snis"], convey.ShouldResemble, []string{"a.example.com"})
+		certificates := load()["tls"].(map[interface{}]interface{})["certificates"].([]interface{})
+		convey.So(len(certificates), convey.ShouldEqual, 1)
+		convey.So(certificates[0].(map[interface{}]interface{})["certFile"], convey.ShouldEqual, "cert")
+
+		convey.So(router.DeleteRoute("web"), convey.ShouldBeNil)
+		convey.So(router.DeleteSSL("s1"), convey.ShouldBeNil)
+		config = load()
+		convey.So(routerOf(config, "zta_web"), convey.ShouldBeNil)
+		convey.So(config["tls"], convey.ShouldBeNil)
+
+		// file is unchanged if it can not be written
+		router.conf.File = filepath.Join(file, "invalid")
+		convey.So(router.UpdateRoute(testRoute("web", "/*", "a.example.com")), convey.ShouldNotBeNil)
+		routes, _ := router.ListRoutes()
+		convey.So(len(routes), convey.ShouldEqual, 2)
+
+		_, err = NewTraefikRoute(json.RawMessage(`{"file": "` + file + `", "version": 1}`))
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/ICKelin/zta/common"
+	"github.com/xtaci/kcp-go/v5"
+	"net"
+)
+
+// listenKCP listens tunnel over kcp for clients on lossy links
+func (gw *Gateway) listenKCP() (*kcp.Listener, error) {
+	return common.ListenKCP(gw.conf.KCP.ListenAddr, &gw.conf.KCP.KCPConfig)
+}
+
+// serveKCP serves kcp sessions as tcp connections, with tls if configured
+func (gw *Gateway) serveKCP(listener *kcp.Listener) error {
+	defer listener.Close()
+
+	var tlsConfig *tls.Config
+	if gw.conf.TLS != nil {
+		var err error
+		tlsConfig, err = newTLSConfig(gw.conf.TLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		sess, err := listener.AcceptKCP()
+		if err != nil {
+			return err
+		}
+		gw.conf.KCP.Apply(sess)
+
+		var conn net.Conn = sess
+		if tlsConfig != nil {
+			conn = tls.Server(sess, tlsConfig)
+		}
+		go gw.handleConn(conn, TransportKCP)
+	}
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"fmt"
 	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
 	"github.com/ICKelin/zta/gateway/http_route"
 	"github.com/astaxie/beego/logs"
 	"io"
 	"net"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
 
 var (
 	writeTimeout = time.Second * 3
+	// wait for client dialing internal address
+	streamReplyTimeout = time.Second * 10
 )
 
 type udpSession struct {
@@ -50,7 +55,7 @@ func (mgr *udpSessionManager) Set(remoteAddr, localAddr string, tunnelConn net.C
 		tunnelConn: tunnelConn,
 		activeAt:   time.Now(),
 	}
-	mgr.sessions[localAddr] = sess
+	mgr.sessions[remoteAddr] = sess
 }
 
 func (mgr *udpSessionManager) Del(key string) {
@@ -59,6 +64,12 @@ func (mgr *udpSessionManager) Del(key string) {
 	delete(mgr.sessions, key)
 }
 
+func (mgr *udpSessionManager) Len() int {
+	mgr.sessionsMu.Lock()
+	defer mgr.sessionsMu.Unlock()
+	return len(mgr.sessions)
+}
+
 func (mgr *udpSessionManager) Range(f func(k string, value *udpSession) bool) {
 	mgr.sessionsMu.Lock()
 	defer mgr.sessionsMu.Unlock()
@@ -71,12 +82,63 @@ func (mgr *udpSessionManager) Range(f func(k string, value *udpSession) bool) {
 }
 
 type ListenerManager struct {
+	sessionMgr  *SessionManager
 	listenersMu sync.Mutex
 	listeners   map[string]*Listener
 }
 
-func NewListenerManager() *ListenerManager {
-	return &ListenerManager{listeners: make(map[string]*Listener)}
+func NewListenerManager(sessionMgr *SessionManager) *ListenerManager {
+	return &ListenerManager{
+		sessionMgr: sessionMgr,
+		listeners:  make(map[string]*Listener),
+	}
+}
+
+// ApplyListener creates listener of conf or replaces the one of conf.ID
+// nothing is changed if the configuration is the same
+// the old listener keeps serving if the new one fails to listen
+func (mgr *ListenerManager) ApplyListener(conf *ListenerConfig) error {
+	mgr.listenersMu.Lock()
+	defer mgr.listenersMu.Unlock()
+
+	old := mgr.listeners[conf.ID]
+	if old != nil {
+		if reflect.DeepEqual(old.listenerConfig, conf) {
+			return nil
+		}
+		logs.Info("update listener %+v", conf)
+		// the new listener may bind the same address
+		// tcp address is released at once, connections in progress are drained
+		// udp address is shared by its flows, so they are dropped
+		if old.listenerConfig.PublicProtocol == "udp" {
+			old.Close()
+		} else {
+			old.Shutdown(mgr.sessionMgr.drainTimeout)
+		}
+		delete(mgr.listeners, conf.ID)
+	} else {
+		logs.Info("add listener %+v", conf)
+	}
+
+	l := NewListener(conf, mgr.sessionMgr)
+	err := l.Listen()
+	if err != nil {
+		if old != nil {
+			restore := NewListener(old.listenerConfig, mgr.sessionMgr)
+			restoreErr := restore.Listen()
+			if restoreErr != nil {
+				logs.Error("restore listener %s fail: %v", conf.ID, restoreErr)
+			} else {
+				mgr.listeners[conf.ID] = restore
+				go restore.Serve()
+			}
+		}
+		return err
+	}
+
+	mgr.listeners[conf.ID] = l
+	go l.Serve()
+	return nil
 }
 
 func (mgr *ListenerManager) AddListener(id string, l *Listener) {
@@ -85,77 +147,211 @@ func (mgr *ListenerManager) AddListener(id string, l *Listener) {
 	mgr.listeners[id] = l
 }
 
+// RemoveListener closes listener id only if it is still l
+// listener id may be replaced by a newer one
+// the listener is closed without lock, deleting its http route may be slow
+func (mgr *ListenerManager) RemoveListener(id string, l *Listener) {
+	mgr.listenersMu.Lock()
+	if mgr.listeners[id] != l {
+		mgr.listenersMu.Unlock()
+		return
+	}
+	delete(mgr.listeners, id)
+	mgr.listenersMu.Unlock()
+	l.Close()
+}
+
+// CloseListener stops listener id accepting
+// connections in progress are drained in background
 func (mgr *ListenerManager) CloseListener(id string) {
 	mgr.listenersMu.Lock()
-	defer mgr.listenersMu.Unlock()
 	l := mgr.listeners[id]
+	delete(mgr.listeners, id)
+	mgr.listenersMu.Unlock()
 	if l != nil {
-		l.Close()
-		delete(mgr.listeners, id)
+		l.Shutdown(mgr.sessionMgr.drainTimeout)
 	}
 }
 
+// Shutdown stops all listeners accepting
+// and waits for their connections up to timeout
+func (mgr *ListenerManager) Shutdown(timeout time.Duration) {
+	mgr.listenersMu.Lock()
+	listeners := mgr.listeners
+	mgr.listeners = make(map[string]*Listener)
+	mgr.listenersMu.Unlock()
+
+	done := make([]<-chan struct{}, 0, len(listeners))
+	for _, l := range listeners {
+		done = append(done, l.Shutdown(timeout))
+	}
+	for _, d := range done {
+		<-d
+	}
+}
+
+func (mgr *ListenerManager) GetListener(id string) *Listener {
+	mgr.listenersMu.Lock()
+	defer mgr.listenersMu.Unlock()
+	return mgr.listeners[id]
+}
+
+// Listeners returns all listeners sorted by id
+func (mgr *ListenerManager) Listeners() []*Listener {
+	mgr.listenersMu.Lock()
+	defer mgr.listenersMu.Unlock()
+	listeners := make([]*Listener, 0, len(mgr.listeners))
+	for _, l := range mgr.listeners {
+		listeners = append(listeners, l)
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].listenerConfig.ID < listeners[j].listenerConfig.ID
+	})
+	return listeners
+}
+
 type Listener struct {
-	listenerConfig    *ListenerConfig
-	sessionMgr        *SessionManager
+	listenerConfig *ListenerConfig
+	compressStats  *common.CompressStats
+	sessionMgr     *SessionManager
+	// http route rule is created by the listener
+	routed bool
+	// closed when the listener stops accepting
+	stopOnce          sync.Once
+	stopped           chan struct{}
 	closeOnce         sync.Once
 	close             chan struct{}
 	tcpListener       net.Listener
 	udpListener       *net.UDPConn
 	udpSessionManager *udpSessionManager
+	// tcp connections in progress
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
 }
 
 func NewListener(listenerConfig *ListenerConfig,
 	sessionMgr *SessionManager) *Listener {
 	return &Listener{
 		listenerConfig:    listenerConfig,
+		compressStats:     &common.CompressStats{},
+		stopped:           make(chan struct{}),
 		close:             make(chan struct{}),
+		conns:             make(map[net.Conn]struct{}),
 		sessionMgr:        sessionMgr,
 		udpSessionManager: newUDPSessionManager(),
 	}
 }
 
 func (l *Listener) ListenAndServe() error {
+	err := l.Listen()
+	if err != nil {
+		return err
+	}
+	return l.Serve()
+}
+
+// Listen binds the public address, so address conflicts are reported
+// before serving
+func (l *Listener) Listen() error {
 	switch l.listenerConfig.PublicProtocol {
 	case "http", "https":
-		return l.listenAndServeHTTP()
+		return l.listenHTTP()
 	case "tcp":
-		return l.listenAndServeTCP()
+		return l.listenTCP()
 	case "udp":
-		return l.listenAndServeUDP()
+		return l.listenUDP()
 	default:
 		return fmt.Errorf("TODO://")
 	}
 }
 
-func (l *Listener) listenAndServeHTTP() error {
+// Serve serves the public connections until the listener is closed
+func (l *Listener) Serve() error {
+	switch l.listenerConfig.PublicProtocol {
+	case "http", "https", "tcp":
+		return l.serveTCP()
+	case "udp":
+		return l.serveUDP()
+	default:
+		return fmt.Errorf("TODO://")
+	}
+}
+
+func (l *Listener) listenHTTP() error {
 	route := http_route.GetRoute(l.listenerConfig.HTTPRouteType)
 	if route == nil {
 		return fmt.Errorf("route %s is not initialize",
 			l.listenerConfig.HTTPRouteType)
 	}
 
+	// listening tcp for http(s) before the route points to it
+	// stream routes proxy requests into streams, no address is listened
+	if _, ok := route.(http_route.StreamRoute); !ok {
+		err := l.listenTCP()
+		if err != nil {
+			return err
+		}
+	}
+
 	// update http_route rule
-	err := route.UpdateRoute(l.listenerConfig.HTTPParam)
+	err := l.updateRoute(route)
 	if err != nil {
+		if l.tcpListener != nil {
+			l.tcpListener.Close()
+		}
 		return err
 	}
+	l.routed = true
+	return nil
+}
 
-	// listening and serve tcp for http(s)
-	return l.listenAndServeTCP()
+// updateRoute updates http_route rule of the listener to route
+func (l *Listener) updateRoute(route http_route.HTTPRoute) error {
+	if streamRoute, ok := route.(http_route.StreamRoute); ok {
+		return streamRoute.UpdateStreamRoute(l.listenerConfig.HTTPParam, l.dial)
+	}
+	return route.UpdateRoute(l.listenerConfig.HTTPParam)
 }
 
-func (l *Listener) listenAndServeTCP() error {
+// deleteRoute deletes http_route rule created by the listener
+func (l *Listener) deleteRoute() {
+	conf := l.listenerConfig
+	id, _ := conf.HTTPParam["id"].(string)
+	if id == "" {
+		logs.Warn("listener %s http route rule has no id, it is kept", conf.ID)
+		return
+	}
+
+	route := http_route.GetRoute(conf.HTTPRouteType)
+	if route == nil {
+		return
+	}
+	err := route.DeleteRoute(id)
+	if err != nil {
+		logs.Error("listener %s delete http route rule %s fail: %v", conf.ID, id, err)
+		return
+	}
+	logs.Info("listener %s delete http route rule %s", conf.ID, id)
+}
+
+func (l *Listener) listenTCP() error {
 	listenAddr := fmt.Sprintf("%s:%d", l.listenerConfig.PublicIP, l.listenerConfig.PublicPort)
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
 	l.tcpListener = listener
+	return nil
+}
 
+func (l *Listener) serveTCP() error {
+	// http listener of stream route
+	if l.tcpListener == nil {
+		return nil
+	}
+	defer l.tcpListener.Close()
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.tcpListener.Accept()
 		if err != nil {
 			return err
 		}
@@ -164,7 +360,7 @@ func (l *Listener) listenAndServeTCP() error {
 	}
 }
 
-func (l *Listener) listenAndServeUDP() error {
+func (l *Listener) listenUDP() error {
 	listenAddr := fmt.Sprintf("%s:%d", l.listenerConfig.PublicIP, l.listenerConfig.PublicPort)
 	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
@@ -174,14 +370,25 @@ func (l *Listener) listenAndServeUDP() error {
 	if err != nil {
 		return err
 	}
+	l.udpListener = listener
+	return nil
+}
+
+func (l *Listener) serveUDP() error {
+	listener := l.udpListener
 	defer listener.Close()
 
-	l.udpListener = listener
 	go func() {
 		tick := time.NewTicker(time.Second * 10)
 		defer tick.Stop()
 
-		for range tick.C {
+		for {
+			select {
+			case <-l.close:
+				return
+			case <-tick.C:
+			}
+
 			l.udpSessionManager.Range(func(k string, value *udpSession) bool {
 				if value.activeAt.Add(time.Second * 30).Before(time.Now()) {
 					logs.Debug("session %s is expired, last active %d",
@@ -209,81 +416,142 @@ func (l *Listener) listenAndServeUDP() error {
 func (l *Listener) handleTCPConn(conn net.Conn) {
 	defer conn.Close()
 
-	// get session for clientID
-	tunnelConn, err := l.sessionMgr.GetSessionByClientID(l.listenerConfig.ClientID)
+	l.connsMu.Lock()
+	l.conns[conn] = struct{}{}
+	l.connsMu.Unlock()
+	defer func() {
+		l.connsMu.Lock()
+		delete(l.conns, conn)
+		l.connsMu.Unlock()
+	}()
+
+	tunnelConn, reply, err := l.openStream(conn.RemoteAddr().String())
 	if err != nil {
-		logs.Warn("get session for client %s fail", l.listenerConfig.ClientID)
+		logs.Warn("listener %s open stream for %s fail: %v",
+			l.listenerConfig.ID, conn.RemoteAddr(), err)
 		return
 	}
 	defer tunnelConn.Close()
 
+	// copy from and copy to .
+	go func() {
+		defer tunnelConn.Close()
+		defer conn.Close()
+		io.Copy(tunnelConn, conn)
+	}()
+	io.Copy(conn, tunnelConn)
+
+	if reply.Compression != "" {
+		raw, wire, ratio := l.CompressStats()
+		logs.Debug("listener %s %s compressed %d bytes to %d, ratio %.2f",
+			l.listenerConfig.ID, reply.Compression, raw, wire, ratio)
+	}
+}
+
+// openStream opens a stream to the internal address for visitorAddr
+// the stream is compressed if client accepts the compression of listener
+func (l *Listener) openStream(visitorAddr string) (net.Conn, *common.StreamReply, error) {
+	// get session for clientID
+	tunnelConn, err := l.sessionMgr.GetSessionByClientID(l.listenerConfig.ClientID,
+		l.listenerConfig.LoadBalance, visitorAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get session for client %s fail: %v", l.listenerConfig.ClientID, err)
+	}
+
 	// encode and send pp to client
-	pp := &common.ProxyProtocol{
-		ClientID:         l.listenerConfig.ClientID,
-		PublicProtocol:   l.listenerConfig.PublicProtocol,
-		PublicIP:         l.listenerConfig.PublicIP,
-		PublicPort:       l.listenerConfig.PublicPort,
-		InternalProtocol: l.listenerConfig.InternalProtocol,
-		InternalIP:       l.listenerConfig.InternalIP,
-		InternalPort:     l.listenerConfig.InternalPort,
+	err = l.writeProxyProtocol(tunnelConn)
+	if err != nil {
+		tunnelConn.Close()
+		return nil, nil, fmt.Errorf("write proxy protocol fail: %v", err)
 	}
-	ppBody, err := pp.Encode()
+
+	// close public connection right away if client can't reach internal address
+	reply, err := l.readStreamReply(tunnelConn)
 	if err != nil {
-		logs.Warn("encode listenerConfig fail: %v ", err)
-		return
+		tunnelConn.Close()
+		return nil, nil, fmt.Errorf("client %s: %v", l.listenerConfig.ClientID, err)
 	}
 
-	tunnelConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	_, err = tunnelConn.Write(ppBody)
-	tunnelConn.SetWriteDeadline(time.Time{})
+	// client accepts the compression of listener or replies none
+	if reply.Compression != "" && reply.Compression != l.listenerConfig.Compression {
+		tunnelConn.Close()
+		return nil, nil, fmt.Errorf("client %s: compression %s is not configured",
+			l.listenerConfig.ClientID, reply.Compression)
+	}
+	if reply.Compression != "" {
+		compressed, err := common.Compress(tunnelConn, reply.Compression, l.compressStats)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, nil, fmt.Errorf("compress stream fail: %v", err)
+		}
+		tunnelConn = compressed
+	}
+	return tunnelConn, reply, nil
+}
+
+// streamConn is a stream opened by http route
+// it is tracked as connection in progress of the listener until closed
+type streamConn struct {
+	net.Conn
+	l         *Listener
+	closeOnce sync.Once
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.l.connsMu.Lock()
+		delete(c.l.conns, c)
+		c.l.connsMu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// dial opens a stream for http routes proxying requests into streams
+func (l *Listener) dial(visitorAddr string) (net.Conn, error) {
+	select {
+	case <-l.stopped:
+		return nil, fmt.Errorf("listener %s is closed", l.listenerConfig.ID)
+	default:
+	}
+
+	tunnelConn, _, err := l.openStream(visitorAddr)
 	if err != nil {
-		logs.Warn("write listenerConfig body fail: %v", err)
-		return
+		return nil, err
 	}
 
-	// copy from and copy to .
-	go func() {
-		defer tunnelConn.Close()
-		defer conn.Close()
-		io.Copy(tunnelConn, conn)
-	}()
-	io.Copy(conn, tunnelConn)
+	conn := &streamConn{Conn: tunnelConn, l: l}
+	l.connsMu.Lock()
+	l.conns[conn] = struct{}{}
+	l.connsMu.Unlock()
+	return conn, nil
 }
 
 func (l *Listener) handleUDPMsg(listener *net.UDPConn, raddr *net.UDPAddr, buffer []byte) {
 	udpSess := l.udpSessionManager.Get(raddr.String())
 	if udpSess == nil {
+		// no new flow after the listener stops accepting
+		select {
+		case <-l.stopped:
+			return
+		default:
+		}
+
 		// for the first packet
 		// 1、encode proxy protocol and send to zta client via tunnel connection
 		// 2、create udp session like iptables connection tracking to record udp info
 		// 3、bootstrap a goroutine to handle msg from client via tunnel connection
-		tunnelConn, err := l.sessionMgr.GetSessionByClientID(l.listenerConfig.ClientID)
+		tunnelConn, err := l.sessionMgr.GetSessionByClientID(l.listenerConfig.ClientID,
+			l.listenerConfig.LoadBalance, raddr.String())
 		if err != nil {
-			logs.Warn("get session for client %s fail", l.listenerConfig.ClientID)
+			logs.Warn("get session for client %s fail: %v", l.listenerConfig.ClientID, err)
 			return
 		}
 
 		// 1、encode proxy protocol and send to zta client via tunnel connection
-		pp := &common.ProxyProtocol{
-			ClientID:         l.listenerConfig.ClientID,
-			PublicProtocol:   l.listenerConfig.PublicProtocol,
-			PublicIP:         l.listenerConfig.PublicIP,
-			PublicPort:       l.listenerConfig.PublicPort,
-			InternalProtocol: l.listenerConfig.InternalProtocol,
-			InternalIP:       l.listenerConfig.InternalIP,
-			InternalPort:     l.listenerConfig.InternalPort,
-		}
-		ppBody, err := pp.Encode()
-		if err != nil {
-			logs.Warn("encode listenerConfig fail: %v ", err)
-			return
-		}
-
-		tunnelConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-		_, err = tunnelConn.Write(ppBody)
-		tunnelConn.SetWriteDeadline(time.Time{})
+		err = l.writeProxyProtocol(tunnelConn)
 		if err != nil {
 			logs.Warn("write listenerConfig body fail: %v", err)
+			tunnelConn.Close()
 			return
 		}
 
@@ -313,6 +581,16 @@ func (l *Listener) handleUDPMsg(listener *net.UDPConn, raddr *net.UDPAddr, buffe
 	//	5、since tunnel connection is stream, the client may read 1000+1000 bytes
 	//	data at the same time, and sends 2000 bytes to the inner udp server, this may cause exception,
 	//	since the outer wants to send two msg, each msg is 1000 bytes, not one msg with 2000 bytes
+	// quic tunnel sends packets as datagrams instead
+	if pc, ok := udpSess.tunnelConn.(mux.PacketConn); ok {
+		err := pc.WritePacket(buffer)
+		if err != nil {
+			l.udpSessionManager.Del(raddr.String())
+			logs.Warn("write packet fail: %v", err)
+		}
+		return
+	}
+
 	packet := common.UDPPacket(buffer)
 	body, err := packet.Encode()
 	if err != nil {
@@ -329,9 +607,27 @@ func (l *Listener) handleUDPMsg(listener *net.UDPConn, raddr *net.UDPAddr, buffe
 }
 
 func (l *Listener) udpReadFromClient(tunnelConn net.Conn, raddr *net.UDPAddr, conn *net.UDPConn) {
+	// stream reply is read here instead of handleUDPMsg
+	// to avoid blocking the udp read loop
+	_, err := l.readStreamReply(tunnelConn)
+	if err != nil {
+		logs.Warn("listener %s client %s open stream for %s fail: %v",
+			l.listenerConfig.ID, l.listenerConfig.ClientID, raddr.String(), err)
+		l.udpSessionManager.Del(raddr.String())
+		tunnelConn.Close()
+		return
+	}
+
 	buffer := common.UDPPacket(make([]byte, 1024*64))
+	readPacket := buffer.Decode
+	if pc, ok := tunnelConn.(mux.PacketConn); ok {
+		readPacket = func(io.Reader) (int, error) {
+			return pc.ReadPacket(buffer)
+		}
+	}
+
 	for {
-		nr, err := buffer.Decode(tunnelConn)
+		nr, err := readPacket(tunnelConn)
 		if err != nil {
 			logs.Warn("decode udp from tunnel conn fail: %v", err)
 			break
@@ -345,14 +641,123 @@ func (l *Listener) udpReadFromClient(tunnelConn net.Conn, raddr *net.UDPAddr, co
 	}
 }
 
-func (l *Listener) Close() {
-	l.closeOnce.Do(func() {
-		close(l.close)
+func (l *Listener) writeProxyProtocol(tunnelConn net.Conn) error {
+	pp := &common.ProxyProtocol{
+		ClientID:         l.listenerConfig.ClientID,
+		PublicProtocol:   l.listenerConfig.PublicProtocol,
+		PublicIP:         l.listenerConfig.PublicIP,
+		PublicPort:       l.listenerConfig.PublicPort,
+		InternalProtocol: l.listenerConfig.InternalProtocol,
+		InternalIP:       l.listenerConfig.InternalIP,
+		InternalPort:     l.listenerConfig.InternalPort,
+		InternalService:  l.listenerConfig.InternalService,
+	}
+	if l.listenerConfig.PublicProtocol != "udp" {
+		pp.Compression = l.listenerConfig.Compression
+	}
+	ppBody, err := pp.Encode()
+	if err != nil {
+		return err
+	}
+
+	tunnelConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = tunnelConn.Write(ppBody)
+	tunnelConn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// readStreamReply waits for client dialing internal address
+func (l *Listener) readStreamReply(tunnelConn net.Conn) (*common.StreamReply, error) {
+	reply := &common.StreamReply{}
+	tunnelConn.SetReadDeadline(time.Now().Add(streamReplyTimeout))
+	err := reply.Decode(tunnelConn)
+	tunnelConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return reply, reply.Err()
+}
+
+// CompressStats returns raw and wire bytes of compressed streams
+func (l *Listener) CompressStats() (raw, wire int64, ratio float64) {
+	raw, wire = l.compressStats.Get()
+	return raw, wire, l.compressStats.Ratio()
+}
+
+// stop stops accepting new connections and deletes http_route rule
+// connections in progress are not affected
+func (l *Listener) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+		if l.routed {
+			l.deleteRoute()
+		}
 		if l.tcpListener != nil {
 			l.tcpListener.Close()
 		}
+	})
+}
+
+// numConns returns tcp connections and udp flows in progress
+func (l *Listener) numConns() int {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	return len(l.conns) + l.udpSessionManager.Len()
+}
+
+// Shutdown stops accepting at once and closes the listener in background
+// after connections in progress are done or timeout
+// the returned channel is closed when the listener is closed
+func (l *Listener) Shutdown(timeout time.Duration) <-chan struct{} {
+	l.stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		deadline := time.Now().Add(timeout)
+		for l.numConns() > 0 {
+			if time.Now().After(deadline) {
+				logs.Warn("listener %s drain timeout, %d connections dropped",
+					l.listenerConfig.ID, l.numConns())
+				break
+			}
+
+			select {
+			case <-l.close:
+				return
+			case <-time.After(time.Millisecond * 500):
+			}
+		}
+
+		l.Close()
+		logs.Info("listener %s drained", l.listenerConfig.ID)
+	}()
+	return done
+}
+
+// Close closes the listener and connections in progress at once
+func (l *Listener) Close() {
+	l.stop()
+	l.closeOnce.Do(func() {
+		close(l.close)
 		if l.udpListener != nil {
 			l.udpListener.Close()
 		}
+
+		// streams of http route remove themselves on close
+		l.connsMu.Lock()
+		conns := make([]net.Conn, 0, len(l.conns))
+		for conn := range l.conns {
+			conns = append(conns, conn)
+		}
+		l.connsMu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		l.udpSessionManager.Range(func(k string, value *udpSession) bool {
+			value.tunnelConn.Close()
+			return true
+		})
 	})
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/ICKelin/zta/common"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPSessionManager(t *testing.T) {
+	convey.Convey("test udp session manager", t, func() {
+		mgr := newUDPSessionManager()
+		conn1, peer1 := net.Pipe()
+		defer conn1.Close()
+		defer peer1.Close()
+		conn2, peer2 := net.Pipe()
+		defer conn2.Close()
+		defer peer2.Close()
+
+		// flows of two peers share the address of the listener
+		mgr.Set("1.1.1.1:1000", "0.0.0.0:53", conn1)
+		mgr.Set("2.2.2.2:2000", "0.0.0.0:53", conn2)
+		convey.So(mgr.Len(), convey.ShouldEqual, 2)
+		convey.So(mgr.Get("1.1.1.1:1000").tunnelConn, convey.ShouldEqual, conn1)
+		convey.So(mgr.Get("2.2.2.2:2000").tunnelConn, convey.ShouldEqual, conn2)
+
+		mgr.Del("1.1.1.1:1000")
+		convey.So(mgr.Get("1.1.1.1:1000"), convey.ShouldBeNil)
+		convey.So(mgr.Get("2.2.2.2:2000"), convey.ShouldNotBeNil)
+	})
+}
+
+// pipeMux opens streams served by client
+type pipeMux struct {
+	client func(conn net.Conn)
+}
+
+func (m *pipeMux) OpenStream() (net.Conn, error) {
+	conn, peer := net.Pipe()
+	go m.client(peer)
+	return conn, nil
+}
+
+func (m *pipeMux) AcceptStream() (net.Conn, error) { return nil, io.EOF }
+func (m *pipeMux) NumStreams() int                 { return 0 }
+func (m *pipeMux) IsClosed() bool                  { return false }
+func (m *pipeMux) Close() error                    { return nil }
+
+func TestOpenStream(t *testing.T) {
+	convey.Convey("test open stream", t, func() {
+		sessionMgr := NewSessionManager(false, time.Second, "")
+		compression := ""
+		_, err := sessionMgr.CreateSession(&Session{ClientID: "c1", InstanceID: "i1"}, &pipeMux{
+			client: func(conn net.Conn) {
+				defer conn.Close()
+				pp := &common.ProxyProtocol{}
+				if pp.Decode(conn) != nil {
+					return
+				}
+				reply := &common.StreamReply{Code: common.CodeOK, Compression: compression}
+				buf, _ := reply.Encode()
+				conn.Write(buf)
+				io.Copy(io.Discard, conn)
+			},
+		})
+		convey.So(err, convey.ShouldBeNil)
+		l := NewListener(&ListenerConfig{ID: "1", ClientID: "c1", PublicProtocol: "tcp",
+			Compression: common.CompressionSnappy}, sessionMgr)
+
+		compression = common.CompressionSnappy
+		conn, _, err := l.openStream("1.1.1.1:1000")
+		convey.So(err, convey.ShouldBeNil)
+		conn.Close()
+
+		// client falls back to no compression
+		compression = ""
+		conn, _, err = l.openStream("1.1.1.1:1000")
+		convey.So(err, convey.ShouldBeNil)
+		conn.Close()
+
+		// compression not configured by listener is rejected
+		compression = common.CompressionZstd
+		_, _, err = l.openStream("1.1.1.1:1000")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/ICKelin/zta/gateway/authenticate"
 	"github.com/ICKelin/zta/gateway/http_route"
 	"github.com/astaxie/beego/logs"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -19,18 +25,13 @@ func main() {
 		panic(err)
 	}
 
-	// parse listener config file
-	// use separate file for dynamic update, for example add/delete listener
-	listenerConfigs, err := ParseListenerConfig(conf.ListenerFile)
-	if err != nil {
-		panic(err)
-	}
-
-	// parse ssl config
-	sslConfigs, err := ParseSSLConfig(conf.SSLFile)
+	// listeners, clients, ssl and oidc users are kept in store
+	// for example listener_file or bolt database
+	store, err := NewStore(conf)
 	if err != nil {
 		panic(err)
 	}
+	defer store.Close()
 
 	// init global http route, for example apisix
 	for routeType, routeConfig := range conf.HttpRoutes {
@@ -41,7 +42,6 @@ func main() {
 	}
 
 	// init authenticate, for example OIDCService
-	// use separate file for dynamic update, for example add/delete authenticate and users
 	if conf.HTTPAuthenticate != "" {
 		err = authenticate.RunAuthenticateService(conf.HTTPAuthenticate)
 		if err != nil {
@@ -49,42 +49,100 @@ func main() {
 		}
 	}
 
+	// users of authenticate service are loaded from store
+	oidcUsers, err := storeOIDCUsers(store)
+	if err != nil {
+		panic(err)
+	}
+	authenticate.Range(func(id string, auth authenticate.Authenticate) {
+		users := make(map[string][]*authenticate.UserInfo)
+		for _, user := range oidcUsers {
+			if user.AuthID == id {
+				users[user.ClientID] = append(users[user.ClientID], &user.UserInfo)
+			}
+		}
+		auth.SetUsers(users)
+	})
+
 	// create ssl config
+	sslConfigs, err := storeSSLs(store)
+	if err != nil {
+		panic(err)
+	}
 	for _, sslConfig := range sslConfigs {
 		route := http_route.GetRoute(sslConfig.HTTPRouteType)
+		if route == nil {
+			panic(fmt.Errorf("ssl %s: route %s is not initialize", sslConfig.ID, sslConfig.HTTPRouteType))
+		}
 		err := route.UpdateSSL(sslConfig.ID, sslConfig.Cert, sslConfig.Key, sslConfig.SNIs)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	clientIDs := make([]string, 0)
-	listenerMgr := NewListenerManager()
-	sessionMgr := NewSessionManager()
+	// client credentials
+	clientConfigs, err := storeClients(store)
+	if err != nil {
+		panic(err)
+	}
+
+	listenerConfigs, err := storeListeners(store)
+	if err != nil {
+		panic(err)
+	}
+
+	sessionMgr := NewSessionManager(conf.GatewayConfig.SessionPolicy == SessionPolicyTakeover,
+		time.Duration(conf.GatewayConfig.DrainTimeout)*time.Second,
+		conf.GatewayConfig.LoadBalance)
+	listenerMgr := NewListenerManager(sessionMgr)
 	// listening ports
 	for _, listenerConfig := range listenerConfigs {
-		listener := NewListener(listenerConfig, sessionMgr)
+		err := listenerMgr.ApplyListener(listenerConfig)
+		if err != nil {
+			logs.Error("listener %s serve fail: %v", listenerConfig.ID, err)
+		}
+	}
+	// init tunnel gateway server
+	gw := NewGateway(conf.GatewayConfig, sessionMgr, listenerMgr)
+	gw.SetClients(clientConfigs)
+
+	// changes of store, eg: made by admin api or listener_file edited
+	// are applied to gateway
+	store.Watch(gw.HandleStoreEvent)
+
+	// reload on SIGHUP, and on file changes if auto_reload
+	reloader := NewReloader(confFile, conf, store, gw)
+	go reloader.Watch(conf.AutoReload)
+
+	if conf.Admin != nil {
+		admin := NewAdminServer(conf.Admin, gw, store)
+		// closed with the tunnel listeners on shutdown
+		gw.track(admin, nil)
 		go func() {
-			defer listener.Close()
-			err := listener.ListenAndServe()
-			if err != nil {
-				logs.Error("listener %s serve fail: %v", listenerConfig.ID, err)
+			err := admin.ListenAndServe()
+			if err != http.ErrServerClosed {
+				logs.Error("admin api serve fail: %v", err)
 			}
 		}()
-		listenerMgr.AddListener(listenerConfig.ID, listener)
-		clientIDs = append(clientIDs, listenerConfig.ClientID)
 	}
-	// init tunnel gateway server
-	gw := NewGateway(conf.GatewayConfig, sessionMgr)
-	gw.SetAvailableClientIDs(clientIDs)
+	// graceful shutdown, the second signal exits at once
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		logs.Info("receive %s, shutdown", <-sig)
+		go func() {
+			logs.Warn("receive %s, exit", <-sig)
+			os.Exit(1)
+		}()
+		gw.Shutdown()
+		close(shutdown)
+	}()
 
-	if conf.AutoReload {
-		// watch listener file for add/delete listeners interval
-		go WatchListenerFile(gw, conf.ListenerFile, listenerMgr, sessionMgr, listenerConfigs)
-		go authenticate.WatchConfigChanges(conf.HTTPAuthenticate)
-	}
 	err = gw.ListenAndServe()
-	if err != nil {
+	if err != ErrGatewayClosed {
 		panic(err)
 	}
+	<-shutdown
+	logs.Info("gateway is shutdown")
 }
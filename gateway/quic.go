@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
+	"net"
+	"time"
+)
+
+// alpn of the tunnel over quic
+const quicALPN = "zta"
+
+// rejected connection is kept until client closes it after reading the reply
+// closing it at once may discard the reply not yet sent
+const quicRejectLinger = 3 * time.Second
+
+// listenQUIC listens tunnel over quic, tls is required by quic
+// connections keep working after the listener is closed
+// until the transport is closed
+func (gw *Gateway) listenQUIC() (*quic.Listener, *quic.Transport, error) {
+	tlsConfig, err := newTLSConfig(gw.conf.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.NextProtos = []string{quicALPN}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", gw.conf.QUIC.ListenAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := &quic.Transport{Conn: conn}
+	idleTimeout := time.Second * time.Duration(gw.conf.QUIC.IdleTimeout)
+	listener, err := transport.Listen(tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: handshakeTimeout,
+		MaxIdleTimeout:       idleTimeout,
+		KeepAlivePeriod:      idleTimeout / 3,
+		MaxIncomingStreams:   1 << 16,
+		// udp packets of visitors are sent as datagrams
+		EnableDatagrams: true,
+	})
+	if err != nil {
+		transport.Close()
+		return nil, nil, err
+	}
+	return listener, transport, nil
+}
+
+func (gw *Gateway) serveQUIC(listener *quic.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		go gw.handleQUICConn(conn)
+	}
+}
+
+// handleQUICConn handshakes on the first stream opened by client
+// then each proxied connection is a quic stream
+func (gw *Gateway) handleQUICConn(conn *quic.Conn) {
+	muxSess := mux.QUIC(conn)
+	defer muxSess.Close()
+
+	timer := time.AfterFunc(handshakeTimeout, func() {
+		muxSess.Close()
+	})
+	stream, err := muxSess.AcceptStream()
+	timer.Stop()
+	if err != nil {
+		logs.Warn("accept handshake stream from %s fail: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	accepted := false
+	gw.serve(stream, TransportQUIC, func(sess *Session) (mux.Session, error) {
+		accepted = true
+		stream.Close()
+		return muxSess, nil
+	})
+
+	if !accepted {
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(quicRejectLinger):
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ICKelin/zta/gateway/authenticate"
+	"github.com/ICKelin/zta/gateway/http_route"
+	"github.com/astaxie/beego/logs"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// changes of files within reloadDebounce are reloaded once
+var reloadDebounce = time.Second
+
+// Reloader reloads gateway.yaml, files of store, http_authenticate
+// and certificate files of ssl at runtime
+// a reload is rejected if any file fails to parse, the last good config is kept
+type Reloader struct {
+	confFile string
+	store    Store
+	gw       *Gateway
+
+	mu sync.Mutex
+	// last good config
+	conf *Config
+}
+
+func NewReloader(confFile string, conf *Config, store Store, gw *Gateway) *Reloader {
+	return &Reloader{
+		confFile: confFile,
+		conf:     conf,
+		store:    store,
+		gw:       gw,
+	}
+}
+
+// undoList rolls back the applied changes of a reload
+type undoList []func()
+
+func (u *undoList) add(f func()) {
+	*u = append(*u, f)
+}
+
+// run rolls back in reverse order
+func (u undoList) run() {
+	for i := len(u) - 1; i >= 0; i-- {
+		u[i]()
+	}
+}
+
+// Reload parses all files first, then applies the diffs
+// routes are applied first, then listeners, clients, ssl and oidc users of store
+// the applied diffs are rolled back on the first error, the last good state is kept
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conf, err := ParseConfig(r.confFile)
+	if err != nil {
+		return err
+	}
+
+	var authConfigs []*authenticate.Config
+	if conf.HTTPAuthenticate != "" {
+		authConfigs, err = authenticate.ParseConfig(conf.HTTPAuthenticate)
+		if err != nil {
+			return fmt.Errorf("%s: %v", conf.HTTPAuthenticate, err)
+		}
+	}
+
+	// called after files of store are parsed
+	apply := func(records map[string]map[string]json.RawMessage, events []*StoreEvent) error {
+		routes, err := r.newRoutes(conf.HttpRoutes)
+		if err != nil {
+			return err
+		}
+
+		undo := make(undoList, 0)
+		err = r.reloadRoutes(conf.HttpRoutes, routes, &undo)
+		if err == nil {
+			err = r.applyRoutes(routes, records[StoreKindSSL], events, &undo)
+		}
+		if err == nil {
+			err = r.applyEvents(events, &undo)
+		}
+		if err != nil {
+			undo.run()
+			return err
+		}
+
+		r.warnRestart(conf)
+		if authConfigs != nil {
+			authenticate.Reload(authConfigs)
+		}
+		return nil
+	}
+
+	if s, ok := r.store.(*fileStore); ok {
+		err = s.Reload(apply)
+		if err != nil {
+			return err
+		}
+	} else {
+		sslRecords, err := r.store.List(StoreKindSSL)
+		if err != nil {
+			return err
+		}
+		err = apply(map[string]map[string]json.RawMessage{StoreKindSSL: sslRecords}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.conf = conf
+	return nil
+}
+
+// warnRestart logs changes which take effect after restart
+func (r *Reloader) warnRestart(conf *Config) {
+	old := r.conf
+	if !reflect.DeepEqual(old.GatewayConfig, conf.GatewayConfig) {
+		logs.Warn("gateway config changed, restart is required")
+	}
+	if !reflect.DeepEqual(old.Store, conf.Store) ||
+		old.ListenerFile != conf.ListenerFile ||
+		old.ClientFile != conf.ClientFile ||
+		old.SSLFile != conf.SSLFile ||
+		old.HTTPAuthenticate != conf.HTTPAuthenticate {
+		logs.Warn("store config changed, restart is required")
+	}
+	if !reflect.DeepEqual(old.Admin, conf.Admin) {
+		logs.Warn("admin config changed, restart is required")
+	}
+	if old.AutoReload != conf.AutoReload {
+		logs.Warn("auto_reload changed, restart is required")
+	}
+	for routeType := range old.HttpRoutes {
+		if _, ok := conf.HttpRoutes[routeType]; !ok {
+			logs.Warn("http route %s is removed, restart is required", routeType)
+		}
+	}
+}
+
+// newRoutes returns the changed http_routes, routeType -> new instance
+// instance is only created to replace the current one,
+// it is nil for reloadable routes applying the configuration in place
+func (r *Reloader) newRoutes(configs map[string]string) (map[string]http_route.HTTPRoute, error) {
+	routes := make(map[string]http_route.HTTPRoute)
+	for routeType, routeConfig := range configs {
+		if old, ok := r.conf.HttpRoutes[routeType]; ok && old == routeConfig {
+			continue
+		}
+		if _, ok := http_route.GetRoute(routeType).(http_route.Reloadable); ok {
+			routes[routeType] = nil
+			continue
+		}
+
+		route, err := http_route.NewRoute(routeType, json.RawMessage(routeConfig))
+		if err != nil {
+			return nil, fmt.Errorf("http route %s: %v", routeType, err)
+		}
+		routes[routeType] = route
+	}
+	return routes, nil
+}
+
+// reloadRoutes applies the configuration of reloadable routes in place
+// rules and ssl certificates are kept
+func (r *Reloader) reloadRoutes(configs map[string]string, routes map[string]http_route.HTTPRoute, undo *undoList) error {
+	for routeType, route := range routes {
+		if route != nil {
+			continue
+		}
+
+		logs.Info("reload http route %s", routeType)
+		current := http_route.GetRoute(routeType).(http_route.Reloadable)
+		err := current.Reload(json.RawMessage(configs[routeType]))
+		if err != nil {
+			return fmt.Errorf("http route %s: %v", routeType, err)
+		}
+
+		routeType, old := routeType, r.conf.HttpRoutes[routeType]
+		undo.add(func() {
+			err := current.Reload(json.RawMessage(old))
+			if err != nil {
+				logs.Error("rollback http route %s fail: %v", routeType, err)
+			}
+		})
+	}
+	return nil
+}
+
+// applyRoutes replaces route instances of routes
+// ssl and rules of running http listeners are pushed to the new instance
+// a replaced route is rolled back by a new instance of the old configuration
+func (r *Reloader) applyRoutes(routes map[string]http_route.HTTPRoute, sslRecords map[string]json.RawMessage, events []*StoreEvent, undo *undoList) error {
+	for routeType, route := range routes {
+		if route == nil {
+			continue
+		}
+
+		logs.Info("update http route %s", routeType)
+		err := r.pushRoute(routeType, route, sslRecords)
+		if err == nil {
+			err = http_route.SetRoute(routeType, route)
+		}
+		if err != nil {
+			return fmt.Errorf("update http route %s: %v", routeType, err)
+		}
+
+		routeType, old := routeType, r.conf.HttpRoutes[routeType]
+		undo.add(func() {
+			err := r.restoreRoute(routeType, old, sslRecords, events)
+			if err != nil {
+				logs.Error("rollback http route %s fail: %v", routeType, err)
+			}
+		})
+	}
+	return nil
+}
+
+// restoreRoute replaces route of routeType by a new instance of conf
+// store changes are rolled back already, so ssl of old records is pushed
+func (r *Reloader) restoreRoute(routeType, conf string, sslRecords map[string]json.RawMessage, events []*StoreEvent) error {
+	if conf == "" {
+		// route is added by the reload, it is kept until restart
+		return nil
+	}
+
+	oldRecords := make(map[string]json.RawMessage)
+	for id, value := range sslRecords {
+		oldRecords[id] = value
+	}
+	for _, ev := range events {
+		if ev.Kind != StoreKindSSL {
+			continue
+		}
+		if ev.Old == nil {
+			delete(oldRecords, ev.ID)
+		} else {
+			oldRecords[ev.ID] = ev.Old
+		}
+	}
+
+	route, err := http_route.NewRoute(routeType, json.RawMessage(conf))
+	if err != nil {
+		return err
+	}
+	err = r.pushRoute(routeType, route, oldRecords)
+	if err != nil {
+		return err
+	}
+	return http_route.SetRoute(routeType, route)
+}
+
+// pushRoute pushes ssl of routeType and rules of running http listeners to route
+func (r *Reloader) pushRoute(routeType string, route http_route.HTTPRoute, sslRecords map[string]json.RawMessage) error {
+	for id, value := range sslRecords {
+		conf, err := decodeSSL(value)
+		if err != nil {
+			return fmt.Errorf("ssl %s: %v", id, err)
+		}
+		if conf.HTTPRouteType != routeType {
+			continue
+		}
+		err = route.UpdateSSL(conf.ID, conf.Cert, conf.Key, conf.SNIs)
+		if err != nil {
+			return fmt.Errorf("update ssl %s: %v", id, err)
+		}
+	}
+
+	for _, l := range r.gw.listenerMgr.Listeners() {
+		conf := l.listenerConfig
+		if conf.HTTPRouteType != routeType || len(conf.HTTPParam) == 0 {
+			continue
+		}
+		err := l.updateRoute(route)
+		if err != nil {
+			return fmt.Errorf("update listener %s rule: %v", conf.ID, err)
+		}
+	}
+	return nil
+}
+
+// applyEvents applies changes of store in order
+// a change is rolled back by applying the old record, the failed one too,
+// since it may be applied partly
+func (r *Reloader) applyEvents(events []*StoreEvent, undo *undoList) error {
+	for _, ev := range events {
+		rollback := &StoreEvent{Kind: ev.Kind, ID: ev.ID, Value: ev.Old, Old: ev.Value}
+		undo.add(func() {
+			err := r.gw.applyStoreEvent(rollback)
+			if err != nil {
+				logs.Error("rollback %s %s fail: %v", rollback.Kind, rollback.ID, err)
+			}
+		})
+
+		err := r.gw.applyStoreEvent(ev)
+		if err != nil {
+			return fmt.Errorf("apply %s %s: %v", ev.Kind, ev.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *Reloader) reload() {
+	err := r.Reload()
+	if err != nil {
+		logs.Error("reload fail, last good config is kept: %v", err)
+		return
+	}
+	logs.Info("reload success")
+}
+
+// Watch reloads on SIGHUP
+// if watchFiles, files are also watched by inotify and reloaded with debouncing
+func (r *Reloader) Watch(watchFiles bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var watcher *fsnotify.Watcher
+	var events chan fsnotify.Event
+	var errs chan error
+	var files map[string]bool
+	dirs := make(map[string]bool)
+	if watchFiles {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			logs.Error("watch files fail: %v", err)
+		} else {
+			defer watcher.Close()
+			events, errs = watcher.Events, watcher.Errors
+			files = r.watchFiles(watcher, dirs)
+		}
+	}
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-hup:
+			logs.Info("reload by SIGHUP")
+			r.reload()
+		case ev := <-events:
+			if files[filepath.Clean(ev.Name)] {
+				debounce.Reset(reloadDebounce)
+			}
+		case err := <-errs:
+			logs.Warn("watch files: %v", err)
+		case <-debounce.C:
+			logs.Info("reload by file changes")
+			r.reload()
+			// certificate files of ssl may change
+			files = r.watchFiles(watcher, dirs)
+		}
+	}
+}
+
+// watchFiles watches directories of the files to reload
+// directories are watched since files may be replaced by rename
+// returns the files
+func (r *Reloader) watchFiles(watcher *fsnotify.Watcher, dirs map[string]bool) map[string]bool {
+	r.mu.Lock()
+	conf := r.conf
+	r.mu.Unlock()
+
+	files := make(map[string]bool)
+	add := func(file string) {
+		if file != "" {
+			abs, err := filepath.Abs(file)
+			if err == nil {
+				file = abs
+			}
+			files[filepath.Clean(file)] = true
+		}
+	}
+
+	add(r.confFile)
+	add(conf.HTTPAuthenticate)
+	if _, ok := r.store.(*fileStore); ok {
+		add(conf.ListenerFile)
+		add(conf.ClientFile)
+		add(conf.SSLFile)
+	}
+
+	sslConfigs, err := storeSSLs(r.store)
+	if err != nil {
+		logs.Warn("watch files of ssl fail: %v", err)
+	}
+	for _, sslConfig := range sslConfigs {
+		add(sslConfig.CertFile)
+		add(sslConfig.KeyFile)
+	}
+
+	watching := make(map[string]bool)
+	for file := range files {
+		watching[filepath.Dir(file)] = true
+	}
+
+	for dir := range dirs {
+		if !watching[dir] {
+			watcher.Remove(dir)
+			delete(dirs, dir)
+		}
+	}
+	for dir := range watching {
+		if dirs[dir] {
+			continue
+		}
+		err := watcher.Add(dir)
+		if err != nil {
+			logs.Warn("watch %s fail: %v", dir, err)
+			continue
+		}
+		dirs[dir] = true
+	}
+	return files
+}
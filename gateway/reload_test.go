@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ICKelin/zta/gateway/http_route"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	convey.Convey("test reload", t, func() {
+		dir := t.TempDir()
+		confFile := filepath.Join(dir, "gateway.yaml")
+		listenerFile := filepath.Join(dir, "listener.json")
+		os.WriteFile(listenerFile, []byte(`[]`), 0644)
+		writeConf := func(httpAddr string) {
+			os.WriteFile(confFile, []byte(fmt.Sprintf(`gateway:
+  listen_addr: 127.0.0.1:0
+listener_file: %s
+http_routes:
+  builtin: '{"http_addr": "%s"}'
+`, listenerFile, httpAddr)), 0644)
+		}
+		inUse := func(addr string) bool {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return true
+			}
+			l.Close()
+			return false
+		}
+
+		writeConf("127.0.0.1:0")
+		conf, err := ParseConfig(confFile)
+		convey.So(err, convey.ShouldBeNil)
+		err = http_route.InitRoute(http_route.TypeBuiltin, json.RawMessage(conf.HttpRoutes[http_route.TypeBuiltin]))
+		convey.So(err, convey.ShouldBeNil)
+		route := http_route.GetRoute(http_route.TypeBuiltin)
+		defer route.(http_route.Service).Close()
+
+		s, err := NewStore(conf)
+		convey.So(err, convey.ShouldBeNil)
+		sessionMgr := NewSessionManager(false, time.Second, "")
+		listenerMgr := NewListenerManager(sessionMgr)
+		r := NewReloader(confFile, conf, s, NewGateway(conf.GatewayConfig, sessionMgr, listenerMgr))
+
+		// route is not reloaded if any file is invalid
+		addr := fmt.Sprintf("127.0.0.1:%d", freePort())
+		writeConf(addr)
+		os.WriteFile(listenerFile, []byte(`[{"id"`), 0644)
+		convey.So(r.Reload(), convey.ShouldNotBeNil)
+		convey.So(inUse(addr), convey.ShouldBeFalse)
+
+		// reload fails if route rejects the config
+		os.WriteFile(listenerFile, []byte(`[]`), 0644)
+		writeConf("invalid")
+		convey.So(r.Reload(), convey.ShouldNotBeNil)
+		convey.So(r.conf, convey.ShouldEqual, conf)
+
+		// reloadable route is kept and applies the config in place
+		writeConf(addr)
+		convey.So(r.Reload(), convey.ShouldBeNil)
+		convey.So(http_route.GetRoute(http_route.TypeBuiltin), convey.ShouldEqual, route)
+		convey.So(inUse(addr), convey.ShouldBeTrue)
+
+		// applied listeners are rolled back if any listener fails to listen
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer busy.Close()
+		port := freePort()
+		os.WriteFile(listenerFile, []byte(fmt.Sprintf(`[
+			{"id": "1", "client_id": "c1", "public_protocol": "tcp", "public_ip": "127.0.0.1", "public_port": %d},
+			{"id": "2", "client_id": "c1", "public_protocol": "tcp", "public_ip": "127.0.0.1", "public_port": %d}]`,
+			port, busy.Addr().(*net.TCPAddr).Port)), 0644)
+		convey.So(r.Reload(), convey.ShouldNotBeNil)
+		convey.So(listenerMgr.GetListener("1"), convey.ShouldBeNil)
+		convey.So(inUse(fmt.Sprintf("127.0.0.1:%d", port)), convey.ShouldBeFalse)
+		_, err = s.Get(StoreKindListener, "1")
+		convey.So(err, convey.ShouldEqual, ErrRecordNotFound)
+
+		busy.Close()
+		convey.So(r.Reload(), convey.ShouldBeNil)
+		convey.So(listenerMgr.GetListener("1"), convey.ShouldNotBeNil)
+		convey.So(listenerMgr.GetListener("2"), convey.ShouldNotBeNil)
+		listenerMgr.CloseListener("1")
+		listenerMgr.CloseListener("2")
+	})
+}
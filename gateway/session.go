@@ -2,72 +2,401 @@ package main
 
 import (
 	"fmt"
-	"github.com/xtaci/smux"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/astaxie/beego/logs"
+	"hash/fnv"
 	"net"
+	"sort"
 	"sync"
+	"time"
+)
+
+// load balance strategies for client instances
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastStreams = "least_streams"
+	// rendezvous hash of visitor ip, visitor sticks to one instance
+	// and only visitors of a dropped instance are moved
+	BalanceHash = "hash"
 )
 
 type Session struct {
-	ClientID   string
-	Connection *smux.Session
+	ClientID string
+	// instance of the client, one client id may run on several hosts
+	InstanceID string
+	// service group, sessions of the same group share the listeners
+	Group string
+	// max instances of the group, 1 if not set
+	MaxInstances int
+	RemoteAddr   string
+	// negotiated protocol version and features
+	Version  int
+	Features uint32
+	// tcp, quic, websocket or kcp
+	Transport string
+	// negotiated multiplexer
+	Mux        string
+	Connection mux.Session
+	// measured by heartbeat if negotiated
+	RTT *common.RTTStats
+
+	// control stream opened by client and its writer
+	controlMu    sync.Mutex
+	control      net.Conn
+	controlWrite func([]byte) error
+}
+
+// Key is the id referenced by listener client_id
+func (s *Session) Key() string {
+	if s.Group != "" {
+		return s.Group
+	}
+	return s.ClientID
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("%s/%s(%s)", s.ClientID, s.InstanceID, s.RemoteAddr)
+}
+
+// setControl records the control stream frames are sent to
+func (s *Session) setControl(stream net.Conn, write func([]byte) error) {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	s.control = stream
+	s.controlWrite = write
+}
+
+// GoAway tells client the gateway is going away and closes the control stream
+// nothing is sent if client does not support goaway
+func (s *Session) GoAway(reason string, drainTimeout time.Duration) error {
+	if s.Features&common.FeatureGoAway == 0 {
+		return nil
+	}
+
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	if s.control == nil {
+		return nil
+	}
+
+	goAway := &common.GoAway{
+		Reason:       reason,
+		DrainTimeout: int(drainTimeout / time.Second),
+	}
+	buf, err := goAway.Encode()
+	if err != nil {
+		return err
+	}
+
+	err = s.controlWrite(buf)
+	s.control.Close()
+	return err
+}
+
+func (s *Session) sameInstance(o *Session) bool {
+	return s.ClientID == o.ClientID && s.InstanceID == o.InstanceID
+}
+
+// sessionGroup is the online instances of a client id or a service group
+type sessionGroup struct {
+	sessions []*Session
+	next     uint64
+}
+
+// snapshot copies the instances and takes the round robin start
+// it is called with the lock of session manager held
+func (g *sessionGroup) snapshot(balance string) ([]*Session, uint64) {
+	sessions := make([]*Session, len(g.sessions))
+	copy(sessions, g.sessions)
+	next := g.next
+	if balance != BalanceLeastStreams && balance != BalanceHash {
+		g.next++
+	}
+	return sessions, next
+}
+
+// candidates orders instances of a snapshot by balance strategy
+// the first one is preferred, the others are used for failover
+// it is called without lock, NumStreams of some mux may block
+func candidates(sessions []*Session, next uint64, balance, visitorAddr string) []*Session {
+	candidates := make([]*Session, len(sessions))
+	copy(candidates, sessions)
+	if len(candidates) <= 1 {
+		return candidates
+	}
+
+	switch balance {
+	case BalanceLeastStreams:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Connection.NumStreams() < candidates[j].Connection.NumStreams()
+		})
+	case BalanceHash:
+		host, _, err := net.SplitHostPort(visitorAddr)
+		if err != nil {
+			host = visitorAddr
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return hashScore(candidates[i], host) > hashScore(candidates[j], host)
+		})
+	default:
+		start := int(next % uint64(len(sessions)))
+		candidates = append(candidates[:0], sessions[start:]...)
+		candidates = append(candidates, sessions[:start]...)
+	}
+	return candidates
+}
+
+func (g *sessionGroup) remove(sess *Session) {
+	for i, s := range g.sessions {
+		if s == sess {
+			g.sessions = append(g.sessions[:i], g.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+func hashScore(sess *Session, visitor string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(sess.ClientID))
+	h.Write([]byte(sess.InstanceID))
+	h.Write([]byte(visitor))
+	return h.Sum64()
 }
 
 type SessionManager struct {
+	// replace online session by the newest connection
+	takeover     bool
+	drainTimeout time.Duration
+	// default load balance strategy
+	balance    string
 	sessionsMu sync.Mutex
-	sessions   map[string]*Session
+	sessions   map[string]*sessionGroup
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(takeover bool, drainTimeout time.Duration, balance string) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		takeover:     takeover,
+		drainTimeout: drainTimeout,
+		balance:      balance,
+		sessions:     make(map[string]*sessionGroup),
 	}
 }
 
-func (mgr *SessionManager) GetSessionByClientID(clientID string) (net.Conn, error) {
+// GetSessionByClientID opens a stream to one of the online instances of clientID
+// clientID is the client id or the service group of instances
+// instances that fail to open stream are skipped
+// balance is the load balance strategy, use the default one if empty
+// streams are opened without lock, opening stream of quic may block until timeout
+func (mgr *SessionManager) GetSessionByClientID(clientID, balance, visitorAddr string) (net.Conn, error) {
+	if balance == "" {
+		balance = mgr.balance
+	}
+
 	mgr.sessionsMu.Lock()
-	defer mgr.sessionsMu.Unlock()
-	sess := mgr.sessions[clientID]
-	if sess == nil {
+	group := mgr.sessions[clientID]
+	if group == nil || len(group.sessions) == 0 {
+		mgr.sessionsMu.Unlock()
 		return nil, fmt.Errorf("client %s not connected", clientID)
 	}
+	sessions, next := group.snapshot(balance)
+	mgr.sessionsMu.Unlock()
 
-	stream, err := sess.Connection.OpenStream()
-	if err != nil {
-		return nil, err
+	var lastErr error
+	for _, sess := range candidates(sessions, next, balance, visitorAddr) {
+		if sess.Connection.IsClosed() {
+			continue
+		}
+
+		stream, err := sess.Connection.OpenStream()
+		if err != nil {
+			logs.Warn("open stream to %s fail: %v", sess, err)
+			lastErr = err
+			continue
+		}
+		return stream, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("client %s not connected", clientID)
+	}
+	return nil, lastErr
+}
+
+// CheckSession checks whether sess is allowed to join its group
+func (mgr *SessionManager) CheckSession(sess *Session) error {
+	mgr.sessionsMu.Lock()
+	defer mgr.sessionsMu.Unlock()
+	_, err := mgr.checkSession(sess)
+	return err
+}
+
+// checkSession returns the online session replaced by sess if any
+func (mgr *SessionManager) checkSession(sess *Session) (*Session, error) {
+	group := mgr.sessions[sess.Key()]
+	if group == nil {
+		return nil, nil
+	}
+
+	for _, old := range group.sessions {
+		if old.sameInstance(sess) {
+			if !mgr.takeover {
+				return nil, &common.ReplyError{
+					Code:    common.CodeAlreadyOnline,
+					Message: fmt.Sprintf("instance %s is online", sess.InstanceID),
+				}
+			}
+			return old, nil
+		}
+	}
+
+	maxInstances := sess.MaxInstances
+	if maxInstances <= 0 {
+		maxInstances = 1
+	}
+	if len(group.sessions) >= maxInstances {
+		if maxInstances == 1 && mgr.takeover {
+			return group.sessions[0], nil
+		}
+		return nil, &common.ReplyError{
+			Code:    common.CodeAlreadyOnline,
+			Message: fmt.Sprintf("%s already has %d instances online", sess.Key(), len(group.sessions)),
+		}
 	}
-	return stream, nil
+	return nil, nil
 }
 
-func (mgr *SessionManager) CreateSession(clientID string, conn net.Conn) (*Session, error) {
+// CreateSession adds the handshake result sess with its mux session
+// if the instance is online, the old session is replaced when takeover is enabled
+func (mgr *SessionManager) CreateSession(sess *Session, muxSess mux.Session) (*Session, error) {
 	mgr.sessionsMu.Lock()
 	defer mgr.sessionsMu.Unlock()
 
-	mux, err := smux.Server(conn, nil)
+	old, err := mgr.checkSession(sess)
 	if err != nil {
 		return nil, err
 	}
 
-	old := mgr.sessions[clientID]
-	if old != nil {
-		return nil, fmt.Errorf("client %s is online", clientID)
+	sess.Connection = muxSess
+
+	group := mgr.sessions[sess.Key()]
+	if group == nil {
+		group = &sessionGroup{}
+		mgr.sessions[sess.Key()] = group
 	}
 
-	sess := &Session{
-		ClientID:   clientID,
-		Connection: mux,
+	if old != nil {
+		logs.Info("%s session takeover, old %s new %s", sess.Key(), old, sess)
+		group.remove(old)
+		go mgr.drain(old)
 	}
-	mgr.sessions[clientID] = sess
+
+	group.sessions = append(group.sessions, sess)
+	logs.Info("%s session %s online, %d instances", sess.Key(), sess, len(group.sessions))
 	return sess, nil
 }
 
-func (mgr *SessionManager) Range(f func(k string, v *Session) bool) {
+// drain waits for the streams of a replaced session and then closes it
+// the replaced session is removed from sessions, so no more stream is opened
+func (mgr *SessionManager) drain(sess *Session) {
+	deadline := time.Now().Add(mgr.drainTimeout)
+	for !sess.Connection.IsClosed() && sess.Connection.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			logs.Warn("session %s drain timeout, %d streams dropped",
+				sess, sess.Connection.NumStreams())
+			break
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	sess.Connection.Close()
+	logs.Info("session %s drained", sess)
+}
+
+// Shutdown sends goaway to all online sessions and drains them
+// sessions are removed at once, so no more stream is opened
+func (mgr *SessionManager) Shutdown(reason string) {
+	mgr.sessionsMu.Lock()
+	sessions := make([]*Session, 0)
+	for _, group := range mgr.sessions {
+		sessions = append(sessions, group.sessions...)
+	}
+	mgr.sessions = make(map[string]*sessionGroup)
+	mgr.sessionsMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		wg.Add(1)
+		go func(sess *Session) {
+			defer wg.Done()
+			err := sess.GoAway(reason, mgr.drainTimeout)
+			if err != nil {
+				logs.Warn("session %s goaway fail: %v", sess, err)
+			}
+			mgr.drain(sess)
+		}(sess)
+	}
+	wg.Wait()
+}
+
+// Range iterates all online sessions, session is removed if f returns false
+func (mgr *SessionManager) Range(f func(v *Session) bool) {
 	mgr.sessionsMu.Lock()
 	defer mgr.sessionsMu.Unlock()
 
-	for k, v := range mgr.sessions {
-		ok := f(k, v)
-		if !ok {
+	for k, group := range mgr.sessions {
+		sessions := make([]*Session, 0, len(group.sessions))
+		for _, v := range group.sessions {
+			if f(v) {
+				sessions = append(sessions, v)
+			}
+		}
+		group.sessions = sessions
+
+		if len(group.sessions) == 0 {
 			delete(mgr.sessions, k)
 		}
 	}
 }
+
+// Sessions returns the online sessions sorted by key and instance
+func (mgr *SessionManager) Sessions() []*Session {
+	mgr.sessionsMu.Lock()
+	defer mgr.sessionsMu.Unlock()
+
+	sessions := make([]*Session, 0)
+	for _, group := range mgr.sessions {
+		sessions = append(sessions, group.sessions...)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Key() != sessions[j].Key() {
+			return sessions[i].Key() < sessions[j].Key()
+		}
+		return sessions[i].InstanceID < sessions[j].InstanceID
+	})
+	return sessions
+}
+
+// KickSession closes the online session of instanceID of clientID
+// the client reconnects according to its reconnect policy
+func (mgr *SessionManager) KickSession(clientID, instanceID string) (*Session, error) {
+	mgr.sessionsMu.Lock()
+	defer mgr.sessionsMu.Unlock()
+
+	for k, group := range mgr.sessions {
+		for _, sess := range group.sessions {
+			if sess.ClientID != clientID || sess.InstanceID != instanceID {
+				continue
+			}
+
+			group.remove(sess)
+			if len(group.sessions) == 0 {
+				delete(mgr.sessions, k)
+			}
+			sess.Connection.Close()
+			logs.Info("session %s is kicked", sess)
+			return sess, nil
+		}
+	}
+	return nil, fmt.Errorf("session %s/%s is not online", clientID, instanceID)
+}
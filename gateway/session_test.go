@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockMux blocks opening stream until release is closed, like quic at its stream limit
+type blockMux struct {
+	opening chan struct{}
+	release chan struct{}
+}
+
+func (m *blockMux) OpenStream() (net.Conn, error) {
+	close(m.opening)
+	<-m.release
+	return nil, fmt.Errorf("stream limit")
+}
+
+func (m *blockMux) AcceptStream() (net.Conn, error) { return nil, io.EOF }
+func (m *blockMux) NumStreams() int                 { return 0 }
+func (m *blockMux) IsClosed() bool                  { return false }
+func (m *blockMux) Close() error                    { return nil }
+
+func TestGetSessionByClientID(t *testing.T) {
+	convey.Convey("test get session by client id", t, func() {
+		sessionMgr := NewSessionManager(false, time.Second, BalanceRoundRobin)
+		blocked := &blockMux{opening: make(chan struct{}), release: make(chan struct{})}
+		_, err := sessionMgr.CreateSession(&Session{ClientID: "c1", InstanceID: "i1"}, blocked)
+		convey.So(err, convey.ShouldBeNil)
+
+		opened := make(chan error)
+		go func() {
+			_, err := sessionMgr.GetSessionByClientID("c1", "", "1.1.1.1:1000")
+			opened <- err
+		}()
+		<-blocked.opening
+
+		// blocked stream opening does not hold the sessions of others
+		online := make(chan error)
+		go func() {
+			_, err := sessionMgr.CreateSession(&Session{ClientID: "c2", InstanceID: "i1"}, &pipeMux{
+				client: func(conn net.Conn) { conn.Close() },
+			})
+			online <- err
+		}()
+		select {
+		case err = <-online:
+			convey.So(err, convey.ShouldBeNil)
+		case <-time.After(time.Second):
+			convey.So("create session blocked", convey.ShouldBeEmpty)
+		}
+
+		conn, err := sessionMgr.GetSessionByClientID("c2", "", "1.1.1.1:1000")
+		convey.So(err, convey.ShouldBeNil)
+		conn.Close()
+
+		close(blocked.release)
+		convey.So(<-opened, convey.ShouldNotBeNil)
+	})
+}
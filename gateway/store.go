@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/zta/gateway/authenticate"
+	"strings"
+	"sync"
+)
+
+// kinds of records in store
+const (
+	StoreKindListener = "listener"
+	StoreKindClient   = "client"
+	StoreKindSSL      = "ssl"
+	StoreKindOIDCUser = "oidc_user"
+)
+
+const (
+	StoreTypeFile = "file"
+	StoreTypeBolt = "bolt"
+)
+
+var (
+	storeKinds = []string{
+		StoreKindListener,
+		StoreKindClient,
+		StoreKindSSL,
+		StoreKindOIDCUser,
+	}
+	ErrRecordNotFound = errors.New("record not found")
+)
+
+// StoreEvent is a record changed in store
+type StoreEvent struct {
+	Kind string
+	ID   string
+	// nil if the record is deleted
+	Value json.RawMessage
+	// nil if the record is created
+	Old json.RawMessage
+}
+
+// Store is the source of truth of listeners, clients, ssl and oidc users
+// records are json documents keyed by kind and id
+// id of listener and ssl is the id field, id of client is client_id
+// id of oidc user is auth_id/client_id/username
+type Store interface {
+	// List returns all records of kind, id -> record
+	List(kind string) (map[string]json.RawMessage, error)
+	// Get returns ErrRecordNotFound if id does not exist
+	Get(kind, id string) (json.RawMessage, error)
+	// Put creates or replaces record id
+	Put(kind, id string, value json.RawMessage) error
+	// Delete returns ErrRecordNotFound if id does not exist
+	Delete(kind, id string) error
+	// Watch registers f to be notified of changed records
+	// f is called in order of changes and must not call store
+	Watch(f func(*StoreEvent))
+	Close() error
+}
+
+// NewStore creates store of conf.Store.Type
+func NewStore(conf *Config) (Store, error) {
+	files := map[string]string{
+		StoreKindListener: conf.ListenerFile,
+		StoreKindClient:   conf.ClientFile,
+		StoreKindSSL:      conf.SSLFile,
+		StoreKindOIDCUser: conf.HTTPAuthenticate,
+	}
+
+	switch conf.Store.Type {
+	case StoreTypeFile:
+		return newFileStore(files)
+	case StoreTypeBolt:
+		s, err := newBoltStore(conf.Store.Path)
+		if err != nil {
+			return nil, err
+		}
+		err = s.importFiles(files)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("invalid store type %s", conf.Store.Type)
+	}
+}
+
+// storeWatchers notifies watchers of store
+type storeWatchers struct {
+	mu       sync.Mutex
+	watchers []func(*StoreEvent)
+	// held while notifying changes, so changes are notified in order
+	order sync.Mutex
+}
+
+func (w *storeWatchers) Watch(f func(*StoreEvent)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watchers = append(w.watchers, f)
+}
+
+func (w *storeWatchers) notify(ev *StoreEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.watchers {
+		f(ev)
+	}
+}
+
+// unlockAndNotify unlocks mu of store then notifies events
+// next change of store is notified after events
+func (w *storeWatchers) unlockAndNotify(mu *sync.Mutex, events []*StoreEvent) {
+	w.order.Lock()
+	defer w.order.Unlock()
+	mu.Unlock()
+	for _, ev := range events {
+		w.notify(ev)
+	}
+}
+
+// OIDCUser is a user of oidc client of authenticate service auth_id
+type OIDCUser struct {
+	AuthID   string `json:"auth_id"`
+	ClientID string `json:"client_id"`
+	authenticate.UserInfo
+}
+
+func (u *OIDCUser) ID() string {
+	return oidcUserID(u.AuthID, u.ClientID, u.Username)
+}
+
+func oidcUserID(authID, clientID, username string) string {
+	return fmt.Sprintf("%s/%s/%s", authID, clientID, username)
+}
+
+// parseOIDCUserID returns auth_id, client_id and username of id
+func parseOIDCUserID(id string) (string, string, string, error) {
+	fields := strings.SplitN(id, "/", 3)
+	if len(fields) != 3 {
+		return "", "", "", fmt.Errorf("invalid oidc user id %s", id)
+	}
+	return fields[0], fields[1], fields[2], nil
+}
+
+func decodeListener(value json.RawMessage) (*ListenerConfig, error) {
+	conf := &ListenerConfig{}
+	err := json.Unmarshal(value, conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, conf.validate()
+}
+
+func decodeClient(value json.RawMessage) (*ClientConfig, error) {
+	conf := &ClientConfig{}
+	err := json.Unmarshal(value, conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, conf.validate()
+}
+
+func decodeSSL(value json.RawMessage) (*SSLConfig, error) {
+	conf := &SSLConfig{}
+	err := json.Unmarshal(value, conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, conf.load()
+}
+
+func decodeOIDCUser(value json.RawMessage) (*OIDCUser, error) {
+	user := &OIDCUser{}
+	err := json.Unmarshal(value, user)
+	if err != nil {
+		return nil, err
+	}
+	if user.AuthID == "" || user.ClientID == "" || user.Username == "" {
+		return nil, fmt.Errorf("auth_id, client_id and username are required")
+	}
+	return user, nil
+}
+
+// checkRecord validates value of kind and returns the record to keep
+// ssl keeps references to certificate and key files, the key is never
+// copied into the record, digest of the files is set instead
+// so changes of the files are changes of the record
+func checkRecord(kind string, value json.RawMessage) (json.RawMessage, error) {
+	var err error
+	switch kind {
+	case StoreKindListener:
+		_, err = decodeListener(value)
+	case StoreKindClient:
+		_, err = decodeClient(value)
+	case StoreKindSSL:
+		var conf *SSLConfig
+		conf, err = decodeSSL(value)
+		if err != nil || (conf.CertFile == "" && conf.KeyFile == "") {
+			break
+		}
+
+		ref := &SSLConfig{}
+		err = json.Unmarshal(value, ref)
+		if err != nil {
+			break
+		}
+		ref.Digest = conf.digest()
+		return json.Marshal(ref)
+	case StoreKindOIDCUser:
+		_, err = decodeOIDCUser(value)
+	}
+	return value, err
+}
+
+func storeListeners(s Store) ([]*ListenerConfig, error) {
+	records, err := s.List(StoreKindListener)
+	if err != nil {
+		return nil, err
+	}
+
+	confs := make([]*ListenerConfig, 0, len(records))
+	for id, value := range records {
+		conf, err := decodeListener(value)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", id, err)
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+func storeClients(s Store) ([]*ClientConfig, error) {
+	records, err := s.List(StoreKindClient)
+	if err != nil {
+		return nil, err
+	}
+
+	confs := make([]*ClientConfig, 0, len(records))
+	for id, value := range records {
+		conf, err := decodeClient(value)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %v", id, err)
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+func storeSSLs(s Store) ([]*SSLConfig, error) {
+	records, err := s.List(StoreKindSSL)
+	if err != nil {
+		return nil, err
+	}
+
+	confs := make([]*SSLConfig, 0, len(records))
+	for id, value := range records {
+		conf, err := decodeSSL(value)
+		if err != nil {
+			return nil, fmt.Errorf("ssl %s: %v", id, err)
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+func storeOIDCUsers(s Store) ([]*OIDCUser, error) {
+	records, err := s.List(StoreKindOIDCUser)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*OIDCUser, 0, len(records))
+	for id, value := range records {
+		user, err := decodeOIDCUser(value)
+		if err != nil {
+			return nil, fmt.Errorf("oidc user %s: %v", id, err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// storePut encodes v and puts it as record id
+func storePut(s Store, kind, id string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(kind, id, value)
+}
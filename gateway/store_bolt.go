@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego/logs"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	_ Store = &boltStore{}
+
+	boltMetaBucket  = []byte("meta")
+	boltImportedKey = []byte("imported")
+)
+
+// boltStore keeps records in bolt database, a bucket for each kind
+// database is locked by the gateway, changes are made by admin api
+type boltStore struct {
+	storeWatchers
+	// serializes writes
+	mu sync.Mutex
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 3})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		for _, kind := range storeKinds {
+			_, err := tx.CreateBucketIfNotExists([]byte(kind))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// importFiles imports records of files into database created just now
+// so records of file store are kept after switching to bolt store
+// files not existing are skipped
+func (s *boltStore) importFiles(files map[string]string) error {
+	src := &fileStore{files: files}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		if meta.Get(boltImportedKey) != nil {
+			return nil
+		}
+
+		for _, kind := range storeKinds {
+			records, err := src.load(kind)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			b := tx.Bucket([]byte(kind))
+			for id, value := range records {
+				err := b.Put([]byte(id), value)
+				if err != nil {
+					return err
+				}
+			}
+			if len(records) > 0 {
+				logs.Info("import %d %s from %s", len(records), kind, files[kind])
+			}
+		}
+		return meta.Put(boltImportedKey, []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+func (s *boltStore) List(kind string) (map[string]json.RawMessage, error) {
+	records := make(map[string]json.RawMessage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		// values are only valid in transaction
+		return b.ForEach(func(k, v []byte) error {
+			records[string(k)] = append(json.RawMessage{}, v...)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *boltStore) Get(kind, id string) (json.RawMessage, error) {
+	var value json.RawMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return ErrRecordNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		value = append(json.RawMessage{}, v...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Put(kind, id string, value json.RawMessage) error {
+	value, err := checkRecord(kind, value)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", kind, id, err)
+	}
+
+	var old json.RawMessage
+	s.mu.Lock()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return ErrRecordNotFound
+		}
+		if v := b.Get([]byte(id)); v != nil {
+			old = append(old, v...)
+		}
+		return b.Put([]byte(id), value)
+	})
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.unlockAndNotify(&s.mu, []*StoreEvent{{Kind: kind, ID: id, Value: value, Old: old}})
+	return nil
+}
+
+func (s *boltStore) Delete(kind, id string) error {
+	var old json.RawMessage
+	s.mu.Lock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return ErrRecordNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		old = append(old, v...)
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.unlockAndNotify(&s.mu, []*StoreEvent{{Kind: kind, ID: id, Old: old}})
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
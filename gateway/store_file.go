@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ICKelin/zta/gateway/authenticate"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var _ Store = &fileStore{}
+
+// fileCodec converts between file content and records
+type fileCodec interface {
+	// decode returns records in content, id -> record
+	decode(content []byte) (map[string]json.RawMessage, error)
+	// update puts record id into content, record is deleted if value is nil
+	update(content []byte, id string, value json.RawMessage) ([]byte, error)
+}
+
+var fileCodecs = map[string]fileCodec{
+	StoreKindListener: &arrayCodec{key: "id"},
+	StoreKindClient:   &arrayCodec{key: "client_id"},
+	StoreKindSSL:      &arrayCodec{key: "id"},
+	StoreKindOIDCUser: &oidcUserCodec{},
+}
+
+// fileStore keeps records in the files of gateway.yaml
+// listener_file, client_file, ssl_file and users of http_authenticate
+// files may also be edited by hand, changes are found by Reload
+type fileStore struct {
+	storeWatchers
+	mu    sync.Mutex
+	files map[string]string
+	// records of last load, kind -> id -> record
+	records map[string]map[string]json.RawMessage
+}
+
+func newFileStore(files map[string]string) (*fileStore, error) {
+	s := &fileStore{
+		files:   files,
+		records: make(map[string]map[string]json.RawMessage),
+	}
+
+	for _, kind := range storeKinds {
+		records, err := s.load(kind)
+		if err != nil {
+			return nil, err
+		}
+		s.records[kind] = records
+	}
+	return s, nil
+}
+
+// load reads records of kind from its file
+// no records if file of kind is not configured
+func (s *fileStore) load(kind string) (map[string]json.RawMessage, error) {
+	file := s.files[kind]
+	if file == "" {
+		return make(map[string]json.RawMessage), nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := fileCodecs[kind].decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	for id, value := range records {
+		records[id], err = checkRecord(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s %s: %v", file, kind, id, err)
+		}
+	}
+	return records, nil
+}
+
+func (s *fileStore) List(kind string) (map[string]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make(map[string]json.RawMessage)
+	for id, value := range s.records[kind] {
+		records[id] = value
+	}
+	return records, nil
+}
+
+func (s *fileStore) Get(kind, id string) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.records[kind][id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return value, nil
+}
+
+func (s *fileStore) Put(kind, id string, value json.RawMessage) error {
+	return s.update(kind, id, value)
+}
+
+func (s *fileStore) Delete(kind, id string) error {
+	return s.update(kind, id, nil)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// update rewrites file of kind and notifies the changes
+func (s *fileStore) update(kind, id string, value json.RawMessage) error {
+	s.mu.Lock()
+	events, err := s.write(kind, id, value)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.unlockAndNotify(&s.mu, events)
+	return nil
+}
+
+// write puts record id into file of kind and returns the changes
+func (s *fileStore) write(kind, id string, value json.RawMessage) ([]*StoreEvent, error) {
+	file := s.files[kind]
+	if file == "" {
+		return nil, fmt.Errorf("file of %s is not configured", kind)
+	}
+
+	// invalid record is never written, or every load of the file fails
+	if value != nil {
+		_, err := checkRecord(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", kind, id, err)
+		}
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	content, err = fileCodecs[kind].update(content, id, value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFile(file, content)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.load(kind)
+	if err != nil {
+		return nil, err
+	}
+	return s.commit(kind, records), nil
+}
+
+// Reload loads all files and applies the changes
+// nothing is changed if any file fails to load or apply returns error
+// apply is called with the loaded records, kind -> id -> record, and the changes,
+// it applies the changes instead of watchers and must not call store
+// the changes are notified to watchers if apply is nil
+func (s *fileStore) Reload(apply func(records map[string]map[string]json.RawMessage, events []*StoreEvent) error) error {
+	s.mu.Lock()
+
+	all := make(map[string]map[string]json.RawMessage)
+	events := make([]*StoreEvent, 0)
+	for _, kind := range storeKinds {
+		records, err := s.load(kind)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		all[kind] = records
+		events = append(events, s.diff(kind, records)...)
+	}
+
+	if apply == nil {
+		for _, kind := range storeKinds {
+			s.records[kind] = all[kind]
+		}
+		s.unlockAndNotify(&s.mu, events)
+		return nil
+	}
+
+	defer s.mu.Unlock()
+	// changes notified before are applied first
+	s.order.Lock()
+	defer s.order.Unlock()
+	err := apply(all, events)
+	if err != nil {
+		return err
+	}
+	for _, kind := range storeKinds {
+		s.records[kind] = all[kind]
+	}
+	return nil
+}
+
+// commit replaces records of kind and returns the changes
+func (s *fileStore) commit(kind string, records map[string]json.RawMessage) []*StoreEvent {
+	events := s.diff(kind, records)
+	s.records[kind] = records
+	return events
+}
+
+// diff returns the changes from records of kind to records
+func (s *fileStore) diff(kind string, records map[string]json.RawMessage) []*StoreEvent {
+	old := s.records[kind]
+
+	// deleted first, so the address of deleted listener can be reused
+	events := make([]*StoreEvent, 0)
+	for id, oldValue := range old {
+		if _, ok := records[id]; !ok {
+			events = append(events, &StoreEvent{Kind: kind, ID: id, Old: oldValue})
+		}
+	}
+
+	for id, value := range records {
+		oldValue, ok := old[id]
+		if ok && bytes.Equal(oldValue, value) {
+			continue
+		}
+		events = append(events, &StoreEvent{Kind: kind, ID: id, Value: value, Old: oldValue})
+	}
+	return events
+}
+
+// writeFile replaces file with content by rename
+// so the file is never read half written
+// new file is only readable by owner, client file keeps secrets
+func writeFile(file string, content []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// arrayCodec is for file of json array, eg: listener.json
+// key is the field of record id
+type arrayCodec struct {
+	key string
+}
+
+func (c *arrayCodec) decode(content []byte) (map[string]json.RawMessage, error) {
+	items := make([]json.RawMessage, 0)
+	err := json.Unmarshal(content, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]json.RawMessage)
+	for _, item := range items {
+		id, err := c.id(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := records[id]; ok {
+			return nil, fmt.Errorf("duplicated %s %s", c.key, id)
+		}
+
+		buf := &bytes.Buffer{}
+		err = json.Compact(buf, item)
+		if err != nil {
+			return nil, err
+		}
+		records[id] = buf.Bytes()
+	}
+	return records, nil
+}
+
+func (c *arrayCodec) update(content []byte, id string, value json.RawMessage) ([]byte, error) {
+	if value != nil {
+		valueID, err := c.id(value)
+		if err != nil {
+			return nil, err
+		}
+		if valueID != id {
+			return nil, fmt.Errorf("%s %s mismatch %s", c.key, valueID, id)
+		}
+	}
+
+	items := make([]json.RawMessage, 0)
+	if len(bytes.TrimSpace(content)) > 0 {
+		err := json.Unmarshal(content, &items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	found := false
+	result := make([]json.RawMessage, 0, len(items)+1)
+	for _, item := range items {
+		itemID, err := c.id(item)
+		if err != nil {
+			return nil, err
+		}
+		if itemID != id {
+			result = append(result, item)
+			continue
+		}
+
+		found = true
+		if value != nil {
+			result = append(result, value)
+		}
+	}
+
+	if !found {
+		if value == nil {
+			return nil, ErrRecordNotFound
+		}
+		result = append(result, value)
+	}
+	return json.MarshalIndent(result, "", "  ")
+}
+
+func (c *arrayCodec) id(item json.RawMessage) (string, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(item, &fields)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if fields[c.key] != nil {
+		err = json.Unmarshal(fields[c.key], &id)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", c.key, err)
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("%s is required", c.key)
+	}
+	return id, nil
+}
+
+// oidcUserCodec is for users of oidc clients in http_authenticate file
+type oidcUserCodec struct{}
+
+type authenticateDoc struct {
+	ID      string `json:"id"`
+	Clients []struct {
+		ClientID string                   `json:"client_id"`
+		Users    []*authenticate.UserInfo `json:"users"`
+	} `json:"clients"`
+}
+
+func (c *oidcUserCodec) decode(content []byte) (map[string]json.RawMessage, error) {
+	docs := make([]*authenticateDoc, 0)
+	err := json.Unmarshal(content, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]json.RawMessage)
+	for _, doc := range docs {
+		for _, client := range doc.Clients {
+			for _, userInfo := range client.Users {
+				user := &OIDCUser{
+					AuthID:   doc.ID,
+					ClientID: client.ClientID,
+					UserInfo: *userInfo,
+				}
+				value, err := json.Marshal(user)
+				if err != nil {
+					return nil, err
+				}
+				records[user.ID()] = value
+			}
+		}
+	}
+	return records, nil
+}
+
+// update puts the user into users of its client
+// other fields of the file are kept
+func (c *oidcUserCodec) update(content []byte, id string, value json.RawMessage) ([]byte, error) {
+	authID, clientID, username, err := parseOIDCUserID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *OIDCUser
+	if value != nil {
+		user, err = decodeOIDCUser(value)
+		if err != nil {
+			return nil, err
+		}
+		if user.ID() != id {
+			return nil, fmt.Errorf("oidc user %s mismatch %s", user.ID(), id)
+		}
+	}
+
+	docs := make([]map[string]json.RawMessage, 0)
+	err = json.Unmarshal(content, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range docs {
+		var docID string
+		json.Unmarshal(doc["id"], &docID)
+		if docID != authID {
+			continue
+		}
+
+		clients := make([]map[string]json.RawMessage, 0)
+		err = json.Unmarshal(doc["clients"], &clients)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, client := range clients {
+			var cid string
+			json.Unmarshal(client["client_id"], &cid)
+			if cid != clientID {
+				continue
+			}
+
+			users := make([]*authenticate.UserInfo, 0)
+			if client["users"] != nil {
+				err = json.Unmarshal(client["users"], &users)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			users, err = updateUsers(users, username, user)
+			if err != nil {
+				return nil, err
+			}
+
+			client["users"], _ = json.Marshal(users)
+			doc["clients"], _ = json.Marshal(clients)
+			return json.MarshalIndent(docs, "", "  ")
+		}
+	}
+	return nil, fmt.Errorf("oidc client %s of %s not found", clientID, authID)
+}
+
+// updateUsers replaces user username, user is deleted if user is nil
+func updateUsers(users []*authenticate.UserInfo, username string, user *OIDCUser) ([]*authenticate.UserInfo, error) {
+	for i, u := range users {
+		if u.Username != username {
+			continue
+		}
+		if user == nil {
+			return append(users[:i], users[i+1:]...), nil
+		}
+		users[i] = &user.UserInfo
+		return users, nil
+	}
+
+	if user == nil {
+		return nil, ErrRecordNotFound
+	}
+	return append(users, &user.UserInfo), nil
+}
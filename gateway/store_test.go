@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	convey.Convey("test store", t, func() {
+		dir := t.TempDir()
+		files := map[string]string{
+			StoreKindListener: filepath.Join(dir, "listener.json"),
+			StoreKindClient:   filepath.Join(dir, "client.json"),
+			StoreKindOIDCUser: filepath.Join(dir, "authenticate.json"),
+		}
+		os.WriteFile(files[StoreKindListener], []byte(`[{"id": "1", "client_id": "c1", "public_port": 10000}]`), 0644)
+		os.WriteFile(files[StoreKindClient], []byte(`[{"client_id": "c1", "secret": "s1"}]`), 0644)
+		os.WriteFile(files[StoreKindOIDCUser], []byte(`[{"id": "1", "type": "OIDC",
+			"clients": [{"client_id": "app", "users": [{"username": "u1", "password": "p1"}]}]}]`), 0644)
+
+		convey.Convey("test file store", func() {
+			s, err := newFileStore(files)
+			convey.So(err, convey.ShouldBeNil)
+
+			events := make([]*StoreEvent, 0)
+			s.Watch(func(ev *StoreEvent) {
+				events = append(events, ev)
+			})
+
+			listeners, err := storeListeners(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(listeners), convey.ShouldEqual, 1)
+			convey.So(listeners[0].PublicPort, convey.ShouldEqual, 10000)
+
+			err = storePut(s, StoreKindListener, "2", &ListenerConfig{ID: "2", ClientID: "c1"})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(events), convey.ShouldEqual, 1)
+			convey.So(events[0].ID, convey.ShouldEqual, "2")
+
+			// mismatch id is rejected
+			err = storePut(s, StoreKindListener, "3", &ListenerConfig{ID: "2"})
+			convey.So(err, convey.ShouldNotBeNil)
+
+			// invalid record is not written
+			err = storePut(s, StoreKindListener, "3", &ListenerConfig{ID: "3", Compression: "gzip"})
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(len(events), convey.ShouldEqual, 1)
+			convey.So(s.Reload(nil), convey.ShouldBeNil)
+
+			err = s.Delete(StoreKindListener, "1")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(events[1].ID, convey.ShouldEqual, "1")
+			convey.So(events[1].Value, convey.ShouldBeNil)
+			convey.So(s.Delete(StoreKindListener, "1"), convey.ShouldEqual, ErrRecordNotFound)
+
+			// file edited by hand
+			os.WriteFile(files[StoreKindClient], []byte(`[{"client_id": "c2", "secret": "s2"}]`), 0644)
+			convey.So(s.Reload(nil), convey.ShouldBeNil)
+			convey.So(len(events), convey.ShouldEqual, 4)
+
+			// reload is rejected if any file is invalid
+			os.WriteFile(files[StoreKindClient], []byte(`[{"client_id": "c3", "secret": "s3"}]`), 0644)
+			os.WriteFile(files[StoreKindListener], []byte(`[{"id": "1"`), 0644)
+			applied := false
+			err = s.Reload(func(map[string]map[string]json.RawMessage, []*StoreEvent) error {
+				applied = true
+				return nil
+			})
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(applied, convey.ShouldBeFalse)
+			convey.So(len(events), convey.ShouldEqual, 4)
+			os.WriteFile(files[StoreKindListener], []byte(`[{"id": "2", "client_id": "c1"}]`), 0644)
+			clients, err := storeClients(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(clients), convey.ShouldEqual, 1)
+			convey.So(clients[0].ClientID, convey.ShouldEqual, "c2")
+
+			// users are kept in authenticate file
+			user := &OIDCUser{AuthID: "1", ClientID: "app"}
+			user.Username, user.Password = "u2", "p2"
+			err = storePut(s, StoreKindOIDCUser, user.ID(), user)
+			convey.So(err, convey.ShouldBeNil)
+			err = s.Delete(StoreKindOIDCUser, "1/app/u1")
+			convey.So(err, convey.ShouldBeNil)
+			users, err := storeOIDCUsers(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(users), convey.ShouldEqual, 1)
+			convey.So(users[0].ID(), convey.ShouldEqual, "1/app/u2")
+
+			content, _ := os.ReadFile(files[StoreKindOIDCUser])
+			var docs []map[string]interface{}
+			convey.So(json.Unmarshal(content, &docs), convey.ShouldBeNil)
+			convey.So(docs[0]["type"], convey.ShouldEqual, "OIDC")
+
+			// client of user must exist
+			user.ClientID = "unknown"
+			convey.So(storePut(s, StoreKindOIDCUser, user.ID(), user), convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test ssl files", func() {
+			files[StoreKindSSL] = filepath.Join(dir, "ssl.json")
+			certFile, keyFile := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+			os.WriteFile(certFile, []byte("cert1"), 0644)
+			os.WriteFile(keyFile, []byte("key1"), 0600)
+			os.WriteFile(files[StoreKindSSL], []byte(`[]`), 0644)
+			s, err := newFileStore(files)
+			convey.So(err, convey.ShouldBeNil)
+			os.Remove(files[StoreKindSSL])
+
+			// store may be read by watchers
+			events := make([]*StoreEvent, 0)
+			s.Watch(func(ev *StoreEvent) {
+				_, err := s.Get(ev.Kind, ev.ID)
+				convey.So(err == nil, convey.ShouldEqual, ev.Value != nil)
+				events = append(events, ev)
+			})
+			err = storePut(s, StoreKindSSL, "a", &SSLConfig{ID: "a", CertFile: certFile, KeyFile: keyFile})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(events), convey.ShouldEqual, 1)
+
+			// file is created only readable by owner
+			info, err := os.Stat(files[StoreKindSSL])
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Mode().Perm(), convey.ShouldEqual, os.FileMode(0600))
+
+			// key is never kept in record or file
+			value, err := s.Get(StoreKindSSL, "a")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(value), convey.ShouldNotContainSubstring, "key1")
+			content, _ := os.ReadFile(files[StoreKindSSL])
+			convey.So(string(content), convey.ShouldNotContainSubstring, "key1")
+			confs, err := storeSSLs(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(confs[0].Key, convey.ShouldEqual, "key1")
+
+			// changes of key file are found by reload
+			os.WriteFile(keyFile, []byte("key2"), 0600)
+			convey.So(s.Reload(nil), convey.ShouldBeNil)
+			convey.So(len(events), convey.ShouldEqual, 2)
+			convey.So(string(events[1].Value), convey.ShouldNotContainSubstring, "key2")
+		})
+
+		convey.Convey("test bolt store", func() {
+			path := filepath.Join(dir, "zta.db")
+			s, err := newBoltStore(path)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(s.importFiles(files), convey.ShouldBeNil)
+
+			listeners, err := storeListeners(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(listeners), convey.ShouldEqual, 1)
+			users, err := storeOIDCUsers(s)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(users), convey.ShouldEqual, 1)
+
+			events := make([]*StoreEvent, 0)
+			s.Watch(func(ev *StoreEvent) {
+				events = append(events, ev)
+			})
+			convey.So(s.Delete(StoreKindListener, "1"), convey.ShouldBeNil)
+			convey.So(s.Delete(StoreKindListener, "1"), convey.ShouldEqual, ErrRecordNotFound)
+			convey.So(len(events), convey.ShouldEqual, 1)
+
+			// invalid record is not stored
+			err = storePut(s, StoreKindListener, "3", &ListenerConfig{ID: "3", Compression: "gzip"})
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(len(events), convey.ShouldEqual, 1)
+			_, err = s.Get(StoreKindListener, "3")
+			convey.So(err, convey.ShouldEqual, ErrRecordNotFound)
+			convey.So(s.Close(), convey.ShouldBeNil)
+
+			// files are imported only once
+			s, err = newBoltStore(path)
+			convey.So(err, convey.ShouldBeNil)
+			defer s.Close()
+			convey.So(s.importFiles(files), convey.ShouldBeNil)
+			_, err = s.Get(StoreKindListener, "1")
+			convey.So(err, convey.ShouldEqual, ErrRecordNotFound)
+		})
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+func newTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.ClientCAFile != "" {
+		content, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyClientCert checks the client certificate is issued for clientID
+// the CN or one of the DNS/URI SANs must equal to clientID
+// conn is a tls connection or a stream of quic connection
+func verifyClientCert(conn net.Conn, clientID string) error {
+	tlsConn, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return fmt.Errorf("not a tls connection")
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+
+	cert := certs[0]
+	if cert.Subject.CommonName == clientID {
+		return nil
+	}
+
+	for _, name := range cert.DNSNames {
+		if name == clientID {
+			return nil
+		}
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.String() == clientID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client certificate %s is not issued for %s",
+		cert.Subject.CommonName, clientID)
+}
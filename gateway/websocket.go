@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/ICKelin/zta/common"
+	"github.com/ICKelin/zta/common/mux"
+	"github.com/astaxie/beego/logs"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+)
+
+// listenWebSocket listens tunnel over websocket for clients
+// that can only reach gateway through http proxies
+// it is https if tls is configured
+func (gw *Gateway) listenWebSocket() (net.Listener, error) {
+	listener, err := net.Listen("tcp", gw.conf.WebSocket.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if gw.conf.TLS != nil {
+		tlsConfig, err := newTLSConfig(gw.conf.TLS)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+func (gw *Gateway) serveWebSocket(listener net.Listener) error {
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: handshakeTimeout,
+		ReadBufferSize:   1024 * 32,
+		WriteBufferSize:  1024 * 32,
+	}
+
+	handler := http.NewServeMux()
+	handler.HandleFunc(gw.conf.WebSocket.Path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logs.Warn("websocket upgrade from %s fail: %v", r.RemoteAddr, err)
+			return
+		}
+
+		conn := common.NewWSConn(ws, r.TLS)
+		gw.serve(conn, TransportWebSocket, func(sess *Session) (mux.Session, error) {
+			return mux.Server(conn, sess.Mux, gw.conf.Mux)
+		})
+	})
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+	return srv.Serve(listener)
+}